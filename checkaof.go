@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"redis-clone/persistance"
+)
+
+// checkAOF implements the check-aof subcommand: it validates an AOF given
+// as a manifest or a single file and with -fix truncates a broken last
+// file to its last complete command. It returns the exit status.
+func checkAOF(args []string) int {
+	fs := flag.NewFlagSet("check-aof", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "truncate the AOF at the last valid command")
+	keyFile := fs.String("key-file", "", "key file to decrypt an encrypted AOF with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-aof [-fix] [-key-file file] <file.manifest|file.aof>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var keyring *persistance.Keyring
+	if *keyFile != "" {
+		var err error
+		if keyring, err = persistance.LoadKeyring(*keyFile); err != nil {
+			fmt.Fprintln(os.Stderr, "check-aof:", err)
+			return 1
+		}
+	}
+
+	checks, err := persistance.CheckAOF(fs.Arg(0), keyring)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check-aof:", err)
+		return 1
+	}
+
+	for _, check := range checks {
+		if check.Err == nil {
+			fmt.Printf("%s: OK (%d bytes)\n", check.File, check.Size)
+			continue
+		}
+		fmt.Printf("%s: %s\n", check.File, check.Err.Reason)
+		fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n",
+			check.Size, check.Err.Offset, check.Size-check.Err.Offset)
+		if !*fix {
+			fmt.Println("AOF is not valid. Use the -fix option to try fixing it.")
+			return 1
+		}
+		if err := persistance.FixAOF(check); err != nil {
+			fmt.Fprintln(os.Stderr, "check-aof:", err)
+			return 1
+		}
+		fmt.Printf("Successfully truncated %s to %d bytes.\n", check.File, check.Err.Offset)
+		return 0
+	}
+	fmt.Println("AOF is valid")
+	return 0
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"redis-clone/persistance"
+	"redis-clone/store"
+)
+
+// Rough per-key and per-element overheads of the server's data structures,
+// for memory estimates: the keyspace map entry, the index of the key and
+// the value's own headers, then a string header and a slot in the slice
+// or map holding it.
+const (
+	keyOverhead     = 96
+	elementOverhead = 32
+)
+
+var inspectTypeNames = map[byte]string{
+	persistance.TypeString: "string",
+	persistance.TypeList:   "list",
+	persistance.TypeSet:    "set",
+	persistance.TypeHash:   "hash",
+	persistance.TypeZSet:   "zset",
+}
+
+// ttlBuckets are the rows of the TTL distribution, by remaining time to
+// live.
+var ttlBuckets = []struct {
+	name  string
+	below time.Duration
+}{
+	{"< 1m", time.Minute},
+	{"< 1h", time.Hour},
+	{"< 1d", 24 * time.Hour},
+	{"< 7d", 7 * 24 * time.Hour},
+	{">= 7d", 1<<63 - 1},
+}
+
+// inspect implements the inspect subcommand: it reads an RDB snapshot or
+// an AOF without starting a server and reports key counts per type, the
+// distribution of TTLs, memory estimates and the largest keys. With -match
+// or -grep it prints the selected keys as JSON Lines instead. It returns
+// the exit status.
+func inspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of largest keys to list")
+	match := fs.String("match", "", "print the keys matching this glob-style pattern, as KEYS does")
+	grep := fs.String("grep", "", "print the keys whose name or any element matches this regular expression")
+	keyFile := fs.String("key-file", "", "key file to decrypt the input with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s inspect [-top n] [-match pattern] [-grep regexp] [-key-file file] <file.rdb|file.manifest|file.aof>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	var re *regexp.Regexp
+	if *grep != "" {
+		var err error
+		if re, err = regexp.Compile(*grep); err != nil {
+			fmt.Fprintln(os.Stderr, "inspect: invalid -grep:", err)
+			return 2
+		}
+	}
+
+	snap, err := loadDataset(fs.Arg(0), *keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "inspect:", err)
+		return 1
+	}
+
+	if *match != "" || re != nil {
+		w := persistance.NewJSONWriter(os.Stdout)
+		for _, e := range snap.Entries {
+			if *match != "" && *match != "*" && !store.MatchPattern(*match, e.Key) {
+				continue
+			}
+			if re != nil && !grepEntry(re, e) {
+				continue
+			}
+			if err := w.WriteEntry(e); err != nil {
+				fmt.Fprintln(os.Stderr, "inspect:", err)
+				return 1
+			}
+		}
+		if err := w.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, "inspect:", err)
+			return 1
+		}
+		return 0
+	}
+
+	printReport(fs.Arg(0), snap.Entries, *top)
+	return 0
+}
+
+func grepEntry(re *regexp.Regexp, e persistance.Entry) bool {
+	if re.MatchString(e.Key) || (e.Object.Type == persistance.TypeString && re.MatchString(e.Object.Value)) {
+		return true
+	}
+	for _, item := range e.Object.Items {
+		if re.MatchString(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyStats is what the report knows about one key.
+type keyStats struct {
+	entry  persistance.Entry
+	length int // bytes of a string, elements of anything else
+	memory int64
+}
+
+func statsOf(e persistance.Entry) keyStats {
+	st := keyStats{entry: e, memory: keyOverhead + int64(len(e.Key))}
+	switch e.Object.Type {
+	case persistance.TypeString:
+		st.length = len(e.Object.Value)
+		st.memory += int64(len(e.Object.Value))
+	case persistance.TypeHash, persistance.TypeZSet:
+		st.length = len(e.Object.Items) / 2
+	default:
+		st.length = len(e.Object.Items)
+	}
+	for _, item := range e.Object.Items {
+		st.memory += elementOverhead + int64(len(item))
+	}
+	return st
+}
+
+func printReport(path string, entries []persistance.Entry, top int) {
+	type typeRow struct {
+		keys, elements int
+		memory         int64
+	}
+	byType := make(map[byte]*typeRow)
+	byTTL := make([]int, len(ttlBuckets))
+	noTTL, expired := 0, 0
+	dbs := make(map[int]int)
+	stats := make([]keyStats, 0, len(entries))
+	var total int64
+	now := time.Now().UnixMilli()
+
+	for _, e := range entries {
+		st := statsOf(e)
+		stats = append(stats, st)
+		total += st.memory
+		dbs[e.DB]++
+
+		row := byType[e.Object.Type]
+		if row == nil {
+			row = &typeRow{}
+			byType[e.Object.Type] = row
+		}
+		row.keys++
+		row.memory += st.memory
+		if e.Object.Type == persistance.TypeString {
+			row.elements++
+		} else {
+			row.elements += st.length
+		}
+
+		switch {
+		case e.ExpireAt == 0:
+			noTTL++
+		case e.ExpireAt <= now:
+			expired++
+		default:
+			ttl := time.Duration(e.ExpireAt-now) * time.Millisecond
+			for i, b := range ttlBuckets {
+				if ttl < b.below {
+					byTTL[i]++
+					break
+				}
+			}
+		}
+	}
+
+	fmt.Printf("%s: %d keys, about %s in memory\n", path, len(entries), formatBytes(total))
+	if len(dbs) > 1 || (len(entries) > 0 && dbs[0] == 0) {
+		ids := make([]int, 0, len(dbs))
+		for db := range dbs {
+			ids = append(ids, db)
+		}
+		sort.Ints(ids)
+		for _, db := range ids {
+			fmt.Printf("  db%d: %d keys\n", db, dbs[db])
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nTYPE\tKEYS\tELEMENTS\tMEMORY")
+	for _, t := range []byte{persistance.TypeString, persistance.TypeList, persistance.TypeSet, persistance.TypeHash, persistance.TypeZSet} {
+		if row := byType[t]; row != nil {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", inspectTypeNames[t], row.keys, row.elements, formatBytes(row.memory))
+		}
+	}
+
+	fmt.Fprintln(tw, "\nTTL\tKEYS")
+	fmt.Fprintf(tw, "none\t%d\n", noTTL)
+	fmt.Fprintf(tw, "expired\t%d\n", expired)
+	for i, b := range ttlBuckets {
+		fmt.Fprintf(tw, "%s\t%d\n", b.name, byTTL[i])
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].memory > stats[j].memory })
+	fmt.Fprintf(tw, "\nLARGEST KEYS\tTYPE\tLENGTH\tMEMORY\n")
+	for _, st := range stats[:min(top, len(stats))] {
+		unit := "items"
+		if st.entry.Object.Type == persistance.TypeString {
+			unit = "bytes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d %s\t%s\n", displayKey(st.entry), inspectTypeNames[st.entry.Object.Type], st.length, unit, formatBytes(st.memory))
+	}
+	tw.Flush()
+}
+
+// displayKey quotes keys that wouldn't print cleanly and names the
+// database of keys outside DB 0.
+func displayKey(e persistance.Entry) string {
+	key := e.Key
+	if !strconv.CanBackquote(key) || key == "" {
+		key = strconv.Quote(key)
+	}
+	if e.DB != 0 {
+		key = fmt.Sprintf("%s (db%d)", key, e.DB)
+	}
+	return key
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,62 +1,136 @@
 package main
 
 import (
-	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"time"
+	"os"
+	"strconv"
+	"strings"
 
 	"redis-clone/persistance"
 	"redis-clone/server"
 	"redis-clone/store"
 )
 
-func init() {
-	// Register all possible value types stored in MemoryStore
-	gob.Register("")                  // string values
-	gob.Register([]string{})          // list values
-	gob.Register(map[string]string{}) // hash values
-	gob.Register(map[string]bool{})   // set values
-}
+// Parameters that can be set on the command line, e.g. -save "900 1".
+// They take the same values as CONFIG SET.
+var configFlags = []string{"save", "stop-writes-on-bgsave-error", "dbfilename", "rdb-keep-snapshots",
+	"rdbcompression", "rdb-file-compression", "appendfsync",
+	"auto-aof-rewrite-percentage", "auto-aof-rewrite-min-size", "aof-use-rdb-preamble",
+	"aof-load-truncated", "aof-timestamp-enabled", "encryption-key-file",
+	"tiered-storage-max-memory", "tiered-storage-policy", "tiered-storage-dir", "replica-read-only",
+	"repl-backlog-size"}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(checkAOF(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "recover-aof" {
+		os.Exit(recoverAOF(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dump-json" {
+		os.Exit(dumpJSON(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "load-json" {
+		os.Exit(loadJSON(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		os.Exit(inspect(os.Args[2:]))
+	}
+
+	overrides := make(map[string]*string)
+	for _, name := range configFlags {
+		overrides[name] = flag.String(name, "", "set the "+name+" config parameter")
+	}
+	port := flag.Int("port", 6399, "TCP port to listen on")
+	replicaOf := flag.String("replicaof", "", "replicate the master at \"host port\"")
+	flag.Parse()
+
 	// === Load AOF (Append Only File) ===
-	aof, err := persistance.NewAOF("appendonly.aof")
+	aof, err := persistance.OpenAOF("appendonlydir", "appendonly.aof")
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	// === Initialize in-memory store with AOF support ===
 	memStore := store.NewMemoryStoreWithAOF(nil)
-
-	// === Load RDB snapshot if available ===
-	if err = memStore.LoadSnapshot("dump.rdb"); err == nil {
-		log.Println("[RDB] Snapshot loaded from dump.rdb")
-	} else {
-		log.Println("[RDB] No snapshot found")
-	}
-
-	// Replay AOF commands
-	err = aof.Replay("appendonly.aof", func(cmd string, args []string) error {
-		memStore.ExecuteRaw(cmd, args) // You need to implement this
-		return nil
+	flag.Visit(func(f *flag.Flag) {
+		value, ok := overrides[f.Name]
+		if !ok {
+			return
+		}
+		if err := memStore.InitConfig(f.Name, *value); err != nil {
+			log.Fatalf("invalid -%s: %v", f.Name, err)
+		}
 	})
-	if err != nil {
-		log.Println("[AOF] Replay error:", err)
-	} else {
-		log.Println("[AOF] Replay completed")
-	}
 
-	// == Set AOF for memStore
-	memStore.SetAOF(aof)
+	// === Load the dataset ===
+	if err := restoreDataset(memStore, aof); err != nil {
+		log.Println("[AOF]", err)
+		if errors.Is(err, errAOFReplay) {
+			var aofErr *persistance.AOFError
+			if errors.As(err, &aofErr) && aofErr.Truncated {
+				log.Println("[AOF] Setting aof-load-truncated to yes loads the AOF up to the last complete command.")
+			}
+			log.Fatalf("[AOF] Make a backup of the AOF, then run: %s check-aof -fix %s", os.Args[0], aof.ManifestPath())
+		}
+		os.Exit(1)
+	}
 
-	// === Start auto-saving RDB every 10 seconds ===
-	memStore.StartAutoSave("dump.rdb", 10*time.Second)
+	// === Save RDB snapshots at the configured save points ===
+	memStore.StartAutoSave()
 
-	s := server.New(":6399")
+	s := server.New(fmt.Sprintf(":%d", *port))
 	s.AttachStore(memStore)
+	if *replicaOf != "" {
+		host, masterPort, ok := strings.Cut(*replicaOf, " ")
+		n, err := strconv.Atoi(masterPort)
+		if !ok || err != nil || n <= 0 || n > 65535 {
+			log.Fatalf("invalid -replicaof %q: want \"host port\"", *replicaOf)
+		}
+		s.ReplicaOf(host, n)
+	}
 
-	log.Println("Server running on port: 6399...")
+	log.Printf("Server running on port: %d...", *port)
 	if err := s.ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+var errAOFReplay = errors.New("replay error")
+
+// restoreDataset fills memStore and attaches aof to it. The AOF holds every
+// write since it was created, so it alone is replayed; loading the
+// snapshot as well would apply writes twice. The snapshot only seeds a
+// new AOF, as the base file of its first rewrite. Replay failures wrap
+// errAOFReplay.
+func restoreDataset(memStore *store.MemoryStore, aof *persistance.AOF) error {
+	if !aof.Empty() {
+		if err := memStore.ReplayAOF(aof); err != nil {
+			return fmt.Errorf("%w: %w", errAOFReplay, err)
+		}
+		log.Println("[AOF] Replay completed")
+		return memStore.SetAOF(aof)
+	}
+
+	if err := memStore.LoadSnapshot(memStore.DBFilename()); err == nil {
+		log.Println("[RDB] Snapshot loaded")
+	} else if errors.Is(err, os.ErrNotExist) {
+		log.Println("[RDB] No snapshot found")
+	} else {
+		log.Println("[RDB] WARNING: no usable snapshot, starting with an empty dataset:", err)
+	}
+
+	if err := memStore.SetAOF(aof); err != nil {
+		return err
+	}
+	if memStore.DBSize() > 0 {
+		log.Println("[AOF] Creating the AOF base file from the snapshot")
+		if err := memStore.RewriteAOF(); err != nil {
+			return fmt.Errorf("can't create the AOF base file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"redis-clone/persistance"
+	"redis-clone/store"
+)
+
+// inTempDir runs the test in a new temporary working directory, where
+// the server keeps its snapshot and AOF.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// restart opens the AOF and restores the dataset the way main does.
+func restart(t *testing.T) (*store.MemoryStore, *persistance.AOF) {
+	t.Helper()
+	aof, err := persistance.OpenAOF("appendonlydir", "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memStore := store.NewMemoryStoreWithAOF(nil)
+	if err := restoreDataset(memStore, aof); err != nil {
+		t.Fatal(err)
+	}
+	return memStore, aof
+}
+
+// incr runs INCR like a client would, flushing the AOF after it.
+func incr(t *testing.T, memStore *store.MemoryStore, key string) {
+	t.Helper()
+	if reply := memStore.ExecuteRaw("INCR", []string{key}); reply[0] != ':' {
+		t.Fatalf("INCR %s = %q", key, reply)
+	}
+	if err := memStore.FlushAOF(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkCounter(t *testing.T, memStore *store.MemoryStore, key string, want int) {
+	t.Helper()
+	got, ok, err := memStore.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		got = "0"
+	}
+	if got != strconv.Itoa(want) {
+		t.Fatalf("%s = %q, want %d", key, got, want)
+	}
+}
+
+// TestRestartKeepsCounters restarts repeatedly with the AOF as the
+// authority, taking snapshots along the way that must not be replayed
+// on top of it.
+func TestRestartKeepsCounters(t *testing.T) {
+	inTempDir(t)
+
+	for cycle := 0; cycle < 5; cycle++ {
+		memStore, aof := restart(t)
+		checkCounter(t, memStore, "counter", cycle*3)
+		for i := 0; i < 3; i++ {
+			incr(t, memStore, "counter")
+		}
+		if cycle%2 == 1 {
+			if err := memStore.SaveSnapshot(memStore.DBFilename()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := aof.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	memStore, aof := restart(t)
+	defer aof.Close()
+	checkCounter(t, memStore, "counter", 15)
+}
+
+// TestRestartFromSnapshot starts without an AOF but with a snapshot,
+// which seeds the AOF base file; the restarts after it replay the AOF
+// alone.
+func TestRestartFromSnapshot(t *testing.T) {
+	inTempDir(t)
+
+	memStore, aof := restart(t)
+	for i := 0; i < 5; i++ {
+		incr(t, memStore, "counter")
+	}
+	if err := memStore.SaveSnapshot(memStore.DBFilename()); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll("appendonlydir"); err != nil {
+		t.Fatal(err)
+	}
+
+	for cycle := 0; cycle < 4; cycle++ {
+		memStore, aof := restart(t)
+		checkCounter(t, memStore, "counter", 5+cycle)
+		incr(t, memStore, "counter")
+		if err := aof.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if cycle == 0 {
+			// From here on the AOF base file holds the snapshot.
+			if err := os.Remove(memStore.DBFilename()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	memStore, aof = restart(t)
+	defer aof.Close()
+	checkCounter(t, memStore, "counter", 9)
+}
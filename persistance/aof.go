@@ -2,66 +2,738 @@ package persistance
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
+)
 
-	"redis-clone/resp"
+// appendfsync policies.
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
 )
 
+// AOF is a multi-part append only file in the layout of Redis 7: a
+// directory holding a base file (RDB or AOF format), incremental AOF files
+// and a manifest listing them. Commands are appended to the last incr
+// file.
+//
+// Appended commands are buffered in memory. Flush writes them to the file
+// and, with FsyncAlways, to disk; with FsyncEverySec a background
+// goroutine fsyncs once a second and with FsyncNo the OS decides.
 type AOF struct {
-	file *os.File
-	mu   *sync.Mutex
+	dir      string
+	name     string // appendfilename, the prefix of every file
+	manifest *Manifest
+	file     *os.File
+	mu       *sync.Mutex
+	cond     *sync.Cond
+	done     chan struct{}
+
+	policy   string
+	buf      []byte
+	appended int64 // bytes passed to AppendCommand
+	written  int64 // bytes written to the file
+	synced   int64 // bytes known to be on disk
+	flushing bool  // a Flush is writing outside the lock
+	size     int64 // total size of the base and incr files
+	baseSize int64 // size after the last rewrite or at open
+
+	// rewriteIncr is the first incr file opened by a running rewrite,
+	// 0 when none runs.
+	rewriteIncr int64
+
+	// With timestamps every command appended in a new second is preceded
+	// by a "#TS:<unix time>" annotation, for point-in-time recovery.
+	timestamps    bool
+	lastTimestamp int64
+
+	// keyring encrypts new files, nil to write them in plaintext. enc
+	// seals the appends to the current incr file if that is encrypted;
+	// its key is nil until SetKeyring provides it.
+	keyring *Keyring
+	enc     *encWriter
+
+	// feed gets every appended command, without timestamp annotations,
+	// to pass it on to replicas. nil if unset.
+	feed func(line string)
+
+	writeErr     error
+	delayedFsync int64
+	fsyncLatency time.Duration
 }
 
-func NewAOF(path string) (*AOF, error) {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
+// OpenAOF opens the AOF stored in dir under the file name prefix name,
+// creating it if needed. A single-file AOF called name next to dir, as
+// written by older versions, becomes the base of the new one.
+func OpenAOF(dir, name string) (*AOF, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	mu := &sync.Mutex{}
+	a := &AOF{
+		dir:    dir,
+		name:   name,
+		mu:     mu,
+		cond:   sync.NewCond(mu),
+		done:   make(chan struct{}),
+		policy: FsyncEverySec,
+	}
+
+	m, err := LoadManifest(a.manifestPath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if m, err = a.upgradeLegacy(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	a.manifest = m
+	a.removeHistory()
+
+	// The last incr file may not have been created yet.
+	if err := a.openIncr(); err != nil {
 		return nil, err
 	}
-	return &AOF{
-		file: f,
-		mu:   &sync.Mutex{},
-	}, nil
+	for _, f := range a.files() {
+		info, err := os.Stat(a.path(f.Name))
+		if err != nil {
+			a.file.Close()
+			return nil, fmt.Errorf("AOF file listed in the manifest: %w", err)
+		}
+		a.size += info.Size()
+	}
+	a.baseSize = a.size
+
+	go a.fsyncEverySec()
+	return a, nil
+}
+
+func (a *AOF) manifestPath() string {
+	return a.path(a.name + ".manifest")
+}
+
+// ManifestPath returns the path of the manifest, which check-aof takes.
+func (a *AOF) ManifestPath() string {
+	return a.manifestPath()
+}
+
+func (a *AOF) path(name string) string {
+	return filepath.Join(a.dir, name)
+}
+
+func (a *AOF) baseFileName(seq int64, rdb bool) string {
+	if rdb {
+		return fmt.Sprintf("%s.%d.base.rdb", a.name, seq)
+	}
+	return fmt.Sprintf("%s.%d.base.aof", a.name, seq)
+}
+
+func (a *AOF) incrFileName(seq int64) string {
+	return fmt.Sprintf("%s.%d.incr.aof", a.name, seq)
+}
+
+// upgradeLegacy builds the first manifest, moving a single-file AOF from
+// before the multi-part layout into dir as the base.
+func (a *AOF) upgradeLegacy() (*Manifest, error) {
+	m := &Manifest{}
+	legacy := filepath.Join(filepath.Dir(a.dir), a.name)
+	if _, err := os.Stat(legacy); err == nil {
+		base := AOFFile{Name: a.baseFileName(1, false), Seq: 1, Type: AOFBase}
+		if err := os.Rename(legacy, a.path(base.Name)); err != nil {
+			return nil, fmt.Errorf("moving %s into %s: %w", legacy, a.dir, err)
+		}
+		log.Printf("[AOF] Moved %s into %s as the base of a multi-part AOF", legacy, a.dir)
+		m.Base = &base
+	}
+	m.Incrs = append(m.Incrs, AOFFile{Name: a.incrFileName(1), Seq: 1, Type: AOFIncr})
+	if err := writeManifest(a.manifestPath(), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// files returns the base and incr files in replay order.
+func (a *AOF) files() []AOFFile {
+	files := make([]AOFFile, 0, len(a.manifest.Incrs)+1)
+	if a.manifest.Base != nil {
+		files = append(files, *a.manifest.Base)
+	}
+	return append(files, a.manifest.Incrs...)
+}
+
+// openIncr opens the last incr file for appending, adding one to the
+// manifest if there is none.
+func (a *AOF) openIncr() error {
+	if a.manifest.lastIncr() == nil {
+		seq := a.manifest.nextIncrSeq()
+		a.manifest.Incrs = append(a.manifest.Incrs, AOFFile{Name: a.incrFileName(seq), Seq: seq, Type: AOFIncr})
+		if err := writeManifest(a.manifestPath(), a.manifest); err != nil {
+			return err
+		}
+	}
+	path := a.path(a.manifest.lastIncr().Name)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	header, chunks, end, err := scanChunks(path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	if header != nil {
+		a.enc = &encWriter{w: f, header: *header, chunks: chunks, size: end}
+	}
+	return nil
+}
+
+// createIncr creates a new incr file, encrypted with the current key if
+// there is one. Callers must hold a.mu.
+func (a *AOF) createIncr(name string) (*os.File, *encWriter, error) {
+	f, err := os.OpenFile(a.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := a.keyring.current()
+	if key == nil {
+		return f, nil, nil
+	}
+	enc, err := newEncWriter(f, key)
+	if err != nil {
+		f.Close()
+		os.Remove(a.path(name))
+		return nil, nil, err
+	}
+	return f, enc, nil
+}
+
+// writer returns where appends to the current incr file go.
+func (a *AOF) writer() io.Writer {
+	if a.enc != nil {
+		return a.enc
+	}
+	return a.file
+}
+
+// grown returns by how much writing n appended bytes grows the file.
+func (a *AOF) grown(n int) int64 {
+	if a.enc != nil && n > 0 {
+		return sealedSize(n)
+	}
+	return int64(n)
+}
+
+// Empty reports whether the AOF holds no data at all: no base file and
+// nothing in the incr files, as right after it was created.
+func (a *AOF) Empty() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.manifest.Base == nil && a.size == 0 && len(a.buf) == 0
+}
+
+// removeHistory deletes the files a rewrite replaced and drops them from
+// the manifest.
+func (a *AOF) removeHistory() {
+	if len(a.manifest.History) == 0 {
+		return
+	}
+	for _, f := range a.manifest.History {
+		if err := os.Remove(a.path(f.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("[AOF] Failed to remove old AOF file:", err)
+		}
+	}
+	a.manifest.History = nil
+	if err := writeManifest(a.manifestPath(), a.manifest); err != nil {
+		log.Println("[AOF] Failed to update the AOF manifest:", err)
+	}
 }
 
+// SetFsyncPolicy switches between FsyncAlways, FsyncEverySec and FsyncNo.
+func (a *AOF) SetFsyncPolicy(policy string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.policy = policy
+}
+
+// SetKeyring sets the keys new AOF files are encrypted with, nil to stop
+// encrypting. If the current incr file was written with another key, or
+// with none, appends move on to a new incr file; the older files keep
+// their key until the next rewrite replaces them.
+func (a *AOF) SetKeyring(k *Keyring) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.flushing {
+		a.cond.Wait()
+	}
+	a.keyring = k
+	key := k.current()
+	switch {
+	case a.enc == nil && key == nil:
+		return nil
+	case a.enc != nil && key != nil && a.enc.header.key == key.id:
+		a.enc.key = key
+		return nil
+	}
+
+	if info, err := a.file.Stat(); err == nil && info.Size() == 0 && len(a.buf) == 0 {
+		// Nothing written yet, the file can start encrypted right away.
+		enc, err := newEncWriter(a.file, key)
+		if err != nil {
+			return err
+		}
+		a.enc = enc
+		a.size += encHeaderSize
+		return nil
+	}
+	if _, err := a.switchIncr(); err != nil {
+		return err
+	}
+	if key != nil {
+		log.Printf("[AOF] Appending to %s encrypted with key %s", a.manifest.lastIncr().Name, key.id)
+	} else {
+		log.Printf("[AOF] Appending to %s unencrypted", a.manifest.lastIncr().Name)
+	}
+	return nil
+}
+
+// SetTimestamps turns the timestamp annotations on or off.
+func (a *AOF) SetTimestamps(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.timestamps = enabled
+	a.lastTimestamp = 0
+}
+
+// SetFeed makes AppendCommand pass every command to feed as well, in the
+// order they are appended. feed runs with the AOF locked and must not
+// block.
+func (a *AOF) SetFeed(feed func(line string)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.feed = feed
+}
+
+// AppendCommand queues a command for the next Flush.
 func (a *AOF) AppendCommand(cmd string, args ...string) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	// Format as RESP command
+	line := encodeCommand(cmd, args)
+	if a.feed != nil {
+		a.feed(line)
+	}
+	if a.timestamps {
+		if now := time.Now().Unix(); now != a.lastTimestamp {
+			line = fmt.Sprintf("#TS:%d\r\n", now) + line
+			a.lastTimestamp = now
+		}
+	}
+	a.buf = append(a.buf, line...)
+	a.appended += int64(len(line))
+	return nil
+}
+
+// encodeCommand formats a command as a RESP array.
+func encodeCommand(cmd string, args []string) string {
 	line := fmt.Sprintf("*%d\r\n", len(args)+1)
 	line += fmt.Sprintf("$%d\r\n%s\r\n", len(cmd), cmd)
 	for _, arg := range args {
 		line += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
 	}
-	_, err := a.file.WriteString(line)
+	return line
+}
+
+// WriteCommand writes a command to w in the AOF format.
+func WriteCommand(w io.Writer, cmd string, args ...string) error {
+	_, err := io.WriteString(w, encodeCommand(cmd, args))
 	return err
 }
 
-func (a *AOF) Close() error {
-	return a.file.Close()
+// Flush writes everything appended so far to the file, and with
+// FsyncAlways fsyncs it, before returning. It is meant to run before
+// replying to a client. Concurrent callers are group committed: while one
+// of them writes and fsyncs, the others wait and the next one takes care
+// of everything that was appended in the meantime.
+func (a *AOF) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	target := a.appended
+	for {
+		done := a.written >= target
+		if a.policy == FsyncAlways {
+			done = a.synced >= target
+		}
+		if done {
+			return nil
+		}
+		if a.flushing {
+			a.cond.Wait()
+			continue
+		}
+		if err := a.flushLocked(); err != nil {
+			return err
+		}
+	}
 }
 
-func (a *AOF) Replay(path string, handle func(cmd string, args []string) error) error {
-	f, err := os.Open(path)
+// flushLocked writes the buffer with a.mu released so commands can keep
+// being appended. Callers must hold a.mu.
+func (a *AOF) flushLocked() error {
+	a.flushing = true
+	buf, policy, file, out := a.buf, a.policy, a.file, a.writer()
+	a.buf = nil
+	a.mu.Unlock()
+
+	n, err := out.Write(buf)
+	var latency time.Duration
+	if err == nil && policy == FsyncAlways {
+		start := time.Now()
+		err = file.Sync()
+		latency = time.Since(start)
+	}
+
+	a.mu.Lock()
+	a.flushing = false
+	a.cond.Broadcast()
+	a.written += int64(n)
+	a.size += a.grown(n)
+	if n < len(buf) {
+		// Keep what didn't make it to the file for the next attempt.
+		a.buf = append(buf[n:], a.buf...)
+	}
+	a.writeErr = err
 	if err != nil {
+		log.Println("[AOF] Error writing to the AOF:", err)
 		return err
 	}
-	defer f.Close()
+	if policy == FsyncAlways {
+		a.synced = a.written
+		a.fsyncLatency = latency
+	}
+	return nil
+}
+
+// fsyncEverySec fsyncs the written part of the file once a second under
+// FsyncEverySec. An fsync still running when the next one is due counts as
+// delayed.
+func (a *AOF) fsyncEverySec() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	reader := bufio.NewReader(f)
 	for {
-		cmd, args, err := resp.ParseRESP(reader)
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		target, file := a.written, a.file
+		due := a.policy == FsyncEverySec && a.synced < target
+		a.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		start := time.Now()
+		err := file.Sync()
+		latency := time.Since(start)
+
+		a.mu.Lock()
+		if errors.Is(err, os.ErrClosed) {
+			// A rewrite switched files and fsynced the old one itself.
+		} else if err != nil {
+			log.Println("[AOF] fsync error:", err)
+		} else if target > a.synced {
+			a.synced = target
+		}
+		a.fsyncLatency = latency
+		if latency > time.Second {
+			a.delayedFsync++
+		}
+		a.mu.Unlock()
+	}
+}
+
+// AOFStats is reported in the persistence section of INFO.
+type AOFStats struct {
+	Size          int64
+	BaseSize      int64
+	BufferLength  int
+	DelayedFsync  int64
+	LastFsync     time.Duration
+	LastWriteOK   bool
+	PendingFsyncs bool
+}
+
+func (a *AOF) Stats() AOFStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return AOFStats{
+		Size:          a.size,
+		BaseSize:      a.baseSize,
+		BufferLength:  len(a.buf),
+		DelayedFsync:  a.delayedFsync,
+		LastFsync:     a.fsyncLatency,
+		LastWriteOK:   a.writeErr == nil,
+		PendingFsyncs: a.synced < a.written,
+	}
+}
+
+// StartRewrite switches appends to a new incr file, so the files up to
+// the current one can later be replaced by a new base. It must be called
+// atomically with taking the snapshot the new base is built from.
+func (a *AOF) StartRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriteIncr != 0 {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	for a.flushing {
+		a.cond.Wait()
+	}
+
+	seq, err := a.switchIncr()
+	if err != nil {
+		return err
+	}
+	a.rewriteIncr = seq
+	return nil
+}
+
+// switchIncr writes out and fsyncs everything appended so far, then
+// makes appends go to a new incr file and returns its sequence number.
+// Callers must hold a.mu and wait for a running flush to finish.
+func (a *AOF) switchIncr() (int64, error) {
+	if _, err := a.writer().Write(a.buf); err != nil {
+		return 0, err
+	}
+	if err := a.file.Sync(); err != nil {
+		return 0, err
+	}
+	a.size += a.grown(len(a.buf))
+	a.buf = nil
+	a.written, a.synced = a.appended, a.appended
+
+	seq := a.manifest.nextIncrSeq()
+	incr := AOFFile{Name: a.incrFileName(seq), Seq: seq, Type: AOFIncr}
+	f, enc, err := a.createIncr(incr.Name)
+	if err != nil {
+		return 0, err
+	}
+	a.manifest.Incrs = append(a.manifest.Incrs, incr)
+	if err := writeManifest(a.manifestPath(), a.manifest); err != nil {
+		a.manifest.Incrs = a.manifest.Incrs[:len(a.manifest.Incrs)-1]
+		f.Close()
+		os.Remove(a.path(incr.Name))
+		return 0, err
+	}
+
+	a.file.Close()
+	a.file, a.enc = f, enc
+	if enc != nil {
+		a.size += encHeaderSize
+	}
+	// Start the new incr file with a timestamp of its own.
+	a.lastTimestamp = 0
+	return seq, nil
+}
+
+// Rewrite writes a new base file and makes it replace the base and incr
+// files that came before StartRewrite. write produces the content of the
+// base, in the RDB format if rdb is set and as commands otherwise. Appends
+// continue undisturbed into the incr file StartRewrite opened.
+func (a *AOF) Rewrite(rdb bool, write func(w io.Writer) error) (err error) {
+	tmp := a.path(fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	defer func() {
+		a.mu.Lock()
+		a.rewriteIncr = 0
+		a.mu.Unlock()
 		if err != nil {
-			break // End of file or invalid
+			os.Remove(tmp)
 		}
-		log.Println(cmd, args)
-		if err = handle(cmd, args); err != nil {
+	}()
+
+	a.mu.Lock()
+	key := a.keyring.current()
+	a.mu.Unlock()
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	if key != nil {
+		if w, err = newEncWriter(f, key); err != nil {
+			f.Close()
 			return err
 		}
 	}
+	bw := bufio.NewWriterSize(w, 64<<10)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.flushing {
+		a.cond.Wait()
+	}
+
+	m := &Manifest{}
+	base := AOFFile{Name: a.baseFileName(a.manifest.nextBaseSeq(), rdb), Seq: a.manifest.nextBaseSeq(), Type: AOFBase}
+	m.Base = &base
+	if old := a.manifest.Base; old != nil {
+		m.History = append(m.History, AOFFile{Name: old.Name, Seq: old.Seq, Type: AOFHistory})
+	}
+	for _, incr := range a.manifest.Incrs {
+		if incr.Seq >= a.rewriteIncr {
+			m.Incrs = append(m.Incrs, incr)
+		} else {
+			m.History = append(m.History, AOFFile{Name: incr.Name, Seq: incr.Seq, Type: AOFHistory})
+		}
+	}
+
+	if err := os.Rename(tmp, a.path(base.Name)); err != nil {
+		return err
+	}
+	if err := writeManifest(a.manifestPath(), m); err != nil {
+		os.Remove(a.path(base.Name))
+		return err
+	}
+
+	size := info.Size()
+	for _, incr := range m.Incrs {
+		if info, err := os.Stat(a.path(incr.Name)); err == nil {
+			size += info.Size()
+		}
+	}
+	a.manifest = m
+	a.size, a.baseSize = size, size
+	a.removeHistory()
+	return nil
+}
+
+// Close flushes and fsyncs whatever is pending and closes the file.
+func (a *AOF) Close() error {
+	close(a.done)
+	a.SetFsyncPolicy(FsyncAlways)
+	if err := a.Flush(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// Replay loads the base file and then the incr files in order. The
+// contents of an RDB base, or of the RDB preamble of an AOF base, are
+// passed to snapshot and the commands to handle. A broken file stops the
+// replay with an *AOFError saying where and why, except that with
+// loadTruncated a last file ending in a partial command is truncated to
+// its last complete command and the replay succeeds. keyring decrypts
+// encrypted files and may be nil.
+func (a *AOF) Replay(loadTruncated bool, keyring *Keyring, snapshot func(Snapshot) error, handle func(cmd string, args []string) error) error {
+	a.mu.Lock()
+	files := a.files()
+	a.mu.Unlock()
+
+	for i, file := range files {
+		err := scanAOFFile(a.path(file.Name), keyring, aofVisitor{
+			snapshot: func(snap Snapshot, _ int64) error { return snapshot(snap) },
+			command:  func(cmd string, args []string, _ int64) error { return handle(cmd, args) },
+		})
+		var aofErr *AOFError
+		if !errors.As(err, &aofErr) {
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Name, err)
+			}
+			continue
+		}
+		if !aofErr.Truncated || !loadTruncated || i != len(files)-1 {
+			return aofErr
+		}
+		if err := a.truncate(aofErr, keyring); err != nil {
+			return err
+		}
+		log.Printf("[AOF] !!! Warning: short read while loading %s, truncated it at offset %d !!!", file.Name, aofErr.Offset)
+		log.Println("[AOF] AOF loaded anyway because aof-load-truncated is enabled")
+	}
+	return nil
+}
+
+// truncate cuts the last incr file where aofErr says it breaks, and makes
+// the appends that follow pick up from the new end. An encrypted file can
+// only be cut between chunks, so the complete commands at the start of
+// the cut chunk, which were replayed, are sealed again into a new one.
+func (a *AOF) truncate(aofErr *AOFError, keyring *Keyring) error {
+	path := aofErr.File
+	var kept []byte
+	if aofErr.kept > 0 {
+		var err error
+		if kept, err = readChunkPrefix(path, aofErr.Offset, aofErr.kept, keyring); err != nil {
+			return fmt.Errorf("truncating the AOF: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(path, aofErr.Offset); err != nil {
+		return fmt.Errorf("truncating the AOF: %w", err)
+	}
+	a.size -= info.Size() - aofErr.Offset
+
+	// The chunk count and size of the file's writer are those openIncr
+	// found before the cut.
+	header, chunks, end, err := scanChunks(path)
+	if err != nil {
+		return err
+	}
+	a.enc = nil
+	if header != nil {
+		a.enc = &encWriter{w: a.file, key: keyring.lookup(header.key), header: *header, chunks: chunks, size: end}
+	}
+	if len(kept) > 0 {
+		if _, err := a.enc.Write(kept); err != nil {
+			return fmt.Errorf("truncating the AOF: %w", err)
+		}
+		a.size += sealedSize(len(kept))
+	}
+	a.baseSize = a.size
 	return nil
 }
@@ -0,0 +1,108 @@
+package persistance
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	key := strings.Repeat("0123456789abcdef", 4)
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// replayKeys replays a and returns the keys of its SET commands in
+// order.
+func replayKeys(t *testing.T, a *AOF, keyring *Keyring) []string {
+	t.Helper()
+	var keys []string
+	err := a.Replay(true, keyring, func(Snapshot) error { return nil }, func(cmd string, args []string) error {
+		keys = append(keys, args[0])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// TestReplayTruncatesEncryptedChunk tears the last chunk of an encrypted
+// incr file while the command it ends started in the chunk before. The
+// replay cuts that chunk off as a whole, so the complete commands at its
+// start must be written again, and appends must carry on from the cut.
+func TestReplayTruncatesEncryptedChunk(t *testing.T) {
+	dir := t.TempDir()
+	keyring := testKeyring(t)
+
+	a, err := OpenAOF(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetKeyring(keyring); err != nil {
+		t.Fatal(err)
+	}
+	// One flush of more than a chunk, so commands span chunks.
+	value := strings.Repeat("v", 1000)
+	n := encMaxChunk/1000 + 50
+	for i := 0; i < n; i++ {
+		a.AppendCommand("SET", "k"+strconv.Itoa(i), value)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	path := a.path(a.manifest.lastIncr().Name)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the second chunk.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-100); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err = OpenAOF(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := replayKeys(t, a, keyring)
+	if len(replayed) == 0 || len(replayed) >= n {
+		t.Fatalf("replayed %d commands, want some but not all of %d", len(replayed), n)
+	}
+	if err := a.SetKeyring(keyring); err != nil {
+		t.Fatal(err)
+	}
+	a.AppendCommand("SET", "after", "x")
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err = OpenAOF(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	got := replayKeys(t, a, keyring)
+	want := append(replayed, "after")
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("after a restart replayed %d commands ending in %v, want %d ending in %v",
+			len(got), got[max(0, len(got)-2):], len(want), want[len(want)-2:])
+	}
+}
@@ -0,0 +1,262 @@
+package persistance
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AOFError reports where and why an AOF file could not be read. Offset is
+// where the offending command starts, which is also how much of the file
+// is valid. In an encrypted file it is where the chunk holding that
+// command starts, and kept bytes of complete commands precede the
+// command in the chunk.
+type AOFError struct {
+	File      string
+	Offset    int64
+	Reason    string
+	Truncated bool // the file ends in the middle of a command
+
+	kept int64
+}
+
+func (e *AOFError) Error() string {
+	return fmt.Sprintf("%s at offset %d of %s", e.Reason, e.Offset, e.File)
+}
+
+// aofReader reads the commands of an AOF file, keeping track of the
+// offset so errors can point at the broken command.
+type aofReader struct {
+	r      *bufio.Reader
+	offset int64 // end of the last complete command
+	read   int64 // bytes consumed so far
+}
+
+// errAOFFormat is returned by readCommand for malformed input; the
+// wrapping message says what was wrong.
+var errAOFFormat = errors.New("bad file format")
+
+// readCommand returns the next command, or the text of an annotation line
+// such as "#TS:1700000000" without the '#'. At a clean end of file it
+// returns io.EOF, if the file ends inside a command io.ErrUnexpectedEOF
+// and for malformed input an error wrapping errAOFFormat.
+func (ar *aofReader) readCommand() ([]string, string, error) {
+	line, err := ar.readLine()
+	if err == io.EOF && line == "" {
+		return nil, "", io.EOF
+	}
+	if err != nil {
+		return nil, "", unexpected(err)
+	}
+	if strings.HasPrefix(line, "#") {
+		ar.offset = ar.read
+		return nil, line[1:], nil
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, "", fmt.Errorf("%w: expected '*', got %q", errAOFFormat, abbreviate(line))
+	}
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, "", fmt.Errorf("%w: invalid argument count %q", errAOFFormat, abbreviate(line))
+	}
+
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		line, err := ar.readLine()
+		if err != nil {
+			return nil, "", unexpected(err)
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, "", fmt.Errorf("%w: expected '$', got %q", errAOFFormat, abbreviate(line))
+		}
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("%w: invalid bulk length %q", errAOFFormat, abbreviate(line))
+		}
+		buf := make([]byte, n+2)
+		read, err := io.ReadFull(ar.r, buf)
+		ar.read += int64(read)
+		if err != nil {
+			return nil, "", unexpected(err)
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, "", fmt.Errorf("%w: bulk string not terminated by CRLF", errAOFFormat)
+		}
+		args = append(args, string(buf[:n]))
+	}
+	ar.offset = ar.read
+	return args, "", nil
+}
+
+// readLine reads a CRLF terminated line without the terminator.
+func (ar *aofReader) readLine() (string, error) {
+	line, err := ar.r.ReadString('\n')
+	ar.read += int64(len(line))
+	if err != nil {
+		return line, err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("%w: line not terminated by CRLF", errAOFFormat)
+	}
+	return line[:len(line)-2], nil
+}
+
+func abbreviate(s string) string {
+	if len(s) > 32 {
+		return s[:32] + "..."
+	}
+	return s
+}
+
+// aofVisitor receives what scanAOFFile reads, together with the offset in
+// the file where it ends. Nil callbacks are skipped.
+type aofVisitor struct {
+	snapshot   func(snap Snapshot, end int64) error
+	command    func(cmd string, args []string, end int64) error
+	annotation func(text string, end int64) error
+}
+
+// errStopScan ends scanAOFFile early without error when returned by a
+// visitor callback.
+var errStopScan = errors.New("stop scanning the AOF")
+
+// scanAOFFile reads one AOF file, passing an RDB preamble, the commands and
+// the annotations to v. Problems with the file are returned as *AOFError,
+// and errStopScan if a callback stopped the scan.
+func scanAOFFile(path string, keyring *Keyring, v aofVisitor) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Offsets are in the plaintext of an encrypted file; those of errors
+	// are mapped back to the file, as they are where it can be truncated.
+	r, fileOffset, err := openDecrypted(bufio.NewReader(f), keyring)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return &AOFError{File: path, Offset: 0, Reason: "incomplete encryption header", Truncated: true}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	ar := &aofReader{r: r}
+	if magic, err := ar.r.Peek(len(rdbMagic)); err == nil && string(magic) == rdbMagic {
+		snap, n, err := readSnapshot(ar.r)
+		if err != nil {
+			return &AOFError{File: path, Offset: 0, Reason: "bad RDB preamble: " + err.Error(),
+				Truncated: errors.Is(err, io.ErrUnexpectedEOF)}
+		}
+		ar.offset, ar.read = n, n
+		if v.snapshot != nil {
+			if err := v.snapshot(snap, n); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		args, note, err := ar.readCommand()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			reason := err.Error()
+			if err == io.ErrUnexpectedEOF {
+				reason = "unexpected end of file"
+			}
+			off, kept := fileOffset(ar.offset)
+			return &AOFError{File: path, Offset: off, Reason: reason, Truncated: err == io.ErrUnexpectedEOF, kept: kept}
+		}
+		if args == nil {
+			if v.annotation != nil {
+				if err := v.annotation(note, ar.offset); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if v.command != nil {
+			if err := v.command(args[0], args[1:], ar.offset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// AOFCheck is the result of checking one AOF file.
+type AOFCheck struct {
+	File string
+	Size int64
+	Err  *AOFError // nil if the file is valid
+	Last bool      // the last file, the only one that may be fixed
+}
+
+// aofFiles returns the files of the AOF at path in replay order. path is
+// either a manifest, listing a base and incr files, or a single AOF file.
+func aofFiles(path string) ([]string, error) {
+	if !strings.HasSuffix(path, ".manifest") {
+		return []string{path}, nil
+	}
+	m, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	dir := filepath.Dir(path)
+	if m.Base != nil {
+		files = append(files, filepath.Join(dir, m.Base.Name))
+	}
+	for _, incr := range m.Incrs {
+		files = append(files, filepath.Join(dir, incr.Name))
+	}
+	return files, nil
+}
+
+// CheckAOF validates an AOF. path is either a manifest, whose base and
+// incr files are checked in order, or a single AOF file. keyring decrypts
+// encrypted files and may be nil.
+func CheckAOF(path string, keyring *Keyring) ([]AOFCheck, error) {
+	files, err := aofFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]AOFCheck, 0, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		check := AOFCheck{File: file, Size: info.Size(), Last: i == len(files)-1}
+		err = scanAOFFile(file, keyring, aofVisitor{})
+		var aofErr *AOFError
+		if errors.As(err, &aofErr) {
+			check.Err = aofErr
+		} else if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+		if check.Err != nil {
+			// Later files can't be applied on top of a broken one anyway.
+			break
+		}
+	}
+	return checks, nil
+}
+
+// FixAOF truncates file at the end of its last valid command.
+func FixAOF(check AOFCheck) error {
+	if check.Err == nil {
+		return nil
+	}
+	if !check.Last {
+		return fmt.Errorf("%s is not the last AOF file and can't be fixed by truncation", check.File)
+	}
+	return os.Truncate(check.File, check.Err.Offset)
+}
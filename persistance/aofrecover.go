@@ -0,0 +1,108 @@
+package persistance
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecoveryTarget is where a point-in-time recovery stops. Before stops at
+// the first "#TS" annotation at or after it, Offset after the last
+// command that ends within that many bytes of the AOF, counting its files
+// in replay order and the decrypted content of encrypted files. Zero
+// values don't limit the recovery.
+type RecoveryTarget struct {
+	Before time.Time
+	Offset int64
+}
+
+// Recovery describes what RecoverAOF replayed.
+type Recovery struct {
+	Commands  int
+	Offset    int64     // bytes of the AOF replayed, in replay order
+	Timestamp time.Time // last annotation replayed, zero if none
+}
+
+// RecoverAOF replays the AOF at path, a manifest or a single file, up to
+// target. It only reads the files, so it can run against the AOF of a
+// live server or a copy of it. An RDB base or preamble is passed to
+// snapshot and the commands to handle; a partial command at the end of
+// the last file is ignored. keyring decrypts encrypted files and may be
+// nil.
+func RecoverAOF(path string, keyring *Keyring, target RecoveryTarget, snapshot func(Snapshot) error, handle func(cmd string, args []string) error) (Recovery, error) {
+	var rec Recovery
+	files, err := aofFiles(path)
+	if err != nil {
+		return rec, err
+	}
+
+	var start int64 // offset of the current file in the AOF
+	for i, file := range files {
+		var fileEnd int64
+		err := scanAOFFile(file, keyring, aofVisitor{
+			snapshot: func(snap Snapshot, end int64) error {
+				fileEnd = end
+				if target.Offset > 0 && start+end > target.Offset {
+					return fmt.Errorf("offset %d lies inside the RDB data of %s, which ends at %d",
+						target.Offset, file, start+end)
+				}
+				rec.Offset = start + end
+				return snapshot(snap)
+			},
+			annotation: func(text string, end int64) error {
+				fileEnd = end
+				ts, ok := parseTimestamp(text)
+				if !ok {
+					return nil
+				}
+				if !target.Before.IsZero() && !ts.Before(target.Before) {
+					return errStopScan
+				}
+				if target.Offset > 0 && start+end > target.Offset {
+					return errStopScan
+				}
+				rec.Offset, rec.Timestamp = start+end, ts
+				return nil
+			},
+			command: func(cmd string, args []string, end int64) error {
+				fileEnd = end
+				if target.Offset > 0 && start+end > target.Offset {
+					return errStopScan
+				}
+				if err := handle(cmd, args); err != nil {
+					return err
+				}
+				rec.Commands++
+				rec.Offset = start + end
+				return nil
+			},
+		})
+		if errors.Is(err, errStopScan) {
+			return rec, nil
+		}
+		var aofErr *AOFError
+		if errors.As(err, &aofErr) && aofErr.Truncated && i == len(files)-1 {
+			return rec, nil
+		}
+		if err != nil {
+			return rec, err
+		}
+		start += fileEnd
+	}
+	return rec, nil
+}
+
+// parseTimestamp parses the text of a "#TS:<unix time>" annotation.
+func parseTimestamp(text string) (time.Time, bool) {
+	value, ok := strings.CutPrefix(text, "TS:")
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
@@ -0,0 +1,304 @@
+package persistance
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Segments are sealed and a new one is started once they reach this size.
+const coldSegmentSize = 64 << 20
+
+// ColdStore holds the values tiered storage moves out of memory, in a log
+// of segment files. Values are appended to the newest segment and never
+// changed in place; deleting one only counts its bytes as dead, and
+// Compact copies the live values out of a mostly dead segment and removes
+// it. The index lives in memory, in the ColdRefs handed out by Put. The
+// files are only a cache next to the AOF and snapshots, so they are
+// emptied when the store is opened.
+type ColdStore struct {
+	mu          sync.Mutex
+	dir         string
+	keyring     *Keyring
+	segments    map[uint64]*coldSegment
+	active      *coldSegment
+	nextID      uint64
+	compactions int64
+}
+
+type coldSegment struct {
+	id   uint64
+	f    *os.File
+	size int64
+	dead int64 // bytes of freed values
+	live map[*ColdRef]struct{}
+}
+
+// ColdRef locates a value in a ColdStore. Compaction may move the value,
+// so a ColdRef is only ever read through its store.
+type ColdRef struct {
+	store *ColdStore
+	seg   *coldSegment
+	off   int64
+	len   int64
+	key   *encKey // the value is sealed with key, unless nil
+}
+
+// ColdStats backs the tiered section of INFO.
+type ColdStats struct {
+	Values      int   // values stored
+	Size        int64 // bytes in the segment files
+	DeadSize    int64 // bytes of deleted values not compacted yet
+	Segments    int
+	Compactions int64
+}
+
+func coldSegmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("cold-%d.seg", id))
+}
+
+// OpenColdStore creates dir if needed and removes the segments a previous
+// run left there.
+func OpenColdStore(dir string) (*ColdStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "cold-*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &ColdStore{dir: dir, segments: make(map[uint64]*coldSegment), nextID: 1}
+	if err := c.startSegment(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dir returns the directory of the segment files.
+func (c *ColdStore) Dir() string {
+	return c.dir
+}
+
+// SetKeyring makes Put encrypt values with the current key of keyring,
+// or stop encrypting them if it is nil. Values already stored keep their
+// key.
+func (c *ColdStore) SetKeyring(keyring *Keyring) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keyring = keyring
+}
+
+// startSegment seals the active segment and starts a new one. Callers
+// must hold c.mu.
+func (c *ColdStore) startSegment() error {
+	id := c.nextID
+	f, err := os.OpenFile(coldSegmentPath(c.dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	c.nextID++
+	seg := &coldSegment{id: id, f: f, live: make(map[*ColdRef]struct{})}
+	c.segments[id] = seg
+	prev := c.active
+	c.active = seg
+	if prev != nil {
+		c.collect(prev)
+	}
+	return nil
+}
+
+// Put appends a value and returns where it went.
+func (c *ColdStore) Put(value []byte) (*ColdRef, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ref := &ColdRef{store: c, key: c.keyring.current()}
+	if ref.key != nil {
+		nonce := make([]byte, encNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		value = ref.key.aead.Seal(nonce, nonce, value, nil)
+	}
+	if err := c.append(ref, value); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// append writes the stored form of a value to the active segment and
+// points ref at it. Callers must hold c.mu.
+func (c *ColdStore) append(ref *ColdRef, data []byte) error {
+	if c.active.size > 0 && c.active.size+int64(len(data)) > coldSegmentSize {
+		if err := c.startSegment(); err != nil {
+			return err
+		}
+	}
+	seg := c.active
+	if _, err := seg.f.WriteAt(data, seg.size); err != nil {
+		return err
+	}
+	ref.seg, ref.off, ref.len = seg, seg.size, int64(len(data))
+	seg.live[ref] = struct{}{}
+	seg.size += int64(len(data))
+	return nil
+}
+
+// Load reads the value ref points at.
+func (r *ColdRef) Load() ([]byte, error) {
+	c := r.store
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.seg == nil {
+		return nil, errors.New("the value was deleted from the tiered store")
+	}
+	data := make([]byte, r.len)
+	if _, err := r.seg.f.ReadAt(data, r.off); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.seg.f.Name(), err)
+	}
+	if r.key == nil {
+		return data, nil
+	}
+	if len(data) < encNonceSize {
+		return nil, fmt.Errorf("%s: value at offset %d is truncated", r.seg.f.Name(), r.off)
+	}
+	value, err := r.key.aead.Open(nil, data[:encNonceSize], data[encNonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: value at offset %d fails authentication", r.seg.f.Name(), r.off)
+	}
+	return value, nil
+}
+
+// Free deletes the value ref points at; ref must not be used afterwards.
+func (r *ColdRef) Free() {
+	c := r.store
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seg := r.seg
+	if seg == nil {
+		return
+	}
+	delete(seg.live, r)
+	seg.dead += r.len
+	r.seg = nil
+	c.collect(seg)
+}
+
+// collect removes seg once no live value is left in it. The active segment
+// is emptied instead. Callers must hold c.mu.
+func (c *ColdStore) collect(seg *coldSegment) {
+	if len(seg.live) > 0 {
+		return
+	}
+	if seg == c.active {
+		if seg.f.Truncate(0) == nil {
+			seg.size, seg.dead = 0, 0
+		}
+		return
+	}
+	seg.f.Close()
+	os.Remove(seg.f.Name())
+	delete(c.segments, seg.id)
+}
+
+// Compact copies the live values out of the sealed segment with the most
+// dead bytes, if more than half of it is dead, and removes it. The store
+// is only locked while each value is copied, so reads go on meanwhile. It
+// reports whether a segment was compacted.
+func (c *ColdStore) Compact() (bool, error) {
+	c.mu.Lock()
+	var victim *coldSegment
+	for _, seg := range c.segments {
+		if seg != c.active && seg.dead*2 > seg.size && (victim == nil || seg.dead > victim.dead) {
+			victim = seg
+		}
+	}
+	if victim == nil {
+		c.mu.Unlock()
+		return false, nil
+	}
+	refs := make([]*ColdRef, 0, len(victim.live))
+	for ref := range victim.live {
+		refs = append(refs, ref)
+	}
+	c.mu.Unlock()
+
+	for _, ref := range refs {
+		if err := c.move(ref, victim); err != nil {
+			return false, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compactions++
+	c.collect(victim)
+	return true, nil
+}
+
+// move copies the value of ref from seg to the active segment, unless it
+// was freed meanwhile.
+func (c *ColdStore) move(ref *ColdRef, seg *coldSegment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ref.seg != seg {
+		return nil
+	}
+	data := make([]byte, ref.len)
+	if _, err := seg.f.ReadAt(data, ref.off); err != nil {
+		return fmt.Errorf("%s: %w", seg.f.Name(), err)
+	}
+	delete(seg.live, ref)
+	if err := c.append(ref, data); err != nil {
+		seg.live[ref] = struct{}{}
+		return err
+	}
+	return nil
+}
+
+// Stats returns the size of the store.
+func (c *ColdStore) Stats() ColdStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ColdStats{Segments: len(c.segments), Compactions: c.compactions}
+	for _, seg := range c.segments {
+		stats.Values += len(seg.live)
+		stats.Size += seg.size
+		stats.DeadSize += seg.dead
+	}
+	return stats
+}
+
+// Close closes and removes the segment files. Every value must have been
+// freed or loaded back first.
+func (c *ColdStore) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, seg := range c.segments {
+		if len(seg.live) > 0 {
+			return fmt.Errorf("%d values are still stored in %s", len(seg.live), seg.f.Name())
+		}
+	}
+	for _, seg := range c.segments {
+		seg.f.Close()
+		os.Remove(seg.f.Name())
+	}
+	c.segments = make(map[uint64]*coldSegment)
+	c.active = nil
+	return nil
+}
@@ -0,0 +1,413 @@
+package persistance
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Encryption at rest. An encrypted RDB or AOF file starts with a header
+// naming its key, followed by chunks sealed with AES-256-GCM:
+//
+//	header: "RCENC01\n" | key id (8 bytes) | file id (16 random bytes)
+//	chunk:  length of the sealed data (4 bytes, big endian) | nonce (12 bytes) | sealed data
+//
+// The additional data of each chunk is the file id and the index of the
+// chunk, so chunks can't be reordered or moved between files unnoticed.
+// The AOF seals every flush as chunks of its own, so it can still be
+// appended to, and a torn last chunk reads as a truncated file.
+const encMagic = "RCENC01\n"
+
+const (
+	encKeyIDSize   = 8
+	encFileIDSize  = 16
+	encHeaderSize  = 8 + encKeyIDSize + encFileIDSize // len(encMagic) + ...
+	encNonceSize   = 12
+	encTagSize     = 16
+	encOverhead    = 4 + encNonceSize + encTagSize
+	encMaxChunk    = 1 << 20 // plaintext per chunk
+	encMaxChunkLen = encMaxChunk + encTagSize
+)
+
+type keyID [encKeyIDSize]byte
+
+func (id keyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type encKey struct {
+	id   keyID
+	aead cipher.AEAD
+}
+
+// Keyring holds the keys of an encryption key file. The first key
+// encrypts, all of them decrypt, so a new key can be put first while
+// files written with the older ones are still around.
+type Keyring struct {
+	keys []encKey
+}
+
+// LoadKeyring reads a key file: one AES-256 key per line as 64 hex digits,
+// the current one first. Blank lines and lines starting with # are
+// ignored.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &Keyring{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s line %d: a key must be 64 hex digits", path, lineNo)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		var key encKey
+		sum := sha256.Sum256(raw)
+		copy(key.id[:], sum[:])
+		key.aead = aead
+		k.keys = append(k.keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("%s holds no key", path)
+	}
+	return k, nil
+}
+
+// KeyID identifies the current key without revealing it.
+func (k *Keyring) KeyID() string {
+	return k.current().id.String()
+}
+
+// current returns the key new files are encrypted with, nil without
+// encryption.
+func (k *Keyring) current() *encKey {
+	if k == nil {
+		return nil
+	}
+	return &k.keys[0]
+}
+
+func (k *Keyring) lookup(id keyID) *encKey {
+	if k == nil {
+		return nil
+	}
+	for i := range k.keys {
+		if k.keys[i].id == id {
+			return &k.keys[i]
+		}
+	}
+	return nil
+}
+
+// encHeader is the header of an encrypted file.
+type encHeader struct {
+	key  keyID
+	file [encFileIDSize]byte
+}
+
+func (h *encHeader) bytes() []byte {
+	b := make([]byte, 0, encHeaderSize)
+	b = append(b, encMagic...)
+	b = append(b, h.key[:]...)
+	return append(b, h.file[:]...)
+}
+
+// readEncHeader reads the header of an encrypted file. It returns nil
+// and no error if r doesn't start with one; nothing is consumed then.
+func readEncHeader(r *bufio.Reader) (*encHeader, error) {
+	magic, err := r.Peek(len(encMagic))
+	if err != nil || string(magic) != encMagic {
+		return nil, nil
+	}
+	buf := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, unexpected(err)
+	}
+	h := &encHeader{}
+	copy(h.key[:], buf[len(encMagic):])
+	copy(h.file[:], buf[len(encMagic)+encKeyIDSize:])
+	return h, nil
+}
+
+// chunkAD is the additional data sealed with chunk n.
+func chunkAD(h *encHeader, n uint64) []byte {
+	ad := make([]byte, 0, encFileIDSize+8)
+	ad = append(ad, h.file[:]...)
+	return binary.BigEndian.AppendUint64(ad, n)
+}
+
+// sealedSize is how many bytes n bytes of plaintext take in a file.
+func sealedSize(n int) int64 {
+	chunks := (n + encMaxChunk - 1) / encMaxChunk
+	return int64(n + chunks*encOverhead)
+}
+
+// encWriter encrypts everything written through it into chunks.
+type encWriter struct {
+	w      io.Writer
+	key    *encKey
+	header encHeader
+	chunks uint64 // chunks in the file so far
+	size   int64  // bytes in the file so far
+}
+
+// newEncWriter starts a new encrypted file on w.
+func newEncWriter(w io.Writer, key *encKey) (*encWriter, error) {
+	e := &encWriter{w: w, key: key}
+	e.header.key = key.id
+	if _, err := rand.Read(e.header.file[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(e.header.bytes()); err != nil {
+		return nil, err
+	}
+	e.size = encHeaderSize
+	return e, nil
+}
+
+// Write seals p as one or more chunks and writes them at once. It writes
+// either all of p or, as far as it can tell, nothing: if w is a file, a
+// failed write is cut off again so the file never ends in a torn chunk
+// that later appends would follow.
+func (e *encWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if e.key == nil {
+		return 0, fmt.Errorf("the key of the encrypted file is not in the key file")
+	}
+	out := make([]byte, 0, sealedSize(len(p)))
+	chunks := e.chunks
+	for rest := p; len(rest) > 0; chunks++ {
+		plain := rest[:min(len(rest), encMaxChunk)]
+		rest = rest[len(plain):]
+
+		out = binary.BigEndian.AppendUint32(out, uint32(len(plain)+encTagSize))
+		nonce := make([]byte, encNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		out = append(out, nonce...)
+		out = e.key.aead.Seal(out, nonce, plain, chunkAD(&e.header, chunks))
+	}
+
+	if n, err := e.w.Write(out); err != nil {
+		if f, ok := e.w.(*os.File); ok && n > 0 {
+			f.Truncate(e.size)
+		}
+		return 0, err
+	}
+	e.chunks = chunks
+	e.size += int64(len(out))
+	return len(p), nil
+}
+
+// encReader decrypts an encrypted file, keeping track of where each chunk
+// starts so positions in the plaintext can be mapped back to the file.
+type encReader struct {
+	r      *bufio.Reader
+	key    *encKey
+	header *encHeader
+	chunks uint64
+	buf    []byte
+	plain  int64        // plaintext returned so far plus buf
+	file   int64        // end of the last chunk read
+	starts []chunkStart // of every chunk read
+}
+
+type chunkStart struct {
+	plain, file int64
+}
+
+// newEncReader reads the header of an encrypted file and looks up its key
+// in keyring.
+func newEncReader(r *bufio.Reader, h *encHeader, keyring *Keyring) (*encReader, error) {
+	key := keyring.lookup(h.key)
+	if key == nil {
+		if keyring == nil {
+			return nil, errors.New("the file is encrypted and no encryption-key-file is configured")
+		}
+		return nil, fmt.Errorf("the file is encrypted with key %s, which is not in the key file", h.key)
+	}
+	return &encReader{r: r, key: key, header: h, file: encHeaderSize}, nil
+}
+
+func (d *encReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// readChunk returns io.EOF at the end of the file, io.ErrUnexpectedEOF
+// for a torn chunk and an error for a chunk that fails authentication.
+func (d *encReader) readChunk() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return unexpected(err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n < encTagSize || n > encMaxChunkLen {
+		return fmt.Errorf("encrypted chunk %d has a bad length", d.chunks)
+	}
+	sealed := make([]byte, encNonceSize+int(n))
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return unexpected(err)
+	}
+	plain, err := d.key.aead.Open(nil, sealed[:encNonceSize], sealed[encNonceSize:], chunkAD(d.header, d.chunks))
+	if err != nil {
+		return fmt.Errorf("encrypted chunk %d fails authentication", d.chunks)
+	}
+
+	d.starts = append(d.starts, chunkStart{plain: d.plain, file: d.file})
+	d.chunks++
+	d.file += int64(len(length) + len(sealed))
+	d.plain += int64(len(plain))
+	d.buf = plain
+	return nil
+}
+
+// fileOffset maps a position in the plaintext to the start of the chunk
+// holding it, or to the end of the chunks read for the end of the
+// plaintext, so that cutting the file there keeps only whole chunks. It
+// also returns how much of that chunk's plaintext comes before plain,
+// which such a cut loses.
+func (d *encReader) fileOffset(plain int64) (int64, int64) {
+	if plain >= d.plain {
+		return d.file, 0
+	}
+	i := sort.Search(len(d.starts), func(i int) bool { return d.starts[i].plain > plain })
+	return d.starts[i-1].file, plain - d.starts[i-1].plain
+}
+
+// readChunkPrefix decrypts the chunk starting at offset off of the
+// encrypted file at path and returns the first n bytes of its plaintext.
+func readChunkPrefix(path string, off, n int64, keyring *Keyring) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	h, err := readEncHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, errors.New("the file is not encrypted")
+	}
+	d, err := newEncReader(r, h, keyring)
+	if err != nil {
+		return nil, err
+	}
+	// The chunks before only count, for the additional data.
+	for d.file < off {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		size := int64(encNonceSize + binary.BigEndian.Uint32(length[:]))
+		if skipped, _ := r.Discard(int(size)); int64(skipped) < size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d.chunks++
+		d.file += 4 + size
+	}
+	if d.file != off {
+		return nil, fmt.Errorf("no encrypted chunk starts at offset %d", off)
+	}
+	if err := d.readChunk(); err != nil {
+		return nil, err
+	}
+	if int64(len(d.buf)) < n {
+		return nil, fmt.Errorf("encrypted chunk %d is shorter than %d bytes", d.chunks-1, n)
+	}
+	return d.buf[:n], nil
+}
+
+// openDecrypted returns a reader for the plaintext of r, which may or may
+// not be encrypted, and a function mapping plaintext positions back to
+// the file, as encReader.fileOffset does.
+func openDecrypted(r *bufio.Reader, keyring *Keyring) (*bufio.Reader, func(int64) (int64, int64), error) {
+	h, err := readEncHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h == nil {
+		return r, func(off int64) (int64, int64) { return off, 0 }, nil
+	}
+	d, err := newEncReader(r, h, keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bufio.NewReader(d), d.fileOffset, nil
+}
+
+// scanChunks walks the chunks of an encrypted file without decrypting
+// them and returns its header, the number of complete chunks and where
+// they end. The header is nil if the file is not encrypted.
+func scanChunks(path string) (*encHeader, uint64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	h, err := readEncHeader(r)
+	if h == nil || err != nil {
+		return nil, 0, 0, err
+	}
+
+	var chunks uint64
+	end := int64(encHeaderSize)
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			break
+		}
+		n := int64(encNonceSize + binary.BigEndian.Uint32(length[:]))
+		if skipped, _ := r.Discard(int(n)); int64(skipped) < n {
+			break
+		}
+		chunks++
+		end += 4 + n
+	}
+	return h, chunks, end, nil
+}
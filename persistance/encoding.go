@@ -0,0 +1,549 @@
+package persistance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+)
+
+// RDB versions: we write RDBVersion and accept anything up to
+// MaxRDBVersion when reading.
+const (
+	RDBVersion    = 9
+	MaxRDBVersion = 12
+)
+
+// Object type bytes, as used by the RDB format and DUMP payloads. We only
+// write the first four; the others are decoded when loading files
+// produced by Redis and normalized to TypeList, TypeSet, TypeHash or
+// TypeZSet.
+const (
+	TypeString          = 0
+	TypeList            = 1
+	TypeSet             = 2
+	TypeZSet            = 3
+	TypeHash            = 4
+	TypeZSet2           = 5
+	TypeHashZipmap      = 9
+	TypeListZiplist     = 10
+	TypeSetIntset       = 11
+	TypeZSetZiplist     = 12
+	TypeHashZiplist     = 13
+	TypeListQuicklist   = 14
+	TypeHashListpack    = 16
+	TypeZSetListpack    = 17
+	TypeListQuicklist2  = 18
+	TypeSetListpack     = 20
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// Length encoding prefixes.
+const (
+	len6Bit   = 0
+	len14Bit  = 1
+	len32Bit  = 0x80
+	len64Bit  = 0x81
+	lenEncVal = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+var ErrBadPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// crcTable is the reflected form of the Jones polynomial used by Redis.
+var crcTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// CRC64 continues a Redis compatible CRC64 (no initial or final xor).
+func CRC64(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// Object is the type-independent form of a value as it is serialized.
+// Items holds list elements, set members, hash fields and values
+// alternately, or sorted set members and scores alternately.
+type Object struct {
+	Type  byte
+	Value string
+	Items []string
+}
+
+type rdbWriter struct {
+	w        io.Writer
+	err      error
+	compress bool // LZF compress long strings
+}
+
+func (e *rdbWriter) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *rdbWriter) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.writeByte(byte(n))
+	case n < 1<<14:
+		e.write([]byte{byte(n>>8) | len14Bit<<6, byte(n)})
+	case n <= 0xffffffff:
+		buf := make([]byte, 5)
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		e.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], n)
+		e.write(buf)
+	}
+}
+
+// writeString writes s, using the compact integer encodings when s is
+// the canonical form of a 32 bit integer. With compress, strings longer
+// than 20 bytes are LZF compressed if that saves at least 4 bytes, as
+// Redis does.
+func (e *rdbWriter) writeString(s string) {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+			e.writeInt(n)
+			return
+		}
+	}
+	if e.compress && len(s) > 20 {
+		if compressed := lzfCompress([]byte(s), len(s)-4); compressed != nil {
+			e.writeByte(lenEncVal<<6 | encLZF)
+			e.writeLen(uint64(len(compressed)))
+			e.writeLen(uint64(len(s)))
+			e.write(compressed)
+			return
+		}
+	}
+	e.writeLen(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+func (e *rdbWriter) writeInt(n int64) {
+	const enc = lenEncVal << 6
+	switch {
+	case n >= -1<<7 && n < 1<<7:
+		e.write([]byte{enc | encInt8, byte(n)})
+	case n >= -1<<15 && n < 1<<15:
+		buf := []byte{enc | encInt16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(n))
+		e.write(buf)
+	default:
+		buf := []byte{enc | encInt32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+		e.write(buf)
+	}
+}
+
+// writeObject writes the type byte followed by the value.
+func (e *rdbWriter) writeObject(obj Object) {
+	e.writeByte(obj.Type)
+	e.writeObjectValue(obj)
+}
+
+func (e *rdbWriter) writeObjectValue(obj Object) {
+	switch obj.Type {
+	case TypeString:
+		e.writeString(obj.Value)
+	case TypeList, TypeSet:
+		e.writeLen(uint64(len(obj.Items)))
+		for _, item := range obj.Items {
+			e.writeString(item)
+		}
+	case TypeHash:
+		e.writeLen(uint64(len(obj.Items) / 2))
+		for _, item := range obj.Items {
+			e.writeString(item)
+		}
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("unsupported object type %d", obj.Type)
+		}
+	}
+}
+
+// rdbReader decodes RDB primitives, keeping a running CRC64 of every
+// byte consumed so file trailers can be verified.
+type rdbReader struct {
+	r    *bufio.Reader
+	crc  uint64
+	n    int64 // bytes consumed
+	size int64 // input length, or -1 when it is not known
+}
+
+// errBadLength reports a length that cannot fit in what is left of the
+// input.
+var errBadLength = errors.New("length exceeds the remaining input")
+
+// Longest read that is allocated in one go when the input size is unknown.
+const maxPrealloc = 1 << 20
+
+// checkLen rejects a length of n bytes (or items, each taking at least
+// one byte) that is negative or larger than what is left of the input,
+// so a corrupt length fails before anything is allocated for it.
+func (d *rdbReader) checkLen(n uint64) error {
+	if n > math.MaxInt32 || d.size >= 0 && int64(n) > d.size-d.n {
+		return errBadLength
+	}
+	return nil
+}
+
+func (d *rdbReader) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.crc = CRC64(d.crc, []byte{b})
+		d.n++
+	}
+	return b, err
+}
+
+func (d *rdbReader) readFull(n int) ([]byte, error) {
+	if err := d.checkLen(uint64(n)); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	var err error
+	if d.size < 0 && n > maxPrealloc {
+		// The input size is unknown, so let the buffer grow with the
+		// bytes actually read rather than trusting n up front.
+		var b bytes.Buffer
+		_, err = io.CopyN(&b, d.r, int64(n))
+		buf = b.Bytes()
+	} else {
+		buf = make([]byte, n)
+		_, err = io.ReadFull(d.r, buf)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		d.crc = CRC64(d.crc, buf)
+		d.n += int64(n)
+	}
+	return buf, err
+}
+
+// readLen returns a length, or with encoded set the special encoding
+// stored in its place.
+func (d *rdbReader) readLen() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case len14Bit:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case lenEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case len32Bit:
+		buf, err := d.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf, err := d.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("invalid length encoding 0x%x", b)
+}
+
+func (d *rdbReader) readCount() (int, error) {
+	n, encoded, err := d.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errors.New("unexpected encoded length")
+	}
+	if err := d.checkLen(n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (d *rdbReader) readString() (string, error) {
+	n, encoded, err := d.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if err := d.checkLen(n); err != nil {
+			return "", err
+		}
+		buf, err := d.readFull(int(n))
+		return string(buf), err
+	}
+
+	switch n {
+	case encInt8:
+		buf, err := d.readFull(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int8(buf[0])), 10), nil
+	case encInt16:
+		buf, err := d.readFull(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10), nil
+	case encInt32:
+		buf, err := d.readFull(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10), nil
+	case encLZF:
+		compressed, err := d.readCount()
+		if err != nil {
+			return "", err
+		}
+		// The expanded size is bounded by lzfDecompress, not by the input.
+		size, encoded, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		if encoded || size > math.MaxInt32 {
+			return "", errCorrupt
+		}
+		buf, err := d.readFull(compressed)
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress(buf, int(size))
+		return string(out), err
+	}
+	return "", fmt.Errorf("unsupported string encoding %d", n)
+}
+
+func (d *rdbReader) readStrings(n int) ([]string, error) {
+	items := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+// readDouble reads the string encoded score of TypeZSet.
+func (d *rdbReader) readDouble() (string, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return "", err
+	}
+	switch n {
+	case 253:
+		return "nan", nil
+	case 254:
+		return "inf", nil
+	case 255:
+		return "-inf", nil
+	}
+	buf, err := d.readFull(int(n))
+	return string(buf), err
+}
+
+func (d *rdbReader) readObjectValue(typ byte) (Object, error) {
+	switch typ {
+	case TypeString:
+		s, err := d.readString()
+		return Object{Type: TypeString, Value: s}, err
+
+	case TypeList, TypeSet, TypeHash:
+		n, err := d.readCount()
+		if err != nil {
+			return Object{}, err
+		}
+		if typ == TypeHash {
+			n *= 2
+		}
+		items, err := d.readStrings(n)
+		return Object{Type: typ, Items: items}, err
+
+	case TypeZSet, TypeZSet2:
+		n, err := d.readCount()
+		if err != nil {
+			return Object{}, err
+		}
+		items := make([]string, 0, min(n, 1024)*2)
+		for i := 0; i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return Object{}, err
+			}
+			var score string
+			if typ == TypeZSet {
+				score, err = d.readDouble()
+			} else {
+				var buf []byte
+				buf, err = d.readFull(8)
+				if err == nil {
+					score = formatScore(math.Float64frombits(binary.LittleEndian.Uint64(buf)))
+				}
+			}
+			if err != nil {
+				return Object{}, err
+			}
+			items = append(items, member, score)
+		}
+		return Object{Type: TypeZSet, Items: items}, nil
+
+	case TypeListQuicklist, TypeListQuicklist2:
+		nodes, err := d.readCount()
+		if err != nil {
+			return Object{}, err
+		}
+		items := make([]string, 0)
+		for i := 0; i < nodes; i++ {
+			container := uint64(quicklistNodePacked)
+			if typ == TypeListQuicklist2 {
+				if container, _, err = d.readLen(); err != nil {
+					return Object{}, err
+				}
+			}
+			blob, err := d.readString()
+			if err != nil {
+				return Object{}, err
+			}
+			switch {
+			case container == quicklistNodePlain:
+				items = append(items, blob)
+				continue
+			case typ == TypeListQuicklist:
+				items, err = appendZiplist(items, blob)
+			default:
+				items, err = appendListpack(items, blob)
+			}
+			if err != nil {
+				return Object{}, err
+			}
+		}
+		return Object{Type: TypeList, Items: items}, nil
+	}
+
+	// The remaining types store a whole compact encoding as one string.
+	blob, err := d.readString()
+	if err != nil {
+		return Object{}, err
+	}
+	var items []string
+	switch typ {
+	case TypeHashZipmap:
+		items, err = decodeZipmap(blob)
+		return Object{Type: TypeHash, Items: items}, err
+	case TypeListZiplist:
+		items, err = appendZiplist(nil, blob)
+		return Object{Type: TypeList, Items: items}, err
+	case TypeSetIntset:
+		items, err = decodeIntset(blob)
+		return Object{Type: TypeSet, Items: items}, err
+	case TypeZSetZiplist:
+		items, err = appendZiplist(nil, blob)
+		return Object{Type: TypeZSet, Items: items}, err
+	case TypeHashZiplist:
+		items, err = appendZiplist(nil, blob)
+		return Object{Type: TypeHash, Items: items}, err
+	case TypeHashListpack:
+		items, err = appendListpack(nil, blob)
+		return Object{Type: TypeHash, Items: items}, err
+	case TypeZSetListpack:
+		items, err = appendListpack(nil, blob)
+		return Object{Type: TypeZSet, Items: items}, err
+	case TypeSetListpack:
+		items, err = appendListpack(nil, blob)
+		return Object{Type: TypeSet, Items: items}, err
+	}
+	return Object{}, fmt.Errorf("unsupported object type %d", typ)
+}
+
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// DumpPayload serializes obj in the DUMP format: the RDB encoded value,
+// a two byte RDB version and a CRC64 of everything before it.
+func DumpPayload(obj Object) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := &rdbWriter{w: &buf}
+	enc.writeObject(obj)
+	if enc.err != nil {
+		return nil, enc.err
+	}
+
+	var version [2]byte
+	binary.LittleEndian.PutUint16(version[:], RDBVersion)
+	buf.Write(version[:])
+
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], CRC64(0, buf.Bytes()))
+	buf.Write(crc[:])
+	return buf.Bytes(), nil
+}
+
+// ParseDumpPayload validates the version and checksum of a DUMP payload
+// and decodes the value it holds.
+func ParseDumpPayload(payload []byte) (Object, error) {
+	if len(payload) < 10 {
+		return Object{}, ErrBadPayload
+	}
+	body := payload[:len(payload)-10]
+	footer := payload[len(payload)-10:]
+
+	version := binary.LittleEndian.Uint16(footer[:2])
+	if version > MaxRDBVersion {
+		return Object{}, ErrBadPayload
+	}
+	if CRC64(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return Object{}, ErrBadPayload
+	}
+
+	r := bufio.NewReader(bytes.NewReader(body))
+	dec := &rdbReader{r: r, size: int64(len(body))}
+	typ, err := dec.readByte()
+	if err != nil {
+		return Object{}, ErrBadPayload
+	}
+	obj, err := dec.readObjectValue(typ)
+	if errors.Is(err, errBadLength) {
+		return Object{}, ErrBadPayload
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("bad data format: %w", err)
+	}
+	if r.Buffered() > 0 {
+		return Object{}, errors.New("bad data format: trailing bytes in payload")
+	}
+	return obj, nil
+}
@@ -0,0 +1,260 @@
+package persistance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSON Lines export, for debugging and for moving data to other systems.
+// Every key is one line:
+//
+//	{"key":"user:1","type":"hash","value":[["name","Ada"]],"pexpireat":1700000000000}
+//
+// type is string, list, set, hash or zset. A string value is a JSON
+// string, a list or set value an array of them, and a hash or sorted set
+// value an array of [field, value] or [member, score] pairs. pexpireat is
+// the expiry in unix milliseconds and db the database; they are left out
+// for keys without expiry and for DB 0. Strings that aren't valid UTF-8,
+// keys included, are written as {"base64":"..."} instead, so binary data
+// survives the round trip.
+
+// jsonString is a binary-safe string in the JSON Lines format.
+type jsonString string
+
+func (s jsonString) MarshalJSON() ([]byte, error) {
+	var v interface{} = string(s)
+	if !utf8.ValidString(string(s)) {
+		v = struct {
+			Base64 []byte `json:"base64"`
+		}{[]byte(s)}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (s *jsonString) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*s = jsonString(str)
+		return nil
+	}
+	var bin struct {
+		Base64 *[]byte `json:"base64"`
+	}
+	if err := json.Unmarshal(b, &bin); err != nil || bin.Base64 == nil {
+		return errors.New(`expected a string or {"base64": "..."}`)
+	}
+	*s = jsonString(*bin.Base64)
+	return nil
+}
+
+// jsonEntry is one line of the JSON Lines format. Value is the decoded
+// value when writing and the raw JSON when reading.
+type jsonEntry struct {
+	Key       *jsonString `json:"key"`
+	Type      string      `json:"type"`
+	Value     interface{} `json:"value"`
+	PExpireAt int64       `json:"pexpireat,omitempty"`
+	DB        int         `json:"db,omitempty"`
+}
+
+var jsonTypeNames = map[byte]string{
+	TypeString: "string",
+	TypeList:   "list",
+	TypeSet:    "set",
+	TypeHash:   "hash",
+	TypeZSet:   "zset",
+}
+
+// jsonValueShapes describe the value of each type for error messages.
+var jsonValueShapes = map[string]string{
+	"string": "a string",
+	"list":   "an array of strings",
+	"set":    "an array of strings",
+	"hash":   "an array of [field, value] pairs",
+	"zset":   "an array of [member, score] pairs",
+}
+
+// JSONWriter streams keys as JSON Lines.
+type JSONWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	return &JSONWriter{buf: buf, enc: enc}
+}
+
+// WriteEntry writes one key as a line. Idle time and LFU counter are not
+// exported.
+func (jw *JSONWriter) WriteEntry(e Entry) error {
+	typeName, ok := jsonTypeNames[e.Object.Type]
+	if !ok {
+		return fmt.Errorf("key %q has an unsupported type", e.Key)
+	}
+	key := jsonString(e.Key)
+	line := jsonEntry{Key: &key, Type: typeName, PExpireAt: e.ExpireAt, DB: e.DB}
+	switch e.Object.Type {
+	case TypeString:
+		line.Value = jsonString(e.Object.Value)
+	case TypeList, TypeSet:
+		items := make([]jsonString, len(e.Object.Items))
+		for i, item := range e.Object.Items {
+			items[i] = jsonString(item)
+		}
+		line.Value = items
+	case TypeHash, TypeZSet:
+		pairs := make([][2]jsonString, 0, len(e.Object.Items)/2)
+		for i := 0; i+1 < len(e.Object.Items); i += 2 {
+			pairs = append(pairs, [2]jsonString{jsonString(e.Object.Items[i]), jsonString(e.Object.Items[i+1])})
+		}
+		line.Value = pairs
+	}
+	return jw.enc.Encode(line)
+}
+
+// Flush writes any buffered lines to the underlying writer.
+func (jw *JSONWriter) Flush() error {
+	return jw.buf.Flush()
+}
+
+// JSONReader streams the keys of a JSON Lines file. Blank lines are
+// skipped.
+type JSONReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewJSONReader(r io.Reader) *JSONReader {
+	return &JSONReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next key, or io.EOF at the end of the input. Errors
+// name the line they were found on.
+func (jr *JSONReader) Next() (Entry, error) {
+	for {
+		line, err := jr.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return Entry{}, err
+		}
+		jr.line++
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		e, err := parseJSONEntry(line)
+		if err != nil {
+			return Entry{}, fmt.Errorf("line %d: %w", jr.line, err)
+		}
+		return e, nil
+	}
+}
+
+func parseJSONEntry(b []byte) (Entry, error) {
+	var raw json.RawMessage
+	line := jsonEntry{Value: &raw}
+	if err := json.Unmarshal(b, &line); err != nil {
+		return Entry{}, err
+	}
+	if line.Key == nil {
+		return Entry{}, errors.New(`missing "key"`)
+	}
+	e := Entry{DB: line.DB, Key: string(*line.Key), ExpireAt: line.PExpireAt, Idle: -1, Freq: -1}
+	if e.DB < 0 {
+		return Entry{}, fmt.Errorf("key %q: invalid db", e.Key)
+	}
+	if e.ExpireAt < 0 {
+		return Entry{}, fmt.Errorf("key %q: invalid pexpireat", e.Key)
+	}
+	if raw == nil {
+		return Entry{}, fmt.Errorf("key %q: missing \"value\"", e.Key)
+	}
+
+	var err error
+	switch line.Type {
+	case "string":
+		var v jsonString
+		err = json.Unmarshal(raw, &v)
+		e.Object = Object{Type: TypeString, Value: string(v)}
+	case "list", "set":
+		var v []jsonString
+		err = json.Unmarshal(raw, &v)
+		e.Object = Object{Type: TypeList, Items: make([]string, len(v))}
+		if line.Type == "set" {
+			e.Object.Type = TypeSet
+		}
+		for i, item := range v {
+			e.Object.Items[i] = string(item)
+		}
+	case "hash", "zset":
+		var v [][2]jsonString
+		err = json.Unmarshal(raw, &v)
+		e.Object = Object{Type: TypeHash, Items: make([]string, 0, len(v)*2)}
+		if line.Type == "zset" {
+			e.Object.Type = TypeZSet
+		}
+		for _, pair := range v {
+			if e.Object.Type == TypeZSet {
+				if _, perr := strconv.ParseFloat(string(pair[1]), 64); perr != nil {
+					return Entry{}, fmt.Errorf("key %q: score %q is not a number", e.Key, pair[1])
+				}
+			}
+			e.Object.Items = append(e.Object.Items, string(pair[0]), string(pair[1]))
+		}
+	default:
+		return Entry{}, fmt.Errorf("key %q: unknown type %q", e.Key, line.Type)
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("key %q: a %s value must be %s", e.Key, line.Type, jsonValueShapes[line.Type])
+	}
+	return e, nil
+}
+
+// WriteJSONFile writes a JSON Lines file the way WriteRDB writes
+// snapshots: through a temporary file that is fsynced and renamed over
+// path, so path is never left half written.
+func WriteJSONFile(path string, write func(w *JSONWriter) error) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "temp-*.jsonl")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	w := NewJSONWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,274 @@
+package persistance
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Decoders for the compact encodings Redis embeds in RDB files as plain
+// strings: ziplist, listpack, intset and zipmap.
+
+var errCorrupt = errors.New("corrupt compact encoding")
+
+// Sizes of integer entries: ziplist including the encoding byte,
+// listpack excluding it.
+var (
+	ziplistIntSize  = map[byte]int{0xc0: 3, 0xd0: 5, 0xe0: 9, 0xf0: 4, 0xfe: 2}
+	listpackIntSize = map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}
+)
+
+const (
+	ziplistHeaderSize  = 10
+	listpackHeaderSize = 6
+	intsetHeaderSize   = 8
+	compactEnd         = 0xff
+)
+
+// appendZiplist appends every entry of a ziplist blob to items.
+func appendZiplist(items []string, blob string) ([]string, error) {
+	b := []byte(blob)
+	if len(b) < ziplistHeaderSize+1 {
+		return nil, errCorrupt
+	}
+	p := ziplistHeaderSize
+	for {
+		if p >= len(b) {
+			return nil, errCorrupt
+		}
+		if b[p] == compactEnd {
+			return items, nil
+		}
+
+		// Skip the length of the previous entry.
+		if b[p] < 254 {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(b) {
+			return nil, errCorrupt
+		}
+
+		enc := b[p]
+		var n int
+		switch enc >> 6 {
+		case 0:
+			n, p = int(enc&0x3f), p+1
+		case 1:
+			if p+2 > len(b) {
+				return nil, errCorrupt
+			}
+			n, p = int(enc&0x3f)<<8|int(b[p+1]), p+2
+		case 2:
+			if p+5 > len(b) {
+				return nil, errCorrupt
+			}
+			n, p = int(binary.BigEndian.Uint32(b[p+1:p+5])), p+5
+		default:
+			v, size, err := ziplistInt(b[p:])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, strconv.FormatInt(v, 10))
+			p += size
+			continue
+		}
+		if p+n > len(b) {
+			return nil, errCorrupt
+		}
+		items = append(items, string(b[p:p+n]))
+		p += n
+	}
+}
+
+// ziplistInt decodes an integer entry starting at its encoding byte and
+// returns it with the number of bytes used.
+func ziplistInt(b []byte) (int64, int, error) {
+	enc := b[0]
+	if enc >= 0xf1 && enc <= 0xfd {
+		return int64(enc&0x0f) - 1, 1, nil
+	}
+	size, ok := ziplistIntSize[enc]
+	if !ok || len(b) < size {
+		return 0, 0, errCorrupt
+	}
+	switch enc {
+	case 0xc0:
+		return int64(int16(binary.LittleEndian.Uint16(b[1:]))), size, nil
+	case 0xd0:
+		return int64(int32(binary.LittleEndian.Uint32(b[1:]))), size, nil
+	case 0xe0:
+		return int64(binary.LittleEndian.Uint64(b[1:])), size, nil
+	case 0xf0:
+		return int64(int32(uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) >> 8), size, nil
+	default:
+		return int64(int8(b[1])), size, nil
+	}
+}
+
+// appendListpack appends every entry of a listpack blob to items.
+func appendListpack(items []string, blob string) ([]string, error) {
+	b := []byte(blob)
+	if len(b) < listpackHeaderSize+1 {
+		return nil, errCorrupt
+	}
+	p := listpackHeaderSize
+	for {
+		if p >= len(b) {
+			return nil, errCorrupt
+		}
+		enc := b[p]
+		if enc == compactEnd {
+			return items, nil
+		}
+
+		var entry string
+		var size int
+		intEntry := func(bytes int) (int64, bool) {
+			if p+1+bytes > len(b) {
+				return 0, false
+			}
+			var v uint64
+			for i := 0; i < bytes; i++ {
+				v |= uint64(b[p+1+i]) << (8 * i)
+			}
+			shift := 64 - 8*bytes
+			size = 1 + bytes
+			return int64(v<<shift) >> shift, true
+		}
+		strEntry := func(hdr, n int) bool {
+			if p+hdr+n > len(b) {
+				return false
+			}
+			entry, size = string(b[p+hdr:p+hdr+n]), hdr+n
+			return true
+		}
+
+		ok := true
+		switch {
+		case enc&0x80 == 0:
+			entry, size = strconv.Itoa(int(enc&0x7f)), 1
+		case enc&0xc0 == 0x80:
+			ok = strEntry(1, int(enc&0x3f))
+		case enc&0xe0 == 0xc0:
+			if p+2 > len(b) {
+				return nil, errCorrupt
+			}
+			v := int(enc&0x1f)<<8 | int(b[p+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry, size = strconv.Itoa(v), 2
+		case enc&0xf0 == 0xe0:
+			if p+2 > len(b) {
+				return nil, errCorrupt
+			}
+			ok = strEntry(2, int(enc&0x0f)<<8|int(b[p+1]))
+		case enc == 0xf0:
+			if p+5 > len(b) {
+				return nil, errCorrupt
+			}
+			ok = strEntry(5, int(binary.LittleEndian.Uint32(b[p+1:p+5])))
+		case enc >= 0xf1 && enc <= 0xf4:
+			var v int64
+			v, ok = intEntry(listpackIntSize[enc])
+			entry = strconv.FormatInt(v, 10)
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, errCorrupt
+		}
+
+		items = append(items, entry)
+		p += size + listpackBacklenSize(size)
+	}
+}
+
+// listpackBacklenSize returns how many bytes encode an entry length of n.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n < 1<<7:
+		return 1
+	case n < 1<<14:
+		return 2
+	case n < 1<<21:
+		return 3
+	case n < 1<<28:
+		return 4
+	}
+	return 5
+}
+
+func decodeIntset(blob string) ([]string, error) {
+	b := []byte(blob)
+	if len(b) < intsetHeaderSize {
+		return nil, errCorrupt
+	}
+	width := int(binary.LittleEndian.Uint32(b[0:4]))
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if (width != 2 && width != 4 && width != 8) || len(b) != intsetHeaderSize+width*n {
+		return nil, errCorrupt
+	}
+
+	items := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		v := b[intsetHeaderSize+i*width:]
+		var x int64
+		switch width {
+		case 2:
+			x = int64(int16(binary.LittleEndian.Uint16(v)))
+		case 4:
+			x = int64(int32(binary.LittleEndian.Uint32(v)))
+		default:
+			x = int64(binary.LittleEndian.Uint64(v))
+		}
+		items = append(items, strconv.FormatInt(x, 10))
+	}
+	return items, nil
+}
+
+// decodeZipmap decodes the pre 2.6 small hash encoding.
+func decodeZipmap(blob string) ([]string, error) {
+	b := []byte(blob)
+	p := 1
+	readLen := func() (int, bool) {
+		if p >= len(b) {
+			return 0, false
+		}
+		if b[p] < 254 {
+			p++
+			return int(b[p-1]), true
+		}
+		if p+5 > len(b) {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(b[p+1 : p+5]))
+		p += 5
+		return n, true
+	}
+
+	items := make([]string, 0)
+	for p < len(b) && b[p] != compactEnd {
+		klen, ok := readLen()
+		if !ok || p+klen > len(b) {
+			return nil, errCorrupt
+		}
+		field := string(b[p : p+klen])
+		p += klen
+
+		vlen, ok := readLen()
+		if !ok || p+1+vlen > len(b) {
+			return nil, errCorrupt
+		}
+		free := int(b[p])
+		value := string(b[p+1 : p+1+vlen])
+		p += 1 + vlen + free
+		items = append(items, field, value)
+	}
+	if p >= len(b) {
+		return nil, errCorrupt
+	}
+	return items, nil
+}
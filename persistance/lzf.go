@@ -0,0 +1,126 @@
+package persistance
+
+// LZF, the compression Redis applies to long strings in RDB files.
+
+const (
+	lzfHashLog = 14
+	lzfMaxLit  = 1 << 5          // longest literal run
+	lzfMaxOff  = 1 << 13         // farthest back reference
+	lzfMaxRef  = (1 << 8) + 1<<3 // longest back reference
+
+	lzfMaxRatio = lzfMaxRef / 3 // most a three byte back reference expands
+)
+
+// lzfCompress compresses in, returning nil if the result would be longer
+// than maxOut bytes.
+func lzfCompress(in []byte, maxOut int) []byte {
+	var table [1 << lzfHashLog]int // last position+1 of each 3 byte hash
+	out := make([]byte, 1, maxOut+1)
+	ctrl, lit := 0, 0 // the control byte of the current literal run
+
+	literal := func(b byte) {
+		out = append(out, b)
+		lit++
+		if lit == lzfMaxLit {
+			out[ctrl] = lzfMaxLit - 1
+			ctrl, lit = len(out), 0
+			out = append(out, 0)
+		}
+	}
+
+	ip := 0
+	for ip+2 < len(in) && len(out) <= maxOut {
+		h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - lzfHashLog)
+		ref := table[h] - 1
+		table[h] = ip + 1
+		off := ip - ref - 1
+		if ref < 0 || off >= lzfMaxOff || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			literal(in[ip])
+			ip++
+			continue
+		}
+
+		n := 3
+		for n < min(len(in)-ip, lzfMaxRef) && in[ref+n] == in[ip+n] {
+			n++
+		}
+		if lit > 0 {
+			out[ctrl] = byte(lit - 1)
+		} else {
+			out = out[:ctrl]
+		}
+		if l := n - 2; l < 7 {
+			out = append(out, byte(off>>8|l<<5), byte(off))
+		} else {
+			out = append(out, byte(off>>8|7<<5), byte(l-7), byte(off))
+		}
+		ip += n
+		ctrl, lit = len(out), 0
+		out = append(out, 0)
+	}
+	for ; ip < len(in); ip++ {
+		literal(in[ip])
+	}
+	if lit > 0 {
+		out[ctrl] = byte(lit - 1)
+	} else {
+		out = out[:ctrl]
+	}
+	if len(out) > maxOut {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress expands an LZF block into exactly size bytes.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	// Nothing expands more than a back reference, so a larger size
+	// cannot be right.
+	if size < 0 || size > len(in)*lzfMaxRatio {
+		return nil, errCorrupt
+	}
+	out := make([]byte, 0, size)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > size {
+				return nil, errCorrupt
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		// Back reference.
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, errCorrupt
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 {
+			return nil, errCorrupt
+		}
+		if len(out)+n+2 > size {
+			return nil, errCorrupt
+		}
+		for i := 0; i < n+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != size {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,196 @@
+package persistance
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AOF file types in the manifest.
+const (
+	AOFBase    = 'b'
+	AOFIncr    = 'i'
+	AOFHistory = 'h'
+)
+
+// AOFFile is one line of the manifest.
+type AOFFile struct {
+	Name string
+	Seq  int64
+	Type byte
+}
+
+// Manifest lists the files of a multi-part AOF, in the format of Redis 7:
+// at most one base file, then the incremental files in replay order, plus
+// history files left over from a rewrite that are due for deletion.
+type Manifest struct {
+	Base    *AOFFile
+	Incrs   []AOFFile
+	History []AOFFile
+}
+
+// Lines longer than this are rejected, like Redis' AOF_MANIFEST_LINE_MAX.
+const maxManifestLine = 1024
+
+// ParseManifest reads and validates a manifest.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, maxManifestLine+1), maxManifestLine+1)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		file, err := parseManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %w", lineNo, err)
+		}
+		if names[file.Name] {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: duplicate file %s", lineNo, file.Name)
+		}
+		names[file.Name] = true
+
+		switch file.Type {
+		case AOFBase:
+			if m.Base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest line %d: more than one base file", lineNo)
+			}
+			m.Base = &file
+		case AOFIncr:
+			if n := len(m.Incrs); n > 0 && file.Seq <= m.Incrs[n-1].Seq {
+				return nil, fmt.Errorf("invalid AOF manifest line %d: incr file sequence is not increasing", lineNo)
+			}
+			m.Incrs = append(m.Incrs, file)
+		case AOFHistory:
+			m.History = append(m.History, file)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, errors.New("invalid AOF manifest: line too long")
+		}
+		return nil, err
+	}
+	if m.Base == nil && len(m.Incrs) == 0 {
+		return nil, errors.New("invalid AOF manifest: no base or incr files")
+	}
+	return m, nil
+}
+
+func parseManifestLine(line string) (AOFFile, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return AOFFile{}, errors.New("odd number of fields")
+	}
+	var file AOFFile
+	for i := 0; i < len(fields); i += 2 {
+		value := fields[i+1]
+		switch fields[i] {
+		case "file":
+			if strings.ContainsAny(value, `/\`) {
+				return AOFFile{}, fmt.Errorf("file name %q is not a plain name", value)
+			}
+			file.Name = value
+		case "seq":
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seq < 1 {
+				return AOFFile{}, fmt.Errorf("bad seq %q", value)
+			}
+			file.Seq = seq
+		case "type":
+			if len(value) != 1 || !strings.Contains("bih", value) {
+				return AOFFile{}, fmt.Errorf("bad type %q", value)
+			}
+			file.Type = value[0]
+		}
+		// Like Redis, unknown keys are ignored for forward compatibility.
+	}
+	if file.Name == "" || file.Seq == 0 || file.Type == 0 {
+		return AOFFile{}, errors.New("missing file, seq or type")
+	}
+	return file, nil
+}
+
+func (m *Manifest) String() string {
+	var b strings.Builder
+	line := func(f AOFFile) {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", f.Name, f.Seq, f.Type)
+	}
+	if m.Base != nil {
+		line(*m.Base)
+	}
+	for _, f := range m.History {
+		line(f)
+	}
+	for _, f := range m.Incrs {
+		line(f)
+	}
+	return b.String()
+}
+
+// lastIncr returns the incr file appends go to.
+func (m *Manifest) lastIncr() *AOFFile {
+	if len(m.Incrs) == 0 {
+		return nil
+	}
+	return &m.Incrs[len(m.Incrs)-1]
+}
+
+func (m *Manifest) nextIncrSeq() int64 {
+	if last := m.lastIncr(); last != nil {
+		return last.Seq + 1
+	}
+	return 1
+}
+
+func (m *Manifest) nextBaseSeq() int64 {
+	if m.Base != nil {
+		return m.Base.Seq + 1
+	}
+	return 1
+}
+
+// LoadManifest reads the manifest at path.
+func LoadManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseManifest(f)
+}
+
+// writeManifest replaces the manifest at path through a fsynced
+// temporary file and an atomic rename.
+func writeManifest(path string, m *Manifest) error {
+	dir := filepath.Dir(path)
+	tmp := filepath.Join(dir, "temp-"+filepath.Base(path))
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(m.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
@@ -1,35 +1,353 @@
 package persistance
 
 import (
-	"encoding/gob"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"time"
 )
 
+// RDB opcodes.
+const (
+	opSlotInfo     = 0xf4
+	opFunction2    = 0xf5
+	opModuleAux    = 0xf7
+	opIdle         = 0xf8
+	opFreq         = 0xf9
+	opAux          = 0xfa
+	opResizeDB     = 0xfb
+	opExpireTimeMS = 0xfc
+	opExpireTime   = 0xfd
+	opSelectDB     = 0xfe
+	opEOF          = 0xff
+)
+
+const rdbMagic = "REDIS"
+
+// Version reported in the redis-ver aux field, matching RDBVersion.
+const redisCompatVersion = "6.2.0"
+
+// Entry is a single key as stored in an RDB file.
+type Entry struct {
+	DB       int
+	Key      string
+	Object   Object
+	ExpireAt int64 // unix milliseconds, 0 if the key does not expire
+	Idle     int64 // seconds since last access, -1 if unknown
+	Freq     int   // LFU counter, -1 if unknown
+}
+
 type Snapshot struct {
-	Data       map[string]any
-	Expiration map[string]int64
+	Entries []Entry
 }
 
-func SaveRDB(file string, snapshot Snapshot) error {
-	f, err := os.Create(file)
-	if err != nil {
+// crcWriter keeps a running CRC64 of everything written through it.
+type crcWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	c.crc = CRC64(c.crc, p)
+	return c.w.Write(p)
+}
+
+// RDBWriter streams a dataset in the Redis RDB format.
+type RDBWriter struct {
+	buf *bufio.Writer
+	crc *crcWriter
+	enc *rdbWriter
+	db  int
+}
+
+// RDBOptions control how snapshots are written.
+type RDBOptions struct {
+	Compression     bool     // LZF compress long strings, like rdbcompression
+	FileCompression string   // compress the whole file, RDBFileGzip or RDBFileNone
+	Keyring         *Keyring // encrypt the file with the current key, if set
+}
+
+// Whole-file compressions of RDBOptions.FileCompression.
+const (
+	RDBFileNone = "no"
+	RDBFileGzip = "gzip"
+)
+
+// NewRDBWriter writes the RDB header and the standard aux fields to w.
+// opts.FileCompression and opts.Keyring are up to the caller, see
+// WriteRDB.
+func NewRDBWriter(w io.Writer, opts RDBOptions) *RDBWriter {
+	buf := bufio.NewWriter(w)
+	crc := &crcWriter{w: buf}
+	rw := &RDBWriter{buf: buf, crc: crc, enc: &rdbWriter{w: crc, compress: opts.Compression}, db: -1}
+
+	rw.enc.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, RDBVersion)))
+	rw.WriteAux("redis-ver", redisCompatVersion)
+	rw.WriteAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	rw.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	return rw
+}
+
+func (rw *RDBWriter) WriteAux(key, value string) {
+	rw.enc.writeByte(opAux)
+	rw.enc.writeString(key)
+	rw.enc.writeString(value)
+}
+
+// WriteEntry writes one key, emitting a DB selector when e.DB changes.
+func (rw *RDBWriter) WriteEntry(e Entry) error {
+	if e.DB != rw.db {
+		rw.enc.writeByte(opSelectDB)
+		rw.enc.writeLen(uint64(e.DB))
+		rw.db = e.DB
+	}
+	if e.ExpireAt != 0 {
+		var ts [8]byte
+		binary.LittleEndian.PutUint64(ts[:], uint64(e.ExpireAt))
+		rw.enc.writeByte(opExpireTimeMS)
+		rw.enc.write(ts[:])
+	}
+	rw.enc.writeByte(e.Object.Type)
+	rw.enc.writeString(e.Key)
+	rw.enc.writeObjectValue(e.Object)
+	return rw.enc.err
+}
+
+// Close writes the EOF opcode and checksum and flushes the output. It
+// does not close the underlying writer.
+func (rw *RDBWriter) Close() error {
+	rw.enc.writeByte(opEOF)
+	if rw.enc.err != nil {
+		return rw.enc.err
+	}
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], rw.crc.crc)
+	if _, err := rw.buf.Write(sum[:]); err != nil {
 		return err
 	}
-	defer f.Close()
+	return rw.buf.Flush()
+}
 
-	encoder := gob.NewEncoder(f)
-	return encoder.Encode(snapshot)
+// RDBReader streams the keys of an RDB file.
+type RDBReader struct {
+	Version int
+	Aux     map[string]string
+	dec     *rdbReader
+	db      int
 }
 
-func LoadRDB(file string) (Snapshot, error) {
-	snap := Snapshot{}
+func NewRDBReader(r io.Reader) (*RDBReader, error) {
+	dec := &rdbReader{r: bufio.NewReader(r), size: -1}
+	header, err := dec.readFull(len(rdbMagic) + 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading RDB header: %w", err)
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil || version < 1 || version > MaxRDBVersion {
+		return nil, fmt.Errorf("can't handle RDB format version %s", header[len(rdbMagic):])
+	}
+	return &RDBReader{Version: version, Aux: make(map[string]string), dec: dec}, nil
+}
+
+// Next returns the next key, or io.EOF once the end of file marker was
+// read and the checksum verified.
+func (rr *RDBReader) Next() (Entry, error) {
+	e := Entry{Idle: -1, Freq: -1}
+	for {
+		op, err := rr.dec.readByte()
+		if err != nil {
+			return e, unexpected(err)
+		}
+
+		switch op {
+		case opEOF:
+			return e, rr.verifyChecksum()
+
+		case opSelectDB:
+			db, err := rr.dec.readCount()
+			if err != nil {
+				return e, unexpected(err)
+			}
+			rr.db = db
+
+		case opResizeDB:
+			if _, err := rr.dec.readCount(); err != nil {
+				return e, unexpected(err)
+			}
+			if _, err := rr.dec.readCount(); err != nil {
+				return e, unexpected(err)
+			}
+
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := rr.dec.readCount(); err != nil {
+					return e, unexpected(err)
+				}
+			}
+
+		case opAux:
+			key, err := rr.dec.readString()
+			if err != nil {
+				return e, unexpected(err)
+			}
+			value, err := rr.dec.readString()
+			if err != nil {
+				return e, unexpected(err)
+			}
+			rr.Aux[key] = value
+
+		case opFunction2:
+			// Function libraries have no meaning here; skip the code.
+			if _, err := rr.dec.readString(); err != nil {
+				return e, unexpected(err)
+			}
+
+		case opModuleAux:
+			return e, errors.New("RDB contains module data, which is not supported")
+
+		case opExpireTime:
+			buf, err := rr.dec.readFull(4)
+			if err != nil {
+				return e, unexpected(err)
+			}
+			e.ExpireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+
+		case opExpireTimeMS:
+			buf, err := rr.dec.readFull(8)
+			if err != nil {
+				return e, unexpected(err)
+			}
+			e.ExpireAt = int64(binary.LittleEndian.Uint64(buf))
+
+		case opIdle:
+			idle, err := rr.dec.readCount()
+			if err != nil {
+				return e, unexpected(err)
+			}
+			e.Idle = int64(idle)
+
+		case opFreq:
+			freq, err := rr.dec.readByte()
+			if err != nil {
+				return e, unexpected(err)
+			}
+			e.Freq = int(freq)
+
+		default:
+			key, err := rr.dec.readString()
+			if err != nil {
+				return e, unexpected(err)
+			}
+			obj, err := rr.dec.readObjectValue(op)
+			if err != nil {
+				return e, fmt.Errorf("key %q: %w", key, unexpected(err))
+			}
+			e.DB, e.Key, e.Object = rr.db, key, obj
+			return e, nil
+		}
+	}
+}
+
+func (rr *RDBReader) verifyChecksum() error {
+	if rr.Version < 5 {
+		return io.EOF
+	}
+	expected := rr.dec.crc
+	buf, err := rr.dec.readFull(8)
+	if err != nil {
+		return unexpected(err)
+	}
+	sum := binary.LittleEndian.Uint64(buf)
+	// A zero checksum means it was disabled when the file was written.
+	if sum != 0 && sum != expected {
+		return errors.New("wrong RDB checksum")
+	}
+	return io.EOF
+}
+
+// unexpected turns a premature io.EOF into io.ErrUnexpectedEOF so callers
+// can tell a truncated file from a complete one.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// SaveRDB writes snapshot to file through WriteRDB, keeping keep-1 older
+// snapshots.
+func SaveRDB(file string, snapshot Snapshot, keep int, opts RDBOptions) error {
+	return WriteRDB(file, keep, opts, func(w *RDBWriter) error {
+		for _, e := range snapshot.Entries {
+			if err := w.WriteEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadRDB reads the snapshot in file, which may be gzip compressed and
+// encrypted as a whole; keyring may be nil if it isn't encrypted. The
+// checksum at the end of the RDB data is verified, and that of the gzip
+// stream if there is one.
+func LoadRDB(file string, keyring *Keyring) (Snapshot, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return Snapshot{}, err
 	}
 	defer f.Close()
 
-	decoder := gob.NewDecoder(f)
-	err = decoder.Decode(&snap)
+	r, _, err := openDecrypted(bufio.NewReader(f), keyring)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		zr.Multistream(false)
+		snap, _, err := readSnapshot(zr)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		// Reading to the end makes gzip verify its own checksum.
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return Snapshot{}, fmt.Errorf("gzip stream: %w", err)
+		}
+		return snap, nil
+	}
+
+	snap, _, err := readSnapshot(r)
 	return snap, err
 }
+
+// readSnapshot reads a whole RDB from r and returns its length. Given a
+// *bufio.Reader it stops right after the checksum, so whatever follows can
+// still be read.
+func readSnapshot(r io.Reader) (Snapshot, int64, error) {
+	snap := Snapshot{}
+	rr, err := NewRDBReader(r)
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+	for {
+		e, err := rr.Next()
+		if err == io.EOF {
+			return snap, rr.dec.n, nil
+		}
+		if err != nil {
+			return Snapshot{}, rr.dec.n, err
+		}
+		snap.Entries = append(snap.Entries, e)
+	}
+}
@@ -0,0 +1,167 @@
+package persistance
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// WriteRDB writes a snapshot to path without ever leaving a partial file
+// behind: write streams into a temporary file in the same directory,
+// which is fsynced and renamed over path, and the directory is fsynced so
+// the rename survives a crash too. Up to keep-1 previous snapshots are
+// retained as path.1 (the newest), path.2 and so on. With
+// opts.FileCompression set to RDBFileGzip the file is gzip compressed as a
+// whole, and with opts.Keyring it is encrypted.
+func WriteRDB(path string, keep int, opts RDBOptions, write func(w *RDBWriter) error) error {
+	dir := filepath.Dir(path)
+	tmp := filepath.Join(dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeSynced(f, opts, write)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := rotateSnapshots(path, keep); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rotating old snapshots: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func writeSynced(f *os.File, opts RDBOptions, write func(w *RDBWriter) error) error {
+	var out io.Writer = f
+	var sealed *bufio.Writer
+	if key := opts.Keyring.current(); key != nil {
+		enc, err := newEncWriter(f, key)
+		if err != nil {
+			return err
+		}
+		// Seal in large chunks rather than per small write.
+		sealed = bufio.NewWriterSize(enc, 64<<10)
+		out = sealed
+	}
+	var zw *gzip.Writer
+	if opts.FileCompression == RDBFileGzip {
+		zw = gzip.NewWriter(out)
+		out = zw
+	}
+
+	w := NewRDBWriter(out, opts)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if sealed != nil {
+		if err := sealed.Flush(); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// snapshotGeneration is the name of the n-th older snapshot of path.
+func snapshotGeneration(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// rotateSnapshots shifts path.1 ... path.keep-2 up by one and hard links
+// the current path as path.1, so path itself stays in place until the new
+// snapshot is renamed over it. Generations beyond the retention are
+// removed.
+func rotateSnapshots(path string, keep int) error {
+	for n := max(keep, 1); ; n++ {
+		err := os.Remove(snapshotGeneration(path, n))
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if keep <= 1 {
+		return nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	for n := keep - 1; n >= 2; n-- {
+		err := os.Rename(snapshotGeneration(path, n-1), snapshotGeneration(path, n))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	newest := snapshotGeneration(path, 1)
+	os.Remove(newest)
+	if err := os.Link(path, newest); err != nil {
+		// No hard links here: fall back to moving the file, which briefly
+		// leaves only path.1 for startup to find.
+		return os.Rename(path, newest)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LoadLatestRDB loads path, or when it is missing or corrupt, the newest
+// retained older snapshot that loads cleanly. It returns the file that was
+// loaded. If no snapshot exists at all the error wraps os.ErrNotExist.
+func LoadLatestRDB(path string, keyring *Keyring) (Snapshot, string, error) {
+	var firstErr error
+	for n := 0; ; n++ {
+		file := path
+		if n > 0 {
+			file = snapshotGeneration(path, n)
+		}
+
+		snap, err := LoadRDB(file, keyring)
+		if err == nil {
+			if firstErr != nil {
+				log.Printf("[RDB] WARNING: loaded the older snapshot %s, changes made after it was taken are lost", file)
+			}
+			return snap, file, nil
+		}
+		if errors.Is(err, os.ErrNotExist) && n > 0 {
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[RDB] WARNING: snapshot %s is unusable: %v", file, err)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return Snapshot{}, "", firstErr
+}
@@ -37,6 +37,24 @@ func Parse(reader *bufio.Reader) (string, []string, error) {
 	return args[0], args[1:], nil
 }
 
+// Limits on requests, as in Redis: proto-max-bulk-len for the size of an
+// argument and the largest number of arguments it accepts.
+const (
+	MaxBulkLen   = 512 << 20
+	MaxArrayLen  = 1 << 20
+	preallocArgs = 1024 // arguments allocated upfront at most
+)
+
+// ProtocolError is a request that can't be parsed. The rest of the input
+// can't be trusted to start at a request, so the connection is closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
 func ParseRESP(r *bufio.Reader) (string, []string, error) {
 	line, err := r.ReadString('\n')
 	if err != nil {
@@ -47,22 +65,24 @@ func ParseRESP(r *bufio.Reader) (string, []string, error) {
 		return "", nil, errors.New("invalid RESP array")
 	}
 	numArgs, err := strconv.Atoi(line[1:])
-	if err != nil {
-		return "", nil, errors.New("invalid array size")
+	if err != nil || numArgs < 0 || numArgs > MaxArrayLen {
+		return "", nil, &ProtocolError{"invalid multibulk length"}
 	}
 
-	parts := make([]string, 0, numArgs)
+	parts := make([]string, 0, min(numArgs, preallocArgs))
 	for i := 0; i < numArgs; i++ {
 		lenLine, err := r.ReadString('\n')
 		if err != nil {
 			return "", nil, err
 		}
 		if !strings.HasPrefix(lenLine, "$") {
-			return "", nil, errors.New("expected bulk string")
+			return "", nil, &ProtocolError{"expected '$'"}
 		}
+		// $-1, the null bulk string, is a reply and has no place in a
+		// request.
 		strLen, err := strconv.Atoi(strings.TrimSpace(lenLine[1:]))
-		if err != nil {
-			return "", nil, errors.New("invalid bulk length")
+		if err != nil || strLen < 0 || strLen > MaxBulkLen {
+			return "", nil, &ProtocolError{"invalid bulk length"}
 		}
 
 		buf := make([]byte, strLen+2) // \r\n
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-clone/store"
+)
+
+const (
+	// Cached connections unused for longer than this are redialed.
+	migrateConnTTL = 10 * time.Second
+	// Upper bound on the number of cached target connections.
+	migrateMaxConns = 64
+)
+
+type migrateConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	lastUsed time.Time
+}
+
+// migrateCache keeps outbound connections to MIGRATE targets, so moving
+// many keys to the same instance does not reconnect for every call.
+type migrateCache struct {
+	mu    sync.Mutex
+	conns map[string]*migrateConn
+}
+
+func newMigrateCache() *migrateCache {
+	return &migrateCache{
+		conns: make(map[string]*migrateConn),
+	}
+}
+
+// get returns the cached connection to addr or dials a new one. The caller
+// owns the connection until it calls put or drop.
+func (c *migrateCache) get(addr string, timeout time.Duration) (*migrateConn, error) {
+	c.mu.Lock()
+	mc, ok := c.conns[addr]
+	delete(c.conns, addr)
+	c.mu.Unlock()
+
+	if ok && time.Since(mc.lastUsed) < migrateConnTTL {
+		return mc, nil
+	}
+	if ok {
+		mc.conn.Close()
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &migrateConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// put returns a healthy connection to the cache.
+func (c *migrateCache) put(addr string, mc *migrateConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.conns[addr]; ok {
+		old.conn.Close()
+	} else if len(c.conns) >= migrateMaxConns {
+		mc.conn.Close()
+		return
+	}
+	mc.lastUsed = time.Now()
+	c.conns[addr] = mc
+}
+
+type migrateArgs struct {
+	addr    string
+	keys    []string
+	db      int
+	timeout time.Duration
+	copy    bool
+	replace bool
+}
+
+// parseMigrateArgs parses MIGRATE host port key|"" db timeout [COPY]
+// [REPLACE] [KEYS key [key ...]].
+func parseMigrateArgs(args []string) (migrateArgs, error) {
+	var m migrateArgs
+	if len(args) < 5 {
+		return m, errors.New("wrong number of arguments for 'migrate'")
+	}
+	m.addr = net.JoinHostPort(args[0], args[1])
+
+	db, err := strconv.Atoi(args[3])
+	if err != nil {
+		return m, errors.New("invalid DB index")
+	}
+	m.db = db
+
+	timeout, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || timeout < 0 {
+		return m, errors.New("invalid timeout")
+	}
+	if timeout == 0 {
+		timeout = 1000
+	}
+	m.timeout = time.Duration(timeout) * time.Millisecond
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			m.copy = true
+		case "REPLACE":
+			m.replace = true
+		case "KEYS":
+			if args[2] != "" {
+				return m, errors.New("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			m.keys = args[i+1:]
+			i = len(args)
+		default:
+			return m, errors.New("syntax error")
+		}
+	}
+	if m.keys == nil {
+		m.keys = []string{args[2]}
+	}
+	return m, nil
+}
+
+func (s *Server) migrate(args []string) string {
+	m, err := parseMigrateArgs(args)
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	if m.db != 0 {
+		return "-ERR only one DB implemented\r\n"
+	}
+
+	sent, err := s.store.Migrate(m.keys, m.copy, func(items []store.MigrateItem) ([]bool, error) {
+		return s.sendMigrateItems(m, items)
+	})
+	if err != nil {
+		return "-" + err.Error() + "\r\n"
+	}
+	if sent == 0 {
+		return "+NOKEY\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// sendMigrateItems pipelines one RESTORE per item to the target and waits
+// for every reply, returning which items the target acknowledged. Any
+// failure drops the cached connection.
+func (s *Server) sendMigrateItems(m migrateArgs, items []store.MigrateItem) ([]bool, error) {
+	mc, err := s.migrateConns.get(m.addr, m.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("IOERR error or timeout connecting to the client: %v", err)
+	}
+	mc.conn.SetDeadline(time.Now().Add(m.timeout))
+
+	buf := make([]byte, 0)
+	for _, item := range items {
+		cmd := []string{"RESTORE", item.Key, strconv.FormatInt(item.TTL, 10), string(item.Payload)}
+		if m.replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		buf = append(buf, encodeCommand(cmd)...)
+	}
+	if _, err := mc.conn.Write(buf); err != nil {
+		mc.conn.Close()
+		return nil, fmt.Errorf("IOERR error or timeout writing to target instance: %v", err)
+	}
+
+	acked := make([]bool, 0, len(items))
+	var replyErr error
+	for range items {
+		line, err := mc.reader.ReadString('\n')
+		if err != nil {
+			mc.conn.Close()
+			return acked, fmt.Errorf("IOERR error or timeout reading from target instance: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-") && replyErr == nil {
+			replyErr = fmt.Errorf("ERR Target instance replied with error: %s", line[1:])
+		}
+		acked = append(acked, !strings.HasPrefix(line, "-"))
+	}
+
+	mc.conn.SetDeadline(time.Time{})
+	s.migrateConns.put(m.addr, mc)
+	return acked, replyErr
+}
+
+// encodeCommand formats a command as a RESP array of bulk strings.
+func encodeCommand(args []string) string {
+	out := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		out += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return out
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redis-clone/store"
+)
+
+// startServer serves a new empty store on a free localhost port and
+// returns the server with its address.
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(ln.Addr().String())
+	s.AttachStore(store.NewMemoryStoreWithAOF(nil))
+	go s.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return s, ln.Addr().String()
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply, with bulk strings unwrapped,
+// nil bulk strings as "(nil)" and arrays joined by spaces.
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(encodeCommand(args))); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.reply()
+}
+
+func (c *testClient) reply() string {
+	c.t.Helper()
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			items = append(items, c.reply())
+		}
+		return strings.Join(items, " ")
+	}
+	return line
+}
+
+func migrateCmd(target string, key string, opts ...string) []string {
+	host, port, _ := net.SplitHostPort(target)
+	return append([]string{"MIGRATE", host, port, key, "0", "1000"}, opts...)
+}
+
+func TestMigrate(t *testing.T) {
+	_, srcAddr := startServer(t)
+	_, dstAddr := startServer(t)
+	src, dst := dial(t, srcAddr), dial(t, dstAddr)
+
+	src.do("SET", "k", "v")
+	src.do("EXPIRE", "k", "100")
+	if got := src.do(migrateCmd(dstAddr, "k")...); got != "+OK" {
+		t.Fatalf("MIGRATE = %q, want +OK", got)
+	}
+	if got := src.do("EXISTS", "k"); got != ":0" {
+		t.Errorf("source EXISTS k = %q, want :0", got)
+	}
+	if got := dst.do("GET", "k"); got != "v" {
+		t.Errorf("target GET k = %q, want v", got)
+	}
+	if got := dst.do("TTL", "k"); got == ":-1" || got == ":-2" {
+		t.Errorf("target TTL k = %q, want the TTL to move along", got)
+	}
+
+	if got := src.do(migrateCmd(dstAddr, "missing")...); got != "+NOKEY" {
+		t.Errorf("MIGRATE of a missing key = %q, want +NOKEY", got)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	_, srcAddr := startServer(t)
+	_, dstAddr := startServer(t)
+	src, dst := dial(t, srcAddr), dial(t, dstAddr)
+
+	src.do("SET", "a", "1")
+	src.do("RPUSH", "b", "x", "y")
+	src.do("HSET", "c", "f", "v")
+	if got := src.do(migrateCmd(dstAddr, "", "KEYS", "a", "b", "c", "missing")...); got != "+OK" {
+		t.Fatalf("MIGRATE KEYS = %q, want +OK", got)
+	}
+	if got := src.do("DBSIZE"); got != ":0" {
+		t.Errorf("source DBSIZE = %q, want :0", got)
+	}
+	for _, tc := range []struct{ cmd, want string }{
+		{"GET a", "1"},
+		{"LRANGE b 0 -1", "x y"},
+		{"HGET c f", "v"},
+	} {
+		if got := dst.do(strings.Fields(tc.cmd)...); got != tc.want {
+			t.Errorf("target %s = %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	if got := src.do(migrateCmd(dstAddr, "a", "KEYS", "a")...); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("MIGRATE KEYS with a key argument = %q, want an error", got)
+	}
+}
+
+func TestMigrateCopyReplace(t *testing.T) {
+	_, srcAddr := startServer(t)
+	_, dstAddr := startServer(t)
+	src, dst := dial(t, srcAddr), dial(t, dstAddr)
+
+	src.do("SET", "k", "new")
+	dst.do("SET", "k", "old")
+
+	got := src.do(migrateCmd(dstAddr, "k", "COPY")...)
+	if !strings.Contains(got, "BUSYKEY") {
+		t.Fatalf("MIGRATE onto an existing key = %q, want a BUSYKEY error", got)
+	}
+	if got := src.do("GET", "k"); got != "new" {
+		t.Errorf("source GET k after BUSYKEY = %q, want new", got)
+	}
+	if got := dst.do("GET", "k"); got != "old" {
+		t.Errorf("target GET k after BUSYKEY = %q, want old", got)
+	}
+
+	if got := src.do(migrateCmd(dstAddr, "k", "COPY", "REPLACE")...); got != "+OK" {
+		t.Fatalf("MIGRATE COPY REPLACE = %q, want +OK", got)
+	}
+	if got := src.do("GET", "k"); got != "new" {
+		t.Errorf("source GET k after COPY = %q, want new", got)
+	}
+	if got := dst.do("GET", "k"); got != "new" {
+		t.Errorf("target GET k after REPLACE = %q, want new", got)
+	}
+}
+
+func TestMigrateTimeout(t *testing.T) {
+	_, srcAddr := startServer(t)
+	src := dial(t, srcAddr)
+
+	// A target that accepts connections but never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	src.do("SET", "k", "v")
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	start := time.Now()
+	got := src.do("MIGRATE", host, port, "k", "0", "100")
+	if !strings.HasPrefix(got, "-IOERR") {
+		t.Fatalf("MIGRATE to a silent target = %q, want an IOERR error", got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("MIGRATE took %v to time out, want about 100ms", elapsed)
+	}
+	if got := src.do("GET", "k"); got != "v" {
+		t.Errorf("source GET k after a timeout = %q, want v", got)
+	}
+	// The store must not stay locked while waiting on the target.
+	if got := src.do("SET", "other", "x"); got != "+OK" {
+		t.Errorf("SET after a timeout = %q, want +OK", got)
+	}
+}
+
+func cachedConn(s *Server, addr string) *migrateConn {
+	s.migrateConns.mu.Lock()
+	defer s.migrateConns.mu.Unlock()
+	return s.migrateConns.conns[addr]
+}
+
+func TestMigrateReusesConnection(t *testing.T) {
+	srv, srcAddr := startServer(t)
+	_, dstAddr := startServer(t)
+	src, dst := dial(t, srcAddr), dial(t, dstAddr)
+
+	src.do("SET", "a", "1")
+	src.do("SET", "b", "2")
+	if got := src.do(migrateCmd(dstAddr, "a")...); got != "+OK" {
+		t.Fatalf("first MIGRATE = %q, want +OK", got)
+	}
+	first := cachedConn(srv, dstAddr)
+	if first == nil {
+		t.Fatal("no cached connection after MIGRATE")
+	}
+	if got := src.do(migrateCmd(dstAddr, "b")...); got != "+OK" {
+		t.Fatalf("second MIGRATE = %q, want +OK", got)
+	}
+	if second := cachedConn(srv, dstAddr); second != first {
+		t.Error("second MIGRATE dialed a new connection instead of reusing the cached one")
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got := dst.do("GET", key); got != want {
+			t.Errorf("target GET %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMigrateKeepsKeysWrittenDuringSend(t *testing.T) {
+	srv, _ := startServer(t)
+	srv.store.Set("k", "v1")
+
+	sent, err := srv.store.Migrate([]string{"k"}, false, func(items []store.MigrateItem) ([]bool, error) {
+		// A client writes the key while the payload is on its way.
+		srv.store.Set("k", "v2")
+		return []bool{true}, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "k") {
+		t.Fatalf("Migrate = %d, %v, want an error naming k", sent, err)
+	}
+	if got, ok, err := srv.store.Get("k"); !ok || got != "v2" {
+		t.Errorf("Get(k) = %q, %v, %v, want the newer value v2 to be kept", got, ok, err)
+	}
+}
+
+// TestMigrateLargeHashAndSet moves a hashtable-encoded hash and a
+// setTable-encoded set, whose payloads differ between two dumps of the
+// same value.
+func TestMigrateLargeHashAndSet(t *testing.T) {
+	_, srcAddr := startServer(t)
+	_, dstAddr := startServer(t)
+	src, dst := dial(t, srcAddr), dial(t, dstAddr)
+
+	for i := 0; i < 300; i++ {
+		n := strconv.Itoa(i)
+		src.do("HSET", "h", "f"+n, "v"+n)
+		src.do("SADD", "s", "m"+n)
+	}
+	for key, want := range map[string]string{"h": "hashtable", "s": "hashtable"} {
+		if got := src.do("OBJECT", "ENCODING", key); got != want {
+			t.Fatalf("OBJECT ENCODING %s = %q, want %q", key, got, want)
+		}
+	}
+	if got := src.do(migrateCmd(dstAddr, "", "KEYS", "h", "s")...); got != "+OK" {
+		t.Fatalf("MIGRATE KEYS = %q, want +OK", got)
+	}
+	if got := src.do("EXISTS", "h", "s"); got != ":0" {
+		t.Errorf("source EXISTS h s = %q, want :0", got)
+	}
+	if got := dst.do("HGET", "h", "f299"); got != "v299" {
+		t.Errorf("target HGET h f299 = %q, want v299", got)
+	}
+	if got := dst.do("SCARD", "s"); got != ":300" {
+		t.Errorf("target SCARD s = %q, want :300", got)
+	}
+}
+
+// TestMigrateReportsRejectedKeys keeps a key the target refused and
+// moves the rest.
+func TestMigrateReportsRejectedKeys(t *testing.T) {
+	_, srcAddr := startServer(t)
+	_, dstAddr := startServer(t)
+	src, dst := dial(t, srcAddr), dial(t, dstAddr)
+
+	src.do("SET", "a", "1")
+	src.do("SET", "b", "2")
+	dst.do("SET", "b", "old")
+	got := src.do(migrateCmd(dstAddr, "", "KEYS", "a", "b")...)
+	if !strings.Contains(got, "BUSYKEY") {
+		t.Fatalf("MIGRATE KEYS onto an existing key = %q, want a BUSYKEY error", got)
+	}
+	if got := src.do("EXISTS", "a"); got != ":0" {
+		t.Errorf("source EXISTS a = %q, want the acknowledged key moved", got)
+	}
+	if got := src.do("GET", "b"); got != "2" {
+		t.Errorf("source GET b = %q, want the rejected key kept", got)
+	}
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-clone/resp"
+	"redis-clone/store"
+)
+
+const (
+	// A replica reconnects this long after losing its master.
+	replReconnectDelay = time.Second
+	// A replica reports its offset to the master this often.
+	replAckPeriod = time.Second
+	// A master silent for longer than this is considered gone; it pings
+	// every 10 seconds.
+	replTimeout = 60 * time.Second
+)
+
+// masterLink is the connection of a replica to its master. It reconnects
+// and syncs again after any failure until stopLink closes done.
+type masterLink struct {
+	addr string
+	done chan struct{}
+
+	conn net.Conn // current connection, guarded by Server.linkMu
+}
+
+// replicaOf implements REPLICAOF host port and REPLICAOF NO ONE.
+func (s *Server) replicaOf(args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'replicaof'\r\n"
+	}
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		s.stopLink()
+		if host, _ := s.store.Master(); host != "" {
+			s.store.SetMaster("", 0)
+			log.Println("[REPL] Replication stopped, this server is a master now")
+		}
+		return "+OK\r\n"
+	}
+
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return "-ERR Invalid master port\r\n"
+	}
+	if host, p := s.store.Master(); host == args[0] && p == port {
+		return "+OK Already connected to specified master\r\n"
+	}
+	s.ReplicaOf(args[0], port)
+	return "+OK\r\n"
+}
+
+// ReplicaOf makes the server a replica of host:port, dropping its dataset
+// for the one of the master once connected.
+func (s *Server) ReplicaOf(host string, port int) {
+	s.stopLink()
+	s.store.SetMaster(host, port)
+
+	link := &masterLink{addr: net.JoinHostPort(host, strconv.Itoa(port)), done: make(chan struct{})}
+	s.linkMu.Lock()
+	s.link = link
+	s.linkMu.Unlock()
+	log.Printf("[REPL] Replicating %s", link.addr)
+	go s.runLink(link)
+}
+
+// stopLink closes the link to the master, if any.
+func (s *Server) stopLink() {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+
+	if s.link == nil {
+		return
+	}
+	close(s.link.done)
+	if s.link.conn != nil {
+		s.link.conn.Close()
+	}
+	s.link = nil
+}
+
+func (s *Server) runLink(link *masterLink) {
+	for {
+		err := s.syncWithMaster(link)
+		select {
+		case <-link.done:
+			return
+		default:
+		}
+		log.Printf("[REPL] Lost the master %s: %v", link.addr, err)
+		s.store.SetMasterLinkState("connect")
+
+		select {
+		case <-link.done:
+			return
+		case <-time.After(replReconnectDelay):
+		}
+	}
+}
+
+// syncWithMaster connects to the master, gets a full sync and applies the
+// stream that follows until the connection fails.
+func (s *Server) syncWithMaster(link *masterLink) error {
+	s.store.SetMasterLinkState("connecting")
+	conn, err := net.DialTimeout("tcp", link.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.linkMu.Lock()
+	if s.link != link {
+		s.linkMu.Unlock()
+		conn.Close()
+		return errors.New("replication stopped")
+	}
+	link.conn = conn
+	s.linkMu.Unlock()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(replTimeout))
+	if _, err := masterCommand(conn, reader, "PING"); err != nil {
+		return err
+	}
+	if _, port, err := net.SplitHostPort(s.addr); err == nil {
+		if _, err := masterCommand(conn, reader, "REPLCONF", "listening-port", port); err != nil {
+			return err
+		}
+	}
+
+	s.store.SetMasterLinkState("sync")
+	replID, offset := s.store.PSyncArgs()
+	if _, err := io.WriteString(conn, encodeCommand([]string{"PSYNC", replID, strconv.FormatInt(offset, 10)})); err != nil {
+		return err
+	}
+	// The master may take a while to write a snapshot.
+	conn.SetDeadline(time.Time{})
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply := strings.Fields(strings.TrimRight(line, "\r\n"))
+	switch {
+	case len(reply) == 3 && reply[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(reply[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset in reply to PSYNC: %q", line)
+		}
+		if err := s.receiveSnapshot(conn, reader, reply[1], offset); err != nil {
+			return err
+		}
+		log.Printf("[REPL] Synchronized with the master %s", link.addr)
+	case len(reply) >= 1 && reply[0] == "+CONTINUE":
+		newID := ""
+		if len(reply) > 1 {
+			newID = reply[1]
+		}
+		s.store.ContinueReplication(newID)
+		log.Printf("[REPL] Partial resync with the master %s accepted", link.addr)
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %q", strings.TrimRight(line, "\r\n"))
+	}
+	s.store.SetMasterLinkState("connected")
+
+	go sendAcks(conn, s.store)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		cmd, args, err := resp.ParseRESP(reader)
+		if err != nil {
+			return err
+		}
+		raw := encodeCommand(append([]string{cmd}, args...))
+		s.store.ApplyFromMaster(cmd, args, raw)
+		// Flush once the commands received so far are applied, so a burst
+		// shares one write.
+		if reader.Buffered() == 0 {
+			if err := s.store.FlushAOF(); err != nil {
+				log.Println("[REPL] Can't write the master's commands to the AOF:", err)
+			}
+		}
+	}
+}
+
+// masterCommand sends a command to the master during the handshake and
+// returns its reply, failing on error replies.
+func masterCommand(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	if _, err := io.WriteString(conn, encodeCommand(args)); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("master replied to %s: %s", args[0], line[1:])
+	}
+	return line, nil
+}
+
+// receiveSnapshot reads the snapshot that follows +FULLRESYNC, a bulk
+// string without the trailing CRLF, into a temporary file and loads it as
+// the dataset at offset of the stream replID.
+func (s *Server) receiveSnapshot(conn net.Conn, reader *bufio.Reader, replID string, offset int64) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return fmt.Errorf("master failed to send a snapshot: %s", line[1:])
+	}
+	if !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("expected a snapshot from the master, got %q", line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid snapshot size: %q", line)
+	}
+
+	// Like the snapshot it replaces, in the working directory.
+	f, err := os.CreateTemp(".", "temp-sync-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	_, err = io.Copy(f, io.LimitReader(reader, size))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("receiving the snapshot: %w", err)
+	}
+	log.Printf("[REPL] Loading the %d byte snapshot of the master", size)
+	if err := s.store.LoadReplicaSnapshot(f.Name(), replID, offset); err != nil {
+		return fmt.Errorf("loading the snapshot of the master: %w", err)
+	}
+	return nil
+}
+
+// sendAcks reports the offset of the replica to the master until the
+// connection is closed.
+func sendAcks(conn net.Conn, memStore *store.MemoryStore) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		offset := strconv.FormatInt(memStore.ReplicationOffset(), 10)
+		if _, err := io.WriteString(conn, encodeCommand([]string{"REPLCONF", "ACK", offset})); err != nil {
+			return
+		}
+	}
+}
+
+// replconf implements REPLCONF, which replicas send to their master.
+func (s *Server) replconf(client *Client, args []string) string {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return "-ERR wrong number of arguments for 'replconf'\r\n"
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			client.replicaPort = port
+		case "ack":
+			offset, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err == nil && client.replica != nil {
+				client.replica.Ack(offset)
+			}
+			return ""
+		default:
+			// Capabilities and the like are accepted and ignored.
+		}
+	}
+	return "+OK\r\n"
+}
+
+// sync implements SYNC, the full sync of replicas older than PSYNC: it
+// sends the connection a snapshot of the dataset, then the stream of
+// commands appended to the AOF from then on. Replies to the commands the
+// replica sends afterwards are dropped.
+func (s *Server) sync(client *Client) string {
+	if client.replica != nil {
+		return ""
+	}
+	client.replica = s.newReplica(client)
+	go s.serveReplica(client.conn, client.replica, false)
+	return ""
+}
+
+// psync implements PSYNC replid offset. It continues the stream the
+// replica has from offset if the backlog allows, and replies +CONTINUE;
+// otherwise it replies +FULLRESYNC with the replication ID and offset of
+// a snapshot, which follows as for SYNC.
+func (s *Server) psync(client *Client, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'psync'\r\n"
+	}
+	if client.replica != nil {
+		return ""
+	}
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	client.replica = s.newReplica(client)
+	if replID, ok := s.store.PartialSync(client.replica, args[0], offset); ok {
+		log.Printf("[REPL] Partial resync of replica %s:%d from offset %d", client.replica.Addr, client.replica.Port, offset)
+		go s.continueReplica(client.conn, client.replica, replID)
+		return ""
+	}
+	go s.serveReplica(client.conn, client.replica, true)
+	return ""
+}
+
+func (s *Server) newReplica(client *Client) *store.Replica {
+	addr, _, _ := net.SplitHostPort(client.conn.RemoteAddr().String())
+	return s.store.AddReplica(addr, client.replicaPort)
+}
+
+// serveReplica sends the snapshot and then the stream to a replica,
+// announcing the snapshot with +FULLRESYNC if it asked with PSYNC.
+func (s *Server) serveReplica(conn net.Conn, replica *store.Replica, psync bool) {
+	defer conn.Close()
+	defer s.store.RemoveReplica(replica)
+
+	path, replID, offset, err := s.store.ReplicaSnapshot(replica)
+	if err != nil {
+		log.Printf("[REPL] Full sync of replica %s:%d failed: %v", replica.Addr, replica.Port, err)
+		return
+	}
+	if psync {
+		_, err = fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n", replID, offset)
+	}
+	if err == nil {
+		err = sendSnapshot(conn, path)
+	}
+	os.Remove(path)
+	if err != nil {
+		log.Printf("[REPL] Can't send the snapshot to replica %s:%d: %v", replica.Addr, replica.Port, err)
+		return
+	}
+	replica.Online()
+	log.Printf("[REPL] Replica %s:%d is online", replica.Addr, replica.Port)
+	streamToReplica(conn, replica)
+}
+
+// continueReplica serves a partial resync: the stream goes on after
+// +CONTINUE, starting with the part the replica missed.
+func (s *Server) continueReplica(conn net.Conn, replica *store.Replica, replID string) {
+	defer conn.Close()
+	defer s.store.RemoveReplica(replica)
+
+	if _, err := fmt.Fprintf(conn, "+CONTINUE %s\r\n", replID); err != nil {
+		return
+	}
+	streamToReplica(conn, replica)
+}
+
+func streamToReplica(conn net.Conn, replica *store.Replica) {
+	for {
+		buf, err := replica.Next()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			log.Printf("[REPL] Lost replica %s:%d: %v", replica.Addr, replica.Port, err)
+			return
+		}
+	}
+}
+
+func sendSnapshot(conn net.Conn, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "$%d\r\n", info.Size()); err != nil {
+		return err
+	}
+	_, err = io.Copy(conn, f)
+	return err
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+// startReplServer is startServer with an AOF, which feeds the replicas,
+// and the working directory, where snapshots for replicas are written,
+// moved to a temporary directory.
+func startReplServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	s, addr := startServer(t)
+	aof, err := persistance.OpenAOF(dir, "appendonly-"+strings.ReplaceAll(addr, ":", "-")+".aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.SetAOF(aof); err != nil {
+		t.Fatal(err)
+	}
+	return s, addr
+}
+
+// psync sends PSYNC as a replica would and returns the status line of the
+// reply, reading past the snapshot of a full resync.
+func (c *testClient) psync(replID string, offset int64) string {
+	c.t.Helper()
+	status := c.do("PSYNC", replID, strconv.FormatInt(offset, 10))
+	if !strings.HasPrefix(status, "+FULLRESYNC ") {
+		return status
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	size, err := strconv.ParseInt(strings.TrimRight(line, "\r\n")[1:], 10, 64)
+	if err != nil {
+		c.t.Fatalf("PSYNC sent %q instead of a snapshot", line)
+	}
+	// The snapshot has no CRLF after it.
+	if _, err := io.CopyN(io.Discard, c.reader, size); err != nil {
+		c.t.Fatal(err)
+	}
+	return status
+}
+
+// info returns field of INFO replication.
+func (c *testClient) info(field string) string {
+	c.t.Helper()
+	for _, line := range strings.Split(c.do("INFO", "replication"), "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	c.t.Fatalf("INFO replication has no %s", field)
+	return ""
+}
+
+func (c *testClient) infoInt(field string) int64 {
+	c.t.Helper()
+	n, err := strconv.ParseInt(c.info(field), 10, 64)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPSyncInsideBacklog reconnects a replica that missed commands the
+// backlog still holds; it gets them after +CONTINUE.
+func TestPSyncInsideBacklog(t *testing.T) {
+	_, addr := startReplServer(t)
+	c := dial(t, addr)
+	c.do("SET", "a", "1")
+
+	r := dial(t, addr)
+	status := r.psync("?", -1)
+	fields := strings.Fields(status)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("PSYNC ? -1 = %q, want +FULLRESYNC", status)
+	}
+	replID := fields[1]
+	c.do("SET", "b", "2")
+	if got := r.reply(); got != "SET b 2" {
+		t.Fatalf("stream after the full sync = %q, want SET b 2", got)
+	}
+	offset := c.infoInt("master_repl_offset")
+	r.conn.Close()
+
+	c.do("SET", "c", "3")
+	r = dial(t, addr)
+	if got, want := r.psync(replID, offset+1), "+CONTINUE "+replID; got != want {
+		t.Fatalf("PSYNC from within the backlog = %q, want %q", got, want)
+	}
+	if got := r.reply(); got != "SET c 3" {
+		t.Errorf("stream after +CONTINUE = %q, want SET c 3", got)
+	}
+}
+
+// TestPSyncOutsideBacklog reconnects a replica that missed more than the
+// backlog holds, and one with another replication ID; both need a full
+// resync.
+func TestPSyncOutsideBacklog(t *testing.T) {
+	_, addr := startReplServer(t)
+	c := dial(t, addr)
+	if got := c.do("CONFIG", "SET", "repl-backlog-size", "16kb"); got != "+OK" {
+		t.Fatalf("CONFIG SET repl-backlog-size = %q", got)
+	}
+
+	r := dial(t, addr)
+	replID := strings.Fields(r.psync("?", -1))[1]
+	offset := c.infoInt("master_repl_offset")
+	r.conn.Close()
+
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 20; i++ {
+		c.do("SET", "k"+strconv.Itoa(i), value)
+	}
+	r = dial(t, addr)
+	if got := r.psync(replID, offset+1); !strings.HasPrefix(got, "+FULLRESYNC "+replID+" ") {
+		t.Errorf("PSYNC from before the backlog = %q, want +FULLRESYNC", got)
+	}
+
+	r = dial(t, addr)
+	other := strings.Repeat("0123456789", 4)
+	if got := r.psync(other, c.infoInt("master_repl_offset")+1); !strings.HasPrefix(got, "+FULLRESYNC "+replID+" ") {
+		t.Errorf("PSYNC with another replication ID = %q, want +FULLRESYNC", got)
+	}
+}
+
+// TestPSyncAfterPromotion promotes a replica; the other replicas of its
+// old master can continue from it with the replication ID of that master.
+func TestPSyncAfterPromotion(t *testing.T) {
+	_, masterAddr := startReplServer(t)
+	replica, replicaAddr := startReplServer(t)
+	m, r := dial(t, masterAddr), dial(t, replicaAddr)
+
+	host, port, _ := net.SplitHostPort(masterAddr)
+	if got := r.do("REPLICAOF", host, port); got != "+OK" {
+		t.Fatalf("REPLICAOF = %q, want +OK", got)
+	}
+	t.Cleanup(replica.stopLink)
+	m.do("SET", "k", "v")
+	waitFor(t, "the replica to catch up", func() bool {
+		return r.do("GET", "k") == "v" && r.infoInt("slave_repl_offset") == m.infoInt("master_repl_offset")
+	})
+	oldID := m.info("master_replid")
+	if got := r.info("master_replid"); got != oldID {
+		t.Fatalf("replica has replication ID %s, want the one of its master %s", got, oldID)
+	}
+
+	if got := r.do("REPLICAOF", "NO", "ONE"); got != "+OK" {
+		t.Fatalf("REPLICAOF NO ONE = %q, want +OK", got)
+	}
+	newID := r.info("master_replid")
+	if newID == oldID || r.info("master_replid2") != oldID {
+		t.Fatalf("promoted replica has IDs %s and %s, want a new one and %s", newID, r.info("master_replid2"), oldID)
+	}
+	offset := r.infoInt("master_repl_offset")
+
+	p := dial(t, replicaAddr)
+	if got, want := p.psync(oldID, offset+1), "+CONTINUE "+newID; got != want {
+		t.Fatalf("PSYNC with the old ID = %q, want %q", got, want)
+	}
+	r.do("SET", "after", "promotion")
+	if got := p.reply(); got != "SET after promotion" {
+		t.Errorf("stream after +CONTINUE = %q, want SET after promotion", got)
+	}
+
+	// The old ID is only good up to the promotion.
+	p = dial(t, replicaAddr)
+	if got := p.psync(oldID, offset+2); !strings.HasPrefix(got, "+FULLRESYNC "+newID+" ") {
+		t.Errorf("PSYNC with the old ID past the promotion = %q, want +FULLRESYNC", got)
+	}
+}
@@ -2,24 +2,31 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"redis-clone/resp"
 	"redis-clone/store"
 )
 
 type Server struct {
-	addr  string
-	store *store.MemoryStore
+	addr         string
+	store        *store.MemoryStore
+	migrateConns *migrateCache
+
+	linkMu sync.Mutex
+	link   *masterLink // nil unless this server is a replica
 }
 
 func New(addr string) *Server {
 	return &Server{
-		addr: addr,
+		addr:         addr,
+		migrateConns: newMigrateCache(),
 	}
 }
 
@@ -27,6 +34,12 @@ type Client struct {
 	conn       net.Conn
 	inTx       bool
 	queuedCmds [][]string
+
+	// A replica announces its port with REPLCONF listening-port before it
+	// sends SYNC, after which replica is set and the connection carries
+	// the replication stream.
+	replicaPort int
+	replica     *store.Replica
 }
 
 func (s *Server) ListenAndServe() error {
@@ -34,6 +47,12 @@ func (s *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Serve accepts client connections on ln until it fails, closing it
+// before returning.
+func (s *Server) Serve(ln net.Listener) error {
 	defer ln.Close()
 
 	for {
@@ -49,19 +68,38 @@ func (s *Server) ListenAndServe() error {
 
 func (s *Server) handleConnection(client *Client) {
 	defer client.conn.Close()
+	defer func() {
+		if client.replica != nil {
+			s.store.RemoveReplica(client.replica)
+		}
+	}()
 	reader := bufio.NewReader(client.conn)
 
 	subs := make(map[string]chan string)
 
 	for {
-		cmd, args, err := resp.Parse(reader)
+		cmd, args, err := resp.ParseRESP(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		var protoErr *resp.ProtocolError
+		if errors.As(err, &protoErr) {
+			client.conn.Write([]byte("-ERR " + protoErr.Error() + "\r\n"))
+			return
+		}
 		if err != nil {
 			client.conn.Write([]byte("-ERR invalid command\r\n"))
 			continue
 		}
 
-		resp := s.executeCommand(cmd, args, client.conn, subs)
-		client.conn.Write([]byte(resp))
+		resp := s.executeCommand(cmd, args, client, subs)
+		if err := s.store.FlushAOF(); err != nil {
+			resp = "-ERR error writing to the AOF: " + err.Error() + "\r\n"
+		}
+		// Replicas get the replication stream and no replies.
+		if client.replica == nil {
+			client.conn.Write([]byte(resp))
+		}
 	}
 
 	// for chName, subCh := range subs {
@@ -70,7 +108,11 @@ func (s *Server) handleConnection(client *Client) {
 	// }
 }
 
-func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs map[string]chan string) string {
+func (s *Server) executeCommand(cmd string, args []string, client *Client, subs map[string]chan string) string {
+	if err := s.store.CheckWrite(cmd); err != nil {
+		return "-" + err.Error() + "\r\n"
+	}
+
 	switch strings.ToUpper(cmd) {
 	case "PING":
 		return "+PONG\r\n"
@@ -86,7 +128,10 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'get'\r\n"
 		}
-		val, ok := s.store.Get(args[0])
+		val, ok, err := s.store.Get(args[0])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		if !ok {
 			return "$-1\r\n"
 		}
@@ -108,22 +153,31 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) < 2 {
 			return "-ERR wrong number of arguments for 'lpush'\r\n"
 		}
-		count := s.store.LPush(args[0], args[1:]...)
+		count, err := s.store.LPush(args[0], args[1:]...)
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "RPUSH":
 		if len(args) < 2 {
 			return "-ERR wrong number of arguments for 'rpush'\r\n"
 		}
-		count := s.store.RPush(args[0], args[1:]...)
+		count, err := s.store.RPush(args[0], args[1:]...)
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "LPOP":
 		if len(args) < 1 {
 			return "-ERR wrong number of arguments for 'lpop'\r\n"
 		}
-		val, err := s.store.LPop(args[0])
+		val, ok, err := s.store.LPop(args[0])
 		if err != nil {
+			return store.ErrorReply(err)
+		}
+		if !ok {
 			return "$-1\r\n"
 		}
 		return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
@@ -132,8 +186,11 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) < 1 {
 			return "-ERR wrong number of arguments for 'rpop'\r\n"
 		}
-		val, err := s.store.RPop(args[0])
+		val, ok, err := s.store.RPop(args[0])
 		if err != nil {
+			return store.ErrorReply(err)
+		}
+		if !ok {
 			return "$-1\r\n"
 		}
 		return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
@@ -150,7 +207,7 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 
 		items, err := s.store.LRange(args[0], start, stop)
 		if err != nil {
-			return "-ERR" + err.Error() + "\r\n"
+			return store.ErrorReply(err)
 		}
 
 		resp := fmt.Sprintf("*%d\r\n", len(items))
@@ -164,7 +221,10 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 			return "-ERR wrong number of arguments for 'sadd'\r\n"
 		}
 
-		count := s.store.SAdd(args[0], args[1:]...)
+		count, err := s.store.SAdd(args[0], args[1:]...)
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "SREM":
@@ -172,14 +232,21 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 			return "-ERR wrong number of arguments for 'srem'\r\n"
 		}
 
-		count := s.store.SRem(args[0], args[1:]...)
+		count, err := s.store.SRem(args[0], args[1:]...)
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "SISMEMBER":
 		if len(args) != 2 {
 			return "-ERR wrong number of arguments for 'sismember'\r\n"
 		}
-		if s.store.SIsMember(args[0], args[1]) {
+		isMember, err := s.store.SIsMember(args[0], args[1])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
+		if isMember {
 			return ":1\r\n"
 		}
 		return ":0\r\n"
@@ -188,7 +255,10 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'smembers'\r\n"
 		}
-		members, ok := s.store.SMembers(args[0])
+		members, ok, err := s.store.SMembers(args[0])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		if !ok {
 			return "*0\r\n"
 		}
@@ -202,14 +272,20 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) != 1 {
 			return "-ERR wrong number of arguemnts for 'scard'\r\n"
 		}
-		count := s.store.SCard(args[0])
+		count, err := s.store.SCard(args[0])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "SUNION":
 		if len(args) < 1 {
 			return "-ERR wrong number of arguments for 'sunion'\r\n"
 		}
-		union := s.store.SUnion(args...)
+		union, err := s.store.SUnion(args...)
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		resp := fmt.Sprintf("*%d\r\n", len(union))
 		for _, m := range union {
 			resp += fmt.Sprintf("$%d\r\n%s\r\n", len(m), m)
@@ -217,17 +293,27 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		return resp
 
 	case "HSET":
-		if len(args) != 3 {
+		if len(args) < 3 || len(args)%2 != 1 {
 			return "-ERR wrong number of arguments for 'hset'\r\n"
 		}
-		added := s.store.HSet(args[0], args[1], args[2])
+		added := 0
+		for i := 1; i < len(args); i += 2 {
+			n, err := s.store.HSet(args[0], args[i], args[i+1])
+			if err != nil {
+				return store.ErrorReply(err)
+			}
+			added += n
+		}
 		return fmt.Sprintf(":%d\r\n", added)
 
 	case "HGET":
 		if len(args) != 2 {
 			return "-ERR wrong number of arguments for 'hget'\r\n"
 		}
-		val, ok := s.store.HGet(args[0], args[1])
+		val, ok, err := s.store.HGet(args[0], args[1])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		if !ok {
 			return "$-1\r\n"
 		}
@@ -237,7 +323,10 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'hgetall'\r\n"
 		}
-		pairs, ok := s.store.HGetAll(args[0])
+		pairs, ok, err := s.store.HGetAll(args[0])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		if !ok {
 			return "*0\r\n"
 		}
@@ -251,14 +340,20 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		if len(args) < 2 {
 			return "-ERR wrong number of arguments for 'hdel'\r\n"
 		}
-		count := s.store.HDel(args[0], args[1:]...)
+		count, err := s.store.HDel(args[0], args[1:]...)
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "HEXISTS":
 		if len(args) != 2 {
 			return "-ERR wrong number of arguments for 'hexists'\r\n"
 		}
-		exists := s.store.HExists(args[0], args[1])
+		exists, err := s.store.HExists(args[0], args[1])
+		if err != nil {
+			return store.ErrorReply(err)
+		}
 		if exists {
 			return ":1\r\n"
 		}
@@ -285,21 +380,13 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		ttl := s.store.TTL(args[0])
 		return fmt.Sprintf(":%d\r\n", ttl)
 
-	case "SAVE":
-		err := s.store.LoadSnapshot("dump.rdb")
-		if err != nil {
-			log.Println(err)
-			return "-ERR failed to save snapshot\r\n"
-		}
-		return "+OK\r\n"
-
 	case "INCR":
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'incr'\r\n"
 		}
 		n, err := s.store.Incr(args[0])
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return store.ErrorReply(err)
 		}
 		return fmt.Sprintf(":%d\r\n", n)
 
@@ -313,7 +400,7 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		}
 		n, err := s.store.HIncrBy(args[0], args[1], incr)
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return store.ErrorReply(err)
 		}
 		return fmt.Sprintf(":%d\r\n", n)
 
@@ -345,7 +432,7 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		}
 		err := s.store.Rename(args[0], args[1])
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return store.ErrorReply(err)
 		}
 		return "+OK\r\n"
 
@@ -359,7 +446,7 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 		}
 		err = s.store.Move(args[0], dbIndex)
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return store.ErrorReply(err)
 		}
 		return ":1\r\n"
 
@@ -376,11 +463,26 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 			for msg := range ch {
 				reply := fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
 					len(args[0]), args[0], len(msg), msg)
-				conn.Write([]byte(reply))
+				client.conn.Write([]byte(reply))
 			}
 		}()
 		return "+OK\r\n" // no immediate reply, subscription is async
 
+	case "MIGRATE":
+		return s.migrate(args)
+
+	case "REPLICAOF", "SLAVEOF":
+		return s.replicaOf(args)
+
+	case "REPLCONF":
+		return s.replconf(client, args)
+
+	case "SYNC":
+		return s.sync(client)
+
+	case "PSYNC":
+		return s.psync(client, args)
+
 	case "PUBLISH":
 		if len(args) != 2 {
 			return "-ERR PUBLISH requires channel and message\r\n"
@@ -400,15 +502,17 @@ func (s *Server) executeCommand(cmd string, args []string, conn net.Conn, subs m
 				close(subCh)
 				delete(subs, chName)
 
-				conn.Write([]byte(fmt.Sprintf("*2\r\n$11\r\nunsubscribed\r\n$%d\r\n%s\r\n", len(chName), chName)))
+				client.conn.Write([]byte(fmt.Sprintf("*2\r\n$11\r\nunsubscribed\r\n$%d\r\n%s\r\n", len(chName), chName)))
 			} else {
-				conn.Write([]byte(fmt.Sprintf("*2\r\n$11\r\nunsubscribed\r\n$%d\r\n%s\r\n", len(chName), chName)))
+				client.conn.Write([]byte(fmt.Sprintf("*2\r\n$11\r\nunsubscribed\r\n$%d\r\n%s\r\n", len(chName), chName)))
 			}
 		}
 		return ""
 
 	default:
-		return "-ERR unknown command\r\n"
+		// Commands that don't depend on the connection are shared with
+		// AOF replay and live in the store.
+		return s.store.ExecuteRaw(cmd, args)
 	}
 }
 
@@ -0,0 +1,212 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+// Elements per RPUSH, SADD or HSET in a rewritten AOF, like Redis'
+// AOF_REWRITE_ITEMS_PER_CMD.
+const aofRewriteItemsPerCmd = 64
+
+// aofRewriteStats backs the AOF rewrite fields of INFO.
+type aofRewriteStats struct {
+	lastOK   bool
+	lastTime time.Duration // -1 before the first rewrite
+}
+
+// BGRewriteAOF replaces the AOF in the background by a new base file
+// holding the current dataset, as an RDB preamble with
+// aof-use-rdb-preamble or else as the shortest command sequence that
+// rebuilds it. It uses the same copy-on-write view of the keyspace as
+// BGSave; commands run meanwhile go to a new incr file that is kept.
+func (s *MemoryStore) BGRewriteAOF() error {
+	aof, preamble, save, err := s.startAOFRewrite()
+	if err != nil {
+		return err
+	}
+	go s.runAOFRewrite(aof, preamble, save)
+	return nil
+}
+
+// RewriteAOF is BGRewriteAOF waiting for the rewrite to finish.
+func (s *MemoryStore) RewriteAOF() error {
+	aof, preamble, save, err := s.startAOFRewrite()
+	if err != nil {
+		return err
+	}
+	return s.runAOFRewrite(aof, preamble, save)
+}
+
+// startAOFRewrite takes the snapshot for a rewrite. The returned options
+// are those of the RDB preamble, nil without aof-use-rdb-preamble.
+func (s *MemoryStore) startAOFRewrite() (*persistance.AOF, *persistance.RDBOptions, *bgSave, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aof == nil {
+		return nil, nil, nil, errors.New("AOF is not enabled")
+	}
+	if s.bgsave != nil {
+		if s.bgsave.aofRewrite {
+			return nil, nil, nil, errors.New("Background append only file rewriting already in progress")
+		}
+		return nil, nil, nil, errors.New("Background save in progress, can't rewrite the AOF right now")
+	}
+	// Rereading the key file here lets a rewrite rotate the key: the new
+	// base and incr files use the first key in it.
+	if err := s.reloadKeyring(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.aof.SetKeyring(s.keyring); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.aof.StartRewrite(); err != nil {
+		return nil, nil, nil, err
+	}
+	var preamble *persistance.RDBOptions
+	if s.config.AOFUseRDBPreamble {
+		// The AOF must stay readable as is, so only strings are compressed.
+		preamble = &persistance.RDBOptions{Compression: s.config.RDBCompression}
+	}
+	return s.aof, preamble, s.startBackground(true), nil
+}
+
+func (s *MemoryStore) runAOFRewrite(aof *persistance.AOF, preamble *persistance.RDBOptions, save *bgSave) error {
+	err := aof.Rewrite(preamble != nil, func(w io.Writer) error {
+		if preamble != nil {
+			rw := persistance.NewRDBWriter(w, *preamble)
+			if err := writeEntries(rw, save.data, save.expiration); err != nil {
+				return err
+			}
+			return rw.Close()
+		}
+		return writeAOFRewrite(w, save.data, save.expiration)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finishBackground()
+	s.aofRewriteStats.lastOK = err == nil
+	s.aofRewriteStats.lastTime = time.Since(save.started)
+	if err != nil {
+		log.Println("[AOF] Background AOF rewrite failed:", err)
+		return err
+	}
+	log.Println("[AOF] Background AOF rewrite finished successfully")
+	return nil
+}
+
+// writeAOFRewrite writes the commands that recreate data. Expiration times
+// are in unix seconds, as in MemoryStore.expiration.
+func writeAOFRewrite(w io.Writer, data map[string]interface{}, expiration map[string]int64) error {
+	for key, val := range data {
+		obj, err := toObject(val)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+
+		switch obj.Type {
+		case persistance.TypeString:
+			err = persistance.WriteCommand(w, "SET", key, obj.Value)
+		case persistance.TypeList:
+			err = writeBatched(w, "RPUSH", key, obj.Items, 1)
+		case persistance.TypeSet:
+			err = writeBatched(w, "SADD", key, obj.Items, 1)
+		case persistance.TypeHash:
+			err = writeBatched(w, "HSET", key, obj.Items, 2)
+		}
+		if err != nil {
+			return err
+		}
+
+		if expireAt, ok := expiration[key]; ok {
+			err := persistance.WriteCommand(w, "PEXPIREAT", key, strconv.FormatInt(expireAt*1000, 10))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBatched writes items as cmd key item... with at most
+// aofRewriteItemsPerCmd elements of stride items each per command.
+func writeBatched(w io.Writer, cmd, key string, items []string, stride int) error {
+	batch := aofRewriteItemsPerCmd * stride
+	for start := 0; start < len(items); start += batch {
+		end := min(start+batch, len(items))
+		args := append([]string{key}, items[start:end]...)
+		if err := persistance.WriteCommand(w, cmd, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplayAOF loads the dataset from aof: an RDB base or preamble replaces
+// the keyspace and the commands are executed in order. It must run before
+// SetAOF, or the replayed commands would be appended again.
+func (s *MemoryStore) ReplayAOF(aof *persistance.AOF) error {
+	s.mu.Lock()
+	loadTruncated, keyring := s.config.AOFLoadTruncated, s.keyring
+	s.mu.Unlock()
+
+	return aof.Replay(loadTruncated, keyring, func(snap persistance.Snapshot) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return s.loadEntries(snap.Entries)
+	}, func(cmd string, args []string) error {
+		s.ExecuteRaw(cmd, args)
+		return nil
+	})
+}
+
+// RecoverAOF loads the dataset from the AOF at path as it was at target,
+// reading the files without changing them. Like ReplayAOF it must run
+// before SetAOF, on a store meant to hold the recovered dataset.
+func (s *MemoryStore) RecoverAOF(path string, target persistance.RecoveryTarget) (persistance.Recovery, error) {
+	s.mu.Lock()
+	keyring := s.keyring
+	s.mu.Unlock()
+
+	return persistance.RecoverAOF(path, keyring, target, func(snap persistance.Snapshot) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return s.loadEntries(snap.Entries)
+	}, func(cmd string, args []string) error {
+		s.ExecuteRaw(cmd, args)
+		return nil
+	})
+}
+
+// aofRewriteDue reports whether the AOF grew enough since the last
+// rewrite for auto-aof-rewrite-percentage and auto-aof-rewrite-min-size.
+func (s *MemoryStore) aofRewriteDue() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aof == nil || s.bgsave != nil || s.config.AutoAOFRewritePercentage == 0 {
+		return false
+	}
+	stats := s.aof.Stats()
+	if stats.Size < s.config.AutoAOFRewriteMinSize {
+		return false
+	}
+	base := max(stats.BaseSize, 1)
+	growth := (stats.Size - base) * 100 / base
+	if growth < int64(s.config.AutoAOFRewritePercentage) {
+		return false
+	}
+	log.Printf("[AOF] Starting automatic rewriting of AOF on %d%% growth", growth)
+	return true
+}
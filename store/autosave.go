@@ -0,0 +1,121 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// After a failed background save, save points don't trigger another one
+// for this long, like Redis' CONFIG_BGSAVE_RETRY_DELAY.
+const bgsaveRetryDelay = 5 * time.Second
+
+var ErrMisconf = errors.New("MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. " +
+	"Commands that may modify the data set are disabled, because this instance is configured to report errors during writes " +
+	"if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.")
+
+// SavePoint triggers a background save once Seconds have passed since the
+// last save and at least Changes keys were modified.
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+// ParseSavePoints parses the "save" parameter: pairs of seconds and
+// changes such as "900 1 300 10". An empty string disables saving.
+func ParseSavePoints(value string) ([]SavePoint, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid save parameters")
+	}
+	points := make([]SavePoint, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+	}
+	return points, nil
+}
+
+func formatSavePoints(points []SavePoint) string {
+	fields := make([]string, 0, len(points)*2)
+	for _, p := range points {
+		fields = append(fields, strconv.FormatInt(p.Seconds, 10), strconv.FormatInt(p.Changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// writeCommands are the commands refused while stop-writes-on-bgsave-error
+// is in effect, and on read-only replicas.
+var writeCommands = map[string]bool{
+	"SET": true, "DEL": true, "UNLINK": true, "INCR": true,
+	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true,
+	"SADD": true, "SREM": true, "HSET": true, "HDEL": true, "HINCRBY": true,
+	"EXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true, "RENAME": true, "RENAMENX": true, "MOVE": true, "COPY": true,
+	"FLUSHALL": true, "RESTORE": true, "MIGRATE": true, "SORT": true,
+}
+
+// CheckWrite returns ErrMisconf if cmd modifies the dataset while writes
+// are stopped because the last background save failed, and ErrReadOnly if
+// it does on a read-only replica.
+func (s *MemoryStore) CheckWrite(cmd string) error {
+	if !writeCommands[strings.ToUpper(cmd)] {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.StopWritesOnBgsaveError && len(s.config.Save) > 0 && !s.saveStats.lastBgsaveOK {
+		return ErrMisconf
+	}
+	return s.checkReadOnly()
+}
+
+// StartAutoSave checks the configured save points and AOF rewrite
+// thresholds once a second and starts a background save or AOF rewrite
+// when one of them is reached.
+func (s *MemoryStore) StartAutoSave() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for range ticker.C {
+			// Completion is logged by the background job itself.
+			if path, ok := s.savePointReached(); ok {
+				if err := s.BGSave(path); err != nil {
+					log.Println("[RDB] Failed to start background save:", err)
+				}
+			} else if s.aofRewriteDue() {
+				if err := s.BGRewriteAOF(); err != nil {
+					log.Println("[AOF] Failed to start AOF rewrite:", err)
+				}
+			}
+		}
+	}()
+}
+
+// savePointReached reports whether a save point calls for a background
+// save now, and the file to write.
+func (s *MemoryStore) savePointReached() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bgsave != nil {
+		return "", false
+	}
+	if !s.saveStats.lastBgsaveOK && time.Since(s.saveStats.lastBgsaveTry) < bgsaveRetryDelay {
+		return "", false
+	}
+	elapsed := int64(time.Since(s.saveStats.lastSave).Seconds())
+	for _, p := range s.config.Save {
+		if s.dirty >= p.Changes && elapsed >= p.Seconds {
+			log.Printf("[RDB] %d changes in %d seconds. Saving...", p.Changes, p.Seconds)
+			return s.config.DBFilename, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package store
+
+// Smallest replication backlog, like Redis' CONFIG_REPL_BACKLOG_MIN_SIZE.
+const minBacklogSize = 16 << 10
+
+// backlog keeps the most recent bytes of the replication stream in a
+// circular buffer, so a replica that lost its link can be sent what it
+// missed instead of a new snapshot. The byte at stream offset o is at
+// buf[o % len(buf)].
+type backlog struct {
+	buf   []byte
+	start int64 // stream offset of the oldest byte kept
+	end   int64 // stream offset after the newest byte
+}
+
+func newBacklog(size int64, offset int64) *backlog {
+	return &backlog{buf: make([]byte, max(size, minBacklogSize)), start: offset, end: offset}
+}
+
+// write appends the next bytes of the stream, dropping the oldest ones
+// once the buffer is full.
+func (b *backlog) write(data string) {
+	size := int64(len(b.buf))
+	if skip := int64(len(data)) - size; skip > 0 {
+		data = data[skip:]
+		b.end += skip
+	}
+	for len(data) > 0 {
+		pos := b.end % size
+		n := copy(b.buf[pos:], data)
+		data = data[n:]
+		b.end += int64(n)
+	}
+	b.start = max(b.start, b.end-size)
+}
+
+// from returns the bytes of the stream from offset on, or false if some
+// of them are no longer kept.
+func (b *backlog) from(offset int64) ([]byte, bool) {
+	if offset < b.start || offset > b.end {
+		return nil, false
+	}
+	size := int64(len(b.buf))
+	out := make([]byte, 0, b.end-offset)
+	for offset < b.end {
+		pos := offset % size
+		chunk := min(b.end-offset, size-pos)
+		out = append(out, b.buf[pos:pos+chunk]...)
+		offset += chunk
+	}
+	return out, true
+}
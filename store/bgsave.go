@@ -0,0 +1,176 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+var (
+	ErrBgsaveInProgress     = errors.New("Background save already in progress")
+	ErrAOFRewriteInProgress = errors.New("An AOF log rewriting in progress: can't BGSAVE right now")
+)
+
+// bgSave is a running background save or AOF rewrite; only one of them
+// runs at a time. data and expiration are shallow
+// copies of the keyspace taken when the save started, so the values are
+// shared with the live keyspace: writers must call ownValue before
+// modifying a value in place, which gives the live keyspace its own copy
+// and leaves the snapshot's untouched.
+type bgSave struct {
+	data       map[string]interface{}
+	expiration map[string]int64
+	owned      map[string]struct{}
+	started    time.Time
+	dirty      int64 // s.dirty when the save started
+	aofRewrite bool
+	coldRefs   []*persistance.ColdRef // disk copies to free once the save is done
+}
+
+// saveStats backs LASTSAVE and the persistence section of INFO.
+type saveStats struct {
+	lastSave       time.Time
+	lastBgsaveOK   bool
+	lastBgsaveTime time.Duration // -1 before the first background save
+	lastBgsaveTry  time.Time
+}
+
+// ownValue makes sure the value at key is not shared with a running
+// background save. Callers must hold s.mu.
+func (s *MemoryStore) ownValue(key string) {
+	if !s.sharedWithSave(key) {
+		return
+	}
+	s.bgsave.owned[key] = struct{}{}
+	if val, ok := s.data[key]; ok {
+		s.data[key] = cloneValue(val)
+	}
+}
+
+// sharedWithSave reports whether the value at key may still be read by a
+// running background save. Callers must hold s.mu.
+func (s *MemoryStore) sharedWithSave(key string) bool {
+	if s.bgsave == nil {
+		return false
+	}
+	if _, owned := s.bgsave.owned[key]; owned {
+		return false
+	}
+	_, ok := s.bgsave.data[key]
+	return ok
+}
+
+// BGSave starts writing a point-in-time snapshot to path in the
+// background. The store is only locked while the keyspace maps are
+// copied, not while the snapshot is serialized.
+func (s *MemoryStore) BGSave(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bgsave != nil {
+		if s.bgsave.aofRewrite {
+			return ErrAOFRewriteInProgress
+		}
+		return ErrBgsaveInProgress
+	}
+	save := s.startBackground(false)
+	s.saveStats.lastBgsaveTry = save.started
+
+	go s.runBGSave(path, s.config.RDBKeepSnapshots, s.rdbOptions(), save)
+	return nil
+}
+
+// startBackground copies the keyspace maps for a background save or AOF
+// rewrite. Callers must hold s.mu and check that none is running.
+func (s *MemoryStore) startBackground(aofRewrite bool) *bgSave {
+	save := &bgSave{
+		data:       make(map[string]interface{}, len(s.data)),
+		expiration: make(map[string]int64, len(s.expiration)),
+		owned:      make(map[string]struct{}),
+		started:    time.Now(),
+		dirty:      s.dirty,
+		aofRewrite: aofRewrite,
+	}
+	for key, val := range s.data {
+		save.data[key] = val
+	}
+	for key, expireAt := range s.expiration {
+		save.expiration[key] = expireAt
+	}
+	s.bgsave = save
+	return save
+}
+
+// rdbOptions returns how snapshots are written according to the config.
+// Callers must hold s.mu.
+func (s *MemoryStore) rdbOptions() persistance.RDBOptions {
+	return persistance.RDBOptions{
+		Compression:     s.config.RDBCompression,
+		FileCompression: s.config.RDBFileCompression,
+		Keyring:         s.keyring,
+	}
+}
+
+func (s *MemoryStore) runBGSave(path string, keep int, opts persistance.RDBOptions, save *bgSave) {
+	err := writeSnapshot(path, keep, opts, save.data, save.expiration)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finishBackground()
+	s.saveStats.lastBgsaveTime = time.Since(save.started)
+	s.saveStats.lastBgsaveOK = err == nil
+	if err != nil {
+		log.Println("[RDB] Background saving error:", err)
+		return
+	}
+	s.saveStats.lastSave = save.started
+	s.dirty -= save.dirty
+	log.Println("[RDB] Background saving terminated with success")
+}
+
+// BGSaveInProgress reports whether a background save is running.
+func (s *MemoryStore) BGSaveInProgress() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bgsave != nil && !s.bgsave.aofRewrite
+}
+
+// LastSave returns the time of the last successful save.
+func (s *MemoryStore) LastSave() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.saveStats.lastSave
+}
+
+// writeSnapshot streams data to path in the RDB format, keeping keep-1
+// older snapshots. Expiration times are in unix seconds, as in
+// MemoryStore.expiration.
+func writeSnapshot(path string, keep int, opts persistance.RDBOptions, data map[string]interface{}, expiration map[string]int64) error {
+	return persistance.WriteRDB(path, keep, opts, func(w *persistance.RDBWriter) error {
+		return writeEntries(w, data, expiration)
+	})
+}
+
+// writeEntries writes every key of data to w.
+func writeEntries(w *persistance.RDBWriter, data map[string]interface{}, expiration map[string]int64) error {
+	for key, val := range data {
+		obj, err := toObject(val)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+		entry := persistance.Entry{Key: key, Object: obj, Idle: -1, Freq: -1}
+		if expireAt, ok := expiration[key]; ok {
+			entry.ExpireAt = expireAt * 1000
+		}
+		if err := w.WriteEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"redis-clone/persistance"
+)
+
+// Config holds the runtime tunables of a MemoryStore. Every field is
+// exposed through CONFIG GET / CONFIG SET under its Redis name.
+type Config struct {
+	HashMaxListpackEntries   int
+	HashMaxListpackValue     int
+	SetMaxIntsetEntries      int
+	SetMaxListpackEntries    int
+	SetMaxListpackValue      int
+	LFULogFactor             int
+	LFUDecayTime             int
+	DBFilename               string
+	RDBKeepSnapshots         int
+	RDBCompression           bool
+	RDBFileCompression       string
+	Save                     []SavePoint
+	StopWritesOnBgsaveError  bool
+	AppendFsync              string
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
+	AOFUseRDBPreamble        bool
+	AOFLoadTruncated         bool
+	AOFTimestampEnabled      bool
+	EncryptionKeyFile        string
+	TieredStorageMaxMemory   int64
+	TieredStoragePolicy      string
+	TieredStorageDir         string
+	ReplicaReadOnly          bool
+	ReplBacklogSize          int64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		HashMaxListpackEntries:   128,
+		HashMaxListpackValue:     64,
+		SetMaxIntsetEntries:      512,
+		SetMaxListpackEntries:    128,
+		SetMaxListpackValue:      64,
+		LFULogFactor:             10,
+		LFUDecayTime:             1,
+		DBFilename:               "dump.rdb",
+		RDBKeepSnapshots:         2,
+		RDBCompression:           true,
+		RDBFileCompression:       persistance.RDBFileNone,
+		Save:                     []SavePoint{{3600, 1}, {300, 100}, {60, 10000}},
+		StopWritesOnBgsaveError:  true,
+		AppendFsync:              persistance.FsyncEverySec,
+		AutoAOFRewritePercentage: 100,
+		AutoAOFRewriteMinSize:    64 << 20,
+		AOFUseRDBPreamble:        true,
+		AOFLoadTruncated:         true,
+		TieredStoragePolicy:      "lru",
+		TieredStorageDir:         "tierdir",
+		ReplicaReadOnly:          true,
+		ReplBacklogSize:          1 << 20,
+	}
+}
+
+// configParam describes a single CONFIG parameter. An immutable one can
+// only be set at startup, through InitConfig.
+type configParam struct {
+	get       func(c *Config) string
+	set       func(c *Config, value string) error
+	immutable bool
+}
+
+// immutable marks p as settable only at startup, for parameters naming
+// files outside the working directory that clients must not redirect.
+func immutable(p configParam) configParam {
+	p.immutable = true
+	return p
+}
+
+func intParam(field func(c *Config) *int, min int) configParam {
+	return configParam{
+		get: func(c *Config) string {
+			return strconv.Itoa(*field(c))
+		},
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < min {
+				return fmt.Errorf("argument must be an integer >= %d", min)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func stringParam(field func(c *Config) *string) configParam {
+	return configParam{
+		get: func(c *Config) string {
+			return *field(c)
+		},
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+// filenameParam accepts a bare file name, which is resolved against the
+// working directory, like Redis does for dbfilename.
+func filenameParam(field func(c *Config) *string, name string) configParam {
+	p := stringParam(field)
+	p.set = func(c *Config, value string) error {
+		if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+			return fmt.Errorf("%s can't be a path, just a filename", name)
+		}
+		*field(c) = value
+		return nil
+	}
+	return p
+}
+
+func boolParam(field func(c *Config) *bool) configParam {
+	return configParam{
+		get: func(c *Config) string {
+			if *field(c) {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(c *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				*field(c) = true
+			case "no":
+				*field(c) = false
+			default:
+				return fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+func enumParam(field func(c *Config) *string, values ...string) configParam {
+	return configParam{
+		get: func(c *Config) string {
+			return *field(c)
+		},
+		set: func(c *Config, value string) error {
+			for _, v := range values {
+				if strings.EqualFold(value, v) {
+					*field(c) = v
+					return nil
+				}
+			}
+			return fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(values, ", "))
+		},
+	}
+}
+
+// memoryParam accepts byte counts with the k, kb, m, mb, g and gb units
+// of redis.conf.
+func memoryParam(field func(c *Config) *int64) configParam {
+	return configParam{
+		get: func(c *Config) string {
+			return strconv.FormatInt(*field(c), 10)
+		},
+		set: func(c *Config, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+	lower, mul := strings.ToLower(value), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = strings.TrimSuffix(lower, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+var configParams = map[string]configParam{
+	"hash-max-listpack-entries":   intParam(func(c *Config) *int { return &c.HashMaxListpackEntries }, 0),
+	"hash-max-listpack-value":     intParam(func(c *Config) *int { return &c.HashMaxListpackValue }, 0),
+	"set-max-intset-entries":      intParam(func(c *Config) *int { return &c.SetMaxIntsetEntries }, 0),
+	"set-max-listpack-entries":    intParam(func(c *Config) *int { return &c.SetMaxListpackEntries }, 0),
+	"set-max-listpack-value":      intParam(func(c *Config) *int { return &c.SetMaxListpackValue }, 0),
+	"lfu-log-factor":              intParam(func(c *Config) *int { return &c.LFULogFactor }, 0),
+	"lfu-decay-time":              intParam(func(c *Config) *int { return &c.LFUDecayTime }, 0),
+	"dbfilename":                  filenameParam(func(c *Config) *string { return &c.DBFilename }, "dbfilename"),
+	"rdb-keep-snapshots":          intParam(func(c *Config) *int { return &c.RDBKeepSnapshots }, 1),
+	"rdbcompression":              boolParam(func(c *Config) *bool { return &c.RDBCompression }),
+	"stop-writes-on-bgsave-error": boolParam(func(c *Config) *bool { return &c.StopWritesOnBgsaveError }),
+	"appendfsync": enumParam(func(c *Config) *string { return &c.AppendFsync },
+		persistance.FsyncAlways, persistance.FsyncEverySec, persistance.FsyncNo),
+	"rdb-file-compression": enumParam(func(c *Config) *string { return &c.RDBFileCompression },
+		persistance.RDBFileNone, persistance.RDBFileGzip),
+	"tiered-storage-policy": enumParam(func(c *Config) *string { return &c.TieredStoragePolicy },
+		"lru", "lfu"),
+	"auto-aof-rewrite-percentage": intParam(func(c *Config) *int { return &c.AutoAOFRewritePercentage }, 0),
+	"auto-aof-rewrite-min-size":   memoryParam(func(c *Config) *int64 { return &c.AutoAOFRewriteMinSize }),
+	"aof-use-rdb-preamble":        boolParam(func(c *Config) *bool { return &c.AOFUseRDBPreamble }),
+	"aof-load-truncated":          boolParam(func(c *Config) *bool { return &c.AOFLoadTruncated }),
+	"aof-timestamp-enabled":       boolParam(func(c *Config) *bool { return &c.AOFTimestampEnabled }),
+	"encryption-key-file":         immutable(stringParam(func(c *Config) *string { return &c.EncryptionKeyFile })),
+	"tiered-storage-max-memory":   memoryParam(func(c *Config) *int64 { return &c.TieredStorageMaxMemory }),
+	"tiered-storage-dir":          immutable(stringParam(func(c *Config) *string { return &c.TieredStorageDir })),
+	"replica-read-only":           boolParam(func(c *Config) *bool { return &c.ReplicaReadOnly }),
+	"repl-backlog-size":           memoryParam(func(c *Config) *int64 { return &c.ReplBacklogSize }),
+	"save": {
+		get: func(c *Config) string {
+			return formatSavePoints(c.Save)
+		},
+		set: func(c *Config, value string) error {
+			points, err := ParseSavePoints(value)
+			if err != nil {
+				return err
+			}
+			c.Save = points
+			return nil
+		},
+	},
+}
+
+// ConfigGet returns name/value pairs for every parameter matching pattern.
+func (s *MemoryStore) ConfigGet(pattern string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0)
+	for name := range configParams {
+		if MatchPatternNoCase(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]string, 0, len(names)*2)
+	for _, name := range names {
+		result = append(result, name, configParams[name].get(&s.config))
+	}
+	return result
+}
+
+// ConfigSet changes a parameter at runtime, as CONFIG SET does.
+func (s *MemoryStore) ConfigSet(name, value string) error {
+	return s.configSet(name, value, false)
+}
+
+// InitConfig sets a parameter at startup, before clients are served.
+// Unlike ConfigSet it also accepts immutable parameters.
+func (s *MemoryStore) InitConfig(name, value string) error {
+	return s.configSet(name, value, true)
+}
+
+func (s *MemoryStore) configSet(name, value string, startup bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	if param.immutable && !startup {
+		return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", strings.ToLower(name))
+	}
+	old, oldKeyring := s.config, s.keyring
+	if err := param.set(&s.config, value); err != nil {
+		return err
+	}
+	if strings.EqualFold(name, "encryption-key-file") {
+		if err := s.reloadKeyring(); err != nil {
+			s.config = old
+			return err
+		}
+	}
+	return s.applyConfig(old, oldKeyring)
+}
+
+// applyConfig pushes s.config to the AOF, the cold store and the
+// replication backlog. If the AOF can't take it, the configuration and
+// keyring go back to old and oldKeyring. Callers must hold s.mu.
+func (s *MemoryStore) applyConfig(old Config, oldKeyring *persistance.Keyring) error {
+	if err := s.applyAOFConfig(); err != nil {
+		s.config, s.keyring = old, oldKeyring
+		// The AOF is still written with the old keyring, so taking it
+		// back can't fail.
+		s.applyAOFConfig()
+		return err
+	}
+	s.applyTieringConfig()
+	s.repl.mu.Lock()
+	s.repl.setBacklogSize(s.config.ReplBacklogSize)
+	s.repl.mu.Unlock()
+	return nil
+}
+
+// applyAOFConfig pushes the AOF related parameters to s.aof. Callers must
+// hold s.mu.
+func (s *MemoryStore) applyAOFConfig() error {
+	if s.aof == nil {
+		return nil
+	}
+	s.aof.SetFsyncPolicy(s.config.AppendFsync)
+	s.aof.SetTimestamps(s.config.AOFTimestampEnabled)
+	return s.aof.SetKeyring(s.keyring)
+}
+
+// reloadKeyring reads the keys of encryption-key-file, which encrypt
+// snapshots and AOF files written from now on. Callers must hold s.mu.
+func (s *MemoryStore) reloadKeyring() error {
+	if s.config.EncryptionKeyFile == "" {
+		s.keyring = nil
+		return nil
+	}
+	keyring, err := persistance.LoadKeyring(s.config.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	s.keyring = keyring
+	return nil
+}
+
+// DBFilename returns the configured snapshot file.
+func (s *MemoryStore) DBFilename() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config.DBFilename
+}
+
+// SetConfig replaces the whole configuration, typically at startup. If
+// the new configuration can't be applied the old one is kept.
+func (s *MemoryStore) SetConfig(config Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, oldKeyring := s.config, s.keyring
+	s.config = config
+	if err := s.reloadKeyring(); err != nil {
+		s.config = old
+		return err
+	}
+	return s.applyConfig(old, oldKeyring)
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"redis-clone/persistance"
+)
+
+// TestConfigKeptWhenAOFFails turns on encryption while the AOF can't
+// start the new, encrypted file it needs; the old configuration must
+// stay in place.
+func TestConfigKeptWhenAOFFails(t *testing.T) {
+	dir := t.TempDir()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	a, err := persistance.OpenAOF(aofDir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	s := NewMemoryStoreWithAOF(nil)
+	if err := s.SetAOF(a); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("k", "v")
+	if err := s.FlushAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "keys")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(aofDir); err != nil {
+		t.Fatal(err)
+	}
+	old := s.config
+
+	if err := s.InitConfig("encryption-key-file", keyFile); err == nil {
+		t.Fatal("InitConfig(encryption-key-file) succeeded without an AOF directory")
+	}
+	if !reflect.DeepEqual(s.config, old) || s.keyring != nil {
+		t.Errorf("config after a failed InitConfig = %+v with keyring %v, want it unchanged", s.config, s.keyring)
+	}
+
+	config := old
+	config.EncryptionKeyFile = keyFile
+	config.AppendFsync = "always"
+	config.ReplBacklogSize = 2 << 20
+	if err := s.SetConfig(config); err == nil {
+		t.Fatal("SetConfig with an encryption key succeeded without an AOF directory")
+	}
+	if !reflect.DeepEqual(s.config, old) || s.keyring != nil {
+		t.Errorf("config after a failed SetConfig = %+v with keyring %v, want it unchanged", s.config, s.keyring)
+	}
+	if s.repl.backlogSize != old.ReplBacklogSize {
+		t.Errorf("backlog size after a failed SetConfig = %d, want %d", s.repl.backlogSize, old.ReplBacklogSize)
+	}
+}
@@ -0,0 +1,409 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+var ErrBusyKey = errors.New("BUSYKEY Target key name already exists.")
+
+var errUnsupportedType = errors.New("unsupported type")
+
+// RestoreOptions are the optional arguments of RESTORE. IdleTime and Freq
+// are ignored when negative.
+type RestoreOptions struct {
+	Replace  bool
+	AbsTTL   bool
+	IdleTime int64
+	Freq     int
+}
+
+// toObject converts a stored value to its serializable form, reading it
+// back from disk if it was moved there.
+func toObject(val interface{}) (persistance.Object, error) {
+	switch v := val.(type) {
+	case string, int64:
+		str, _ := stringValue(v)
+		return persistance.Object{Type: persistance.TypeString, Value: str}, nil
+	case []string:
+		return persistance.Object{Type: persistance.TypeList, Items: v}, nil
+	case setObject:
+		items := make([]string, 0, v.size())
+		v.forEach(func(member string) {
+			items = append(items, member)
+		})
+		return persistance.Object{Type: persistance.TypeSet, Items: items}, nil
+	case hashObject:
+		items := make([]string, 0, v.size()*2)
+		v.forEach(func(field, value string) {
+			items = append(items, field, value)
+		})
+		return persistance.Object{Type: persistance.TypeHash, Items: items}, nil
+	case *coldValue:
+		return v.object()
+	}
+	return persistance.Object{}, errUnsupportedType
+}
+
+// fromObject builds a stored value from its serialized form, choosing the
+// encoding the same way writes do.
+func (s *MemoryStore) fromObject(obj persistance.Object) (interface{}, error) {
+	switch obj.Type {
+	case persistance.TypeString:
+		return encodeString(obj.Value), nil
+	case persistance.TypeList:
+		return append([]string(nil), obj.Items...), nil
+	case persistance.TypeSet:
+		var set setObject = &intset{}
+		for _, m := range obj.Items {
+			set = s.setForInsert(set, m)
+			set.insert(m)
+		}
+		return set, nil
+	case persistance.TypeHash:
+		var hash hashObject = &hashListpack{}
+		for i := 0; i+1 < len(obj.Items); i += 2 {
+			hash.set(obj.Items[i], obj.Items[i+1])
+			hash = s.convertHash(hash)
+		}
+		return hash, nil
+	}
+	return nil, errors.New("bad data format")
+}
+
+// loadEntries replaces the keyspace with the given snapshot entries.
+// Keys of other databases and of types the store lacks are skipped with
+// a warning, and expired keys are dropped. Callers must hold s.mu.
+func (s *MemoryStore) loadEntries(entries []persistance.Entry) error {
+	values := make(map[string]interface{}, len(entries))
+	expiration := make(map[string]int64)
+	skippedDB, skippedType := 0, 0
+	now := time.Now().UnixMilli()
+
+	for _, e := range entries {
+		if e.DB != 0 {
+			skippedDB++
+			continue
+		}
+		if e.ExpireAt != 0 && e.ExpireAt <= now {
+			continue
+		}
+		if e.Object.Type == persistance.TypeZSet {
+			skippedType++
+			continue
+		}
+		val, err := s.fromObject(e.Object)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", e.Key, err)
+		}
+		values[e.Key] = val
+		if e.ExpireAt != 0 {
+			expiration[e.Key] = (e.ExpireAt + 999) / 1000
+		}
+	}
+	if skippedDB > 0 {
+		log.Printf("[RDB] Skipped %d keys outside DB 0", skippedDB)
+	}
+	if skippedType > 0 {
+		log.Printf("[RDB] Skipped %d sorted set keys, which are not supported", skippedType)
+	}
+
+	s.signalFlush()
+	s.releaseAllCold()
+	s.data = make(map[string]interface{}, len(values))
+	s.keys = newKeyIndex()
+	s.expiration = expiration
+	s.access = make(map[string]*accessInfo)
+	for key, val := range values {
+		s.setValue(key, val)
+	}
+	for _, e := range entries {
+		if _, ok := values[e.Key]; !ok || e.DB != 0 {
+			continue
+		}
+		if e.Idle >= 0 {
+			s.touch(e.Key)
+			s.access[e.Key].lastAccess = now - e.Idle*1000
+		}
+		if e.Freq >= 0 {
+			s.touch(e.Key)
+			s.access[e.Key].freq = uint8(e.Freq)
+		}
+	}
+	s.dirty = 0
+	return nil
+}
+
+// Dump returns the serialized value of key in the DUMP format.
+func (s *MemoryStore) Dump(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.data[key]
+	if !ok {
+		return nil, false, nil
+	}
+	obj, err := toObject(val)
+	if errors.Is(err, errUnsupportedType) {
+		return nil, true, errWrongType
+	}
+	if err != nil {
+		return nil, true, &ColdReadError{Key: key, Err: err}
+	}
+	payload, err := persistance.DumpPayload(obj)
+	return payload, true, err
+}
+
+// Restore creates key from a DUMP payload. ttl is in milliseconds, relative
+// unless opts.AbsTTL is set, and 0 means no expiry.
+func (s *MemoryStore) Restore(key string, ttl int64, payload []byte, opts RestoreOptions) error {
+	obj, err := persistance.ParseDumpPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.data[key]
+	if exists && !opts.Replace {
+		return ErrBusyKey
+	}
+	val, err := s.fromObject(obj)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expireAt := int64(0)
+	if ttl > 0 {
+		expireAt = ttl
+		if !opts.AbsTTL {
+			expireAt += now.UnixMilli()
+		}
+	}
+
+	s.removeKey(key)
+	if expireAt != 0 && expireAt <= now.UnixMilli() {
+		// Already expired: the key just disappears, along with whatever
+		// REPLACE overwrote.
+		if exists && s.aof != nil {
+			s.aof.AppendCommand("DEL", key)
+		}
+		return nil
+	}
+	s.setValue(key, val)
+	if expireAt != 0 {
+		s.expiration[key] = (expireAt + 999) / 1000
+	}
+	s.touch(key)
+	if opts.IdleTime >= 0 {
+		s.access[key].lastAccess = now.UnixMilli() - opts.IdleTime*1000
+	}
+	if opts.Freq >= 0 {
+		s.access[key].freq = uint8(opts.Freq)
+	}
+
+	if s.aof != nil {
+		s.aof.AppendCommand("RESTORE", key, strconv.FormatInt(expireAt, 10), string(payload), "REPLACE", "ABSTTL")
+	}
+
+	return nil
+}
+
+// ParseRestoreArgs parses the options following RESTORE key ttl payload.
+func ParseRestoreArgs(args []string) (RestoreOptions, error) {
+	opts := RestoreOptions{IdleTime: -1, Freq: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			opts.Replace = true
+		case "ABSTTL":
+			opts.AbsTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n < 0 {
+				return opts, errors.New("Invalid IDLETIME value, must be >= 0")
+			}
+			opts.IdleTime = n
+			i++
+		case "FREQ":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || n > 255 {
+				return opts, errors.New("Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			opts.Freq = n
+			i++
+		default:
+			return opts, errors.New("syntax error")
+		}
+	}
+	if opts.IdleTime >= 0 && opts.Freq >= 0 {
+		return opts, errors.New("syntax error")
+	}
+	return opts, nil
+}
+
+// MigrateItem is a key serialized for MIGRATE. TTL is the remaining time
+// to live in milliseconds, 0 if the key does not expire.
+type MigrateItem struct {
+	Key     string
+	TTL     int64
+	Payload []byte
+}
+
+// Migrate serializes the existing keys among keys and passes them to
+// send, which returns which of them the target acknowledged. The store
+// lock is only held while serializing and while deleting, not during
+// send, so a slow target does not stall other clients. Unless keep is
+// set, the acknowledged keys are then deleted; one written in the
+// meantime is kept and reported as an error, since the target holds an
+// older version of it. It returns how many keys were sent.
+func (s *MemoryStore) Migrate(keys []string, keep bool, send func(items []MigrateItem) ([]bool, error)) (int, error) {
+	s.mu.Lock()
+	items, err := s.migrateItems(keys)
+	var watch *keyWatch
+	if err == nil && !keep {
+		watched := make([]string, len(items))
+		for i, item := range items {
+			watched[i] = item.Key
+		}
+		watch = s.watchKeys(watched)
+	}
+	s.mu.Unlock()
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+
+	acked, sendErr := send(items)
+
+	if !keep {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.unwatch(watch)
+		var changed []string
+		for i, item := range items {
+			if i >= len(acked) || !acked[i] {
+				continue
+			}
+			if watch.changed[item.Key] {
+				changed = append(changed, item.Key)
+				continue
+			}
+			s.removeKey(item.Key)
+			if s.aof != nil {
+				s.aof.AppendCommand("DEL", item.Key)
+			}
+		}
+		if sendErr == nil && len(changed) > 0 {
+			return 0, fmt.Errorf("ERR keys written during MIGRATE were kept on the source: %s", strings.Join(changed, ", "))
+		}
+	}
+	if sendErr != nil {
+		return 0, sendErr
+	}
+	return len(items), nil
+}
+
+// migrateItems serializes the existing keys among keys. Callers must hold
+// s.mu.
+func (s *MemoryStore) migrateItems(keys []string) ([]MigrateItem, error) {
+	now := time.Now().UnixMilli()
+	items := make([]MigrateItem, 0, len(keys))
+	for _, key := range keys {
+		val, ok := s.data[key]
+		if !ok || s.isExpired(key) {
+			continue
+		}
+		obj, err := toObject(val)
+		if errors.Is(err, errUnsupportedType) {
+			return nil, errWrongType
+		}
+		if err != nil {
+			return nil, &ColdReadError{Key: key, Err: err}
+		}
+		payload, err := persistance.DumpPayload(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		ttl := int64(0)
+		if expireAt, hasTTL := s.expiration[key]; hasTTL {
+			ttl = expireAt*1000 - now
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		items = append(items, MigrateItem{Key: key, TTL: ttl, Payload: payload})
+	}
+	return items, nil
+}
+
+// keyWatch records which of a set of keys were written since it was
+// created, like the keys of a Redis WATCH.
+type keyWatch struct {
+	keys    []string
+	changed map[string]bool
+}
+
+// watchKeys starts recording writes to keys. Callers must hold s.mu and
+// call unwatch once done.
+func (s *MemoryStore) watchKeys(keys []string) *keyWatch {
+	w := &keyWatch{keys: keys, changed: make(map[string]bool)}
+	if s.watches == nil {
+		s.watches = make(map[string][]*keyWatch)
+	}
+	for _, key := range keys {
+		s.watches[key] = append(s.watches[key], w)
+	}
+	return w
+}
+
+// unwatch stops recording writes for w. Callers must hold s.mu.
+func (s *MemoryStore) unwatch(w *keyWatch) {
+	for _, key := range w.keys {
+		watches := s.watches[key]
+		for i := range watches {
+			if watches[i] == w {
+				watches = append(watches[:i], watches[i+1:]...)
+				break
+			}
+		}
+		if len(watches) == 0 {
+			delete(s.watches, key)
+		} else {
+			s.watches[key] = watches
+		}
+	}
+}
+
+// signalModifiedKey marks key as written for the watches on it. Every
+// write to a key reaches it through setValue, removeKey or a change of
+// its expiration. Callers must hold s.mu.
+func (s *MemoryStore) signalModifiedKey(key string) {
+	for _, w := range s.watches[key] {
+		w.changed[key] = true
+	}
+}
+
+// signalFlush marks every watched key as written, for when the keyspace
+// is replaced as a whole. Callers must hold s.mu.
+func (s *MemoryStore) signalFlush() {
+	for key, watches := range s.watches {
+		for _, w := range watches {
+			w.changed[key] = true
+		}
+	}
+}
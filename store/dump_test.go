@@ -0,0 +1,251 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+// contents describes the value of key independently of its encoding, with
+// the elements of sets and hashes sorted.
+func contents(t *testing.T, s *MemoryStore, key string) string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, err := s.value(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val == nil {
+		return "(none)"
+	}
+	obj, err := toObject(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := append([]string(nil), obj.Items...)
+	switch obj.Type {
+	case persistance.TypeSet:
+		sort.Strings(items)
+	case persistance.TypeHash:
+		pairs := make([]string, 0, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			pairs = append(pairs, items[i]+"="+items[i+1])
+		}
+		sort.Strings(pairs)
+		items = pairs
+	}
+	return fmt.Sprintf("%d %q %v", obj.Type, obj.Value, items)
+}
+
+func encoding(t *testing.T, s *MemoryStore, key string) string {
+	t.Helper()
+	enc, ok, err := s.ObjectEncoding(key)
+	if err != nil || !ok {
+		t.Fatalf("ObjectEncoding(%s) = %q, %v, %v", key, enc, ok, err)
+	}
+	return enc
+}
+
+func numbered(prefix string, n int) []string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = prefix + strconv.Itoa(i)
+	}
+	return items
+}
+
+func pairs(n int) []string {
+	items := make([]string, 0, 2*n)
+	for i := 0; i < n; i++ {
+		items = append(items, "f"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	return items
+}
+
+func TestDumpRestoreEncodings(t *testing.T) {
+	tests := []struct {
+		encoding string
+		cmd      []string
+	}{
+		{encodingInt, []string{"SET", "k", "-12345"}},
+		{encodingEmbstr, []string{"SET", "k", "hello"}},
+		{encodingRaw, []string{"SET", "k", strings.Repeat("x", 100)}},
+		{encodingQuicklist, append([]string{"RPUSH", "k"}, numbered("e", 300)...)},
+		{encodingIntset, []string{"SADD", "k", "3", "-1", "200000", "7"}},
+		{encodingListpack, []string{"SADD", "k", "a", "b", "1"}},
+		{encodingHashtable, append([]string{"SADD", "k"}, numbered("m", 300)...)},
+		{encodingListpack, []string{"HSET", "k", "f1", "v1", "f2", "2"}},
+		{encodingHashtable, append([]string{"HSET", "k"}, pairs(300)...)},
+		{encodingHashtable, []string{"HSET", "k", "f", strings.Repeat("v", 100)}},
+	}
+	for _, tc := range tests {
+		src := NewMemoryStoreWithAOF(nil)
+		run(t, src, tc.cmd[0], tc.cmd[1:]...)
+		if got := encoding(t, src, "k"); got != tc.encoding {
+			t.Fatalf("%s ... has encoding %s, want %s", tc.cmd[0], got, tc.encoding)
+		}
+		payload, ok, err := src.Dump("k")
+		if err != nil || !ok {
+			t.Fatalf("Dump after %s = %v, %v", tc.cmd[0], ok, err)
+		}
+
+		dst := NewMemoryStoreWithAOF(nil)
+		if err := dst.Restore("k", 0, payload, RestoreOptions{IdleTime: -1, Freq: -1}); err != nil {
+			t.Fatalf("Restore of a %s %s: %v", tc.encoding, tc.cmd[0], err)
+		}
+		if got, want := contents(t, dst, "k"), contents(t, src, "k"); got != want {
+			t.Errorf("restored %s %s = %.100s, want %.100s", tc.encoding, tc.cmd[0], got, want)
+		}
+		if got := encoding(t, dst, "k"); got != tc.encoding {
+			t.Errorf("restored %s %s has encoding %s", tc.encoding, tc.cmd[0], got)
+		}
+	}
+}
+
+func TestRestoreTTL(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.Set("k", "v")
+	payload, _, err := s.Dump("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, s, "RESTORE", "rel", "100000", string(payload))
+	if ttl := s.TTL("rel"); ttl < 99 || ttl > 101 {
+		t.Errorf("TTL after RESTORE with 100000ms = %d, want about 100", ttl)
+	}
+	at := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	run(t, s, "RESTORE", "abs", at, string(payload), "ABSTTL")
+	if ttl := s.TTL("abs"); ttl < 3599 || ttl > 3601 {
+		t.Errorf("TTL after RESTORE ABSTTL an hour ahead = %d, want about 3600", ttl)
+	}
+	run(t, s, "RESTORE", "none", "0", string(payload))
+	if ttl := s.TTL("none"); ttl != -1 {
+		t.Errorf("TTL after RESTORE with 0 = %d, want -1", ttl)
+	}
+}
+
+func TestRestoreRejectsBadPayloads(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "RPUSH", "k", "a", "b")
+	payload, _, err := s.Dump("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reseal recomputes the checksum over a changed payload.
+	reseal := func(p []byte) []byte {
+		binary.LittleEndian.PutUint64(p[len(p)-8:], persistance.CRC64(0, p[:len(p)-8]))
+		return p
+	}
+	flipped := append([]byte(nil), payload...)
+	flipped[1] ^= 0xff
+	newer := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint16(newer[len(newer)-10:], persistance.MaxRDBVersion+1)
+
+	for name, bad := range map[string][]byte{
+		"a flipped byte":         flipped,
+		"a wrong checksum":       append(append([]byte(nil), payload[:len(payload)-1]...), payload[len(payload)-1]^1),
+		"a newer version":        reseal(newer),
+		"a truncated footer":     payload[:len(payload)-3],
+		"nothing but the footer": reseal(append([]byte(nil), payload[len(payload)-10:]...)),
+	} {
+		err := s.Restore("new", 0, bad, RestoreOptions{IdleTime: -1, Freq: -1})
+		if err == nil {
+			t.Errorf("Restore of a payload with %s succeeded", name)
+		}
+	}
+	reply := s.ExecuteRaw("RESTORE", []string{"new", "0", string(flipped)})
+	if reply != "-ERR DUMP payload version or checksum are wrong\r\n" {
+		t.Errorf("RESTORE of a corrupt payload = %q", reply)
+	}
+	if reply := run(t, s, "EXISTS", "new"); reply != ":0\r\n" {
+		t.Errorf("EXISTS after rejected payloads = %q, want :0", reply)
+	}
+}
+
+func TestRestoreBusyKey(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.Set("src", "new")
+	s.Set("k", "old")
+	payload, _, err := s.Dump("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Restore("k", 0, payload, RestoreOptions{IdleTime: -1, Freq: -1})
+	if !errors.Is(err, ErrBusyKey) {
+		t.Fatalf("Restore onto an existing key = %v, want ErrBusyKey", err)
+	}
+	if reply := s.ExecuteRaw("RESTORE", []string{"k", "0", string(payload)}); !strings.HasPrefix(reply, "-BUSYKEY ") {
+		t.Errorf("RESTORE onto an existing key = %q, want a BUSYKEY error", reply)
+	}
+	if got, _, _ := s.Get("k"); got != "old" {
+		t.Errorf("GET k after BUSYKEY = %q, want old", got)
+	}
+
+	run(t, s, "RESTORE", "k", "0", string(payload), "REPLACE")
+	if got, _, _ := s.Get("k"); got != "new" {
+		t.Errorf("GET k after RESTORE REPLACE = %q, want new", got)
+	}
+}
+
+// aofCommands replays the AOF in dir and returns its commands.
+func aofCommands(t *testing.T, dir string) []string {
+	t.Helper()
+	a, err := persistance.OpenAOF(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var cmds []string
+	err = a.Replay(false, nil, func(persistance.Snapshot) error { return nil }, func(cmd string, args []string) error {
+		cmds = append(cmds, strings.Join(append([]string{cmd}, args[:min(len(args), 1)]...), " "))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmds
+}
+
+// TestRestoreExpiredReplace restores an already expired value over an
+// existing key, which deletes it; the AOF must say so too.
+func TestRestoreExpiredReplace(t *testing.T) {
+	dir := t.TempDir()
+	a, err := persistance.OpenAOF(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemoryStoreWithAOF(nil)
+	if err := s.SetAOF(a); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("k", "old")
+	payload, _, err := s.Dump("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, s, "RESTORE", "k", "1", string(payload), "REPLACE", "ABSTTL")
+	run(t, s, "RESTORE", "missing", "1", string(payload), "REPLACE", "ABSTTL")
+	if reply := run(t, s, "EXISTS", "k", "missing"); reply != ":0\r\n" {
+		t.Errorf("EXISTS after restoring expired values = %q, want :0", reply)
+	}
+	if err := s.FlushAOF(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(aofCommands(t, dir), ", "), "SET k, DEL k"; got != want {
+		t.Errorf("AOF holds %s, want %s", got, want)
+	}
+}
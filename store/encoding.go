@@ -0,0 +1,394 @@
+package store
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Encodings reported by OBJECT ENCODING.
+const (
+	encodingInt       = "int"
+	encodingEmbstr    = "embstr"
+	encodingRaw       = "raw"
+	encodingListpack  = "listpack"
+	encodingQuicklist = "quicklist"
+	encodingIntset    = "intset"
+	encodingHashtable = "hashtable"
+)
+
+// Strings up to this length are reported as embstr, like Redis does.
+const embstrSizeLimit = 44
+
+// parseInt reports whether s is the canonical decimal form of an int64,
+// i.e. it can be stored as an integer and formatted back unchanged.
+func parseInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// encodeString picks the int encoding for integer-looking strings.
+func encodeString(val string) interface{} {
+	if n, ok := parseInt(val); ok {
+		return n
+	}
+	return val
+}
+
+// stringValue returns the string form of a string-typed value.
+func stringValue(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	}
+	return "", false
+}
+
+// hashObject is implemented by every hash encoding.
+type hashObject interface {
+	get(field string) (string, bool)
+	set(field, value string) bool
+	del(field string) bool
+	size() int
+	forEach(fn func(field, value string))
+}
+
+// hashTable is the default, map based hash encoding. Fields are also kept
+// in a keyIndex so HSCAN can walk large hashes incrementally.
+type hashTable struct {
+	entries map[string]string
+	index   *keyIndex
+}
+
+func newHashTable() *hashTable {
+	return &hashTable{
+		entries: make(map[string]string),
+		index:   newKeyIndex(),
+	}
+}
+
+func (h *hashTable) get(field string) (string, bool) {
+	v, ok := h.entries[field]
+	return v, ok
+}
+
+func (h *hashTable) set(field, value string) bool {
+	_, exists := h.entries[field]
+	h.entries[field] = value
+	if !exists {
+		h.index.add(field)
+	}
+	return !exists
+}
+
+func (h *hashTable) del(field string) bool {
+	_, exists := h.entries[field]
+	if exists {
+		delete(h.entries, field)
+		h.index.remove(field)
+	}
+	return exists
+}
+
+func (h *hashTable) size() int {
+	return len(h.entries)
+}
+
+func (h *hashTable) forEach(fn func(field, value string)) {
+	for f, v := range h.entries {
+		fn(f, v)
+	}
+}
+
+// hashListpack is the compact encoding for small hashes: fields and
+// values are stored alternately in a single slice.
+type hashListpack []string
+
+func (h *hashListpack) index(field string) int {
+	for i := 0; i < len(*h); i += 2 {
+		if (*h)[i] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *hashListpack) get(field string) (string, bool) {
+	i := h.index(field)
+	if i < 0 {
+		return "", false
+	}
+	return (*h)[i+1], true
+}
+
+func (h *hashListpack) set(field, value string) bool {
+	if i := h.index(field); i >= 0 {
+		(*h)[i+1] = value
+		return false
+	}
+	*h = append(*h, field, value)
+	return true
+}
+
+func (h *hashListpack) del(field string) bool {
+	i := h.index(field)
+	if i < 0 {
+		return false
+	}
+	*h = append((*h)[:i], (*h)[i+2:]...)
+	return true
+}
+
+func (h *hashListpack) size() int {
+	return len(*h) / 2
+}
+
+func (h *hashListpack) forEach(fn func(field, value string)) {
+	for i := 0; i < len(*h); i += 2 {
+		fn((*h)[i], (*h)[i+1])
+	}
+}
+
+// setObject is implemented by every set encoding.
+type setObject interface {
+	contains(member string) bool
+	insert(member string) bool
+	remove(member string) bool
+	size() int
+	forEach(fn func(member string))
+}
+
+// setTable is the default, map based set encoding. Members are also kept
+// in a keyIndex so SSCAN can walk large sets incrementally.
+type setTable struct {
+	members map[string]struct{}
+	index   *keyIndex
+}
+
+func newSetTable() *setTable {
+	return &setTable{
+		members: make(map[string]struct{}),
+		index:   newKeyIndex(),
+	}
+}
+
+func (st *setTable) contains(member string) bool {
+	_, ok := st.members[member]
+	return ok
+}
+
+func (st *setTable) insert(member string) bool {
+	if _, ok := st.members[member]; ok {
+		return false
+	}
+	st.members[member] = struct{}{}
+	st.index.add(member)
+	return true
+}
+
+func (st *setTable) remove(member string) bool {
+	if _, ok := st.members[member]; !ok {
+		return false
+	}
+	delete(st.members, member)
+	st.index.remove(member)
+	return true
+}
+
+func (st *setTable) size() int {
+	return len(st.members)
+}
+
+func (st *setTable) forEach(fn func(member string)) {
+	for m := range st.members {
+		fn(m)
+	}
+}
+
+// setListpack is the compact encoding for small sets of short strings.
+type setListpack []string
+
+func (sl *setListpack) index(member string) int {
+	for i, m := range *sl {
+		if m == member {
+			return i
+		}
+	}
+	return -1
+}
+
+func (sl *setListpack) contains(member string) bool {
+	return sl.index(member) >= 0
+}
+
+func (sl *setListpack) insert(member string) bool {
+	if sl.contains(member) {
+		return false
+	}
+	*sl = append(*sl, member)
+	return true
+}
+
+func (sl *setListpack) remove(member string) bool {
+	i := sl.index(member)
+	if i < 0 {
+		return false
+	}
+	*sl = append((*sl)[:i], (*sl)[i+1:]...)
+	return true
+}
+
+func (sl *setListpack) size() int {
+	return len(*sl)
+}
+
+func (sl *setListpack) forEach(fn func(member string)) {
+	for _, m := range *sl {
+		fn(m)
+	}
+}
+
+// intset is the encoding for sets made only of integers, kept sorted so
+// lookups are a binary search.
+type intset []int64
+
+func (is *intset) search(n int64) (int, bool) {
+	i := sort.Search(len(*is), func(i int) bool { return (*is)[i] >= n })
+	return i, i < len(*is) && (*is)[i] == n
+}
+
+func (is *intset) contains(member string) bool {
+	n, ok := parseInt(member)
+	if !ok {
+		return false
+	}
+	_, found := is.search(n)
+	return found
+}
+
+// insert must only be called with integer members; see setForInsert.
+func (is *intset) insert(member string) bool {
+	n, _ := parseInt(member)
+	i, found := is.search(n)
+	if found {
+		return false
+	}
+	*is = append(*is, 0)
+	copy((*is)[i+1:], (*is)[i:])
+	(*is)[i] = n
+	return true
+}
+
+func (is *intset) remove(member string) bool {
+	n, ok := parseInt(member)
+	if !ok {
+		return false
+	}
+	i, found := is.search(n)
+	if !found {
+		return false
+	}
+	*is = append((*is)[:i], (*is)[i+1:]...)
+	return true
+}
+
+func (is *intset) size() int {
+	return len(*is)
+}
+
+func (is *intset) forEach(fn func(member string)) {
+	for _, n := range *is {
+		fn(strconv.FormatInt(n, 10))
+	}
+}
+
+// convertHash upgrades a listpack hash to a hashtable once it exceeds the
+// configured thresholds. Conversion is one way, as in Redis.
+func (s *MemoryStore) convertHash(hash hashObject) hashObject {
+	lp, ok := hash.(*hashListpack)
+	if !ok {
+		return hash
+	}
+
+	fits := lp.size() <= s.config.HashMaxListpackEntries
+	for _, entry := range *lp {
+		if len(entry) > s.config.HashMaxListpackValue {
+			fits = false
+			break
+		}
+	}
+	if fits {
+		return hash
+	}
+
+	table := newHashTable()
+	lp.forEach(func(field, value string) {
+		table.set(field, value)
+	})
+	return table
+}
+
+// setForInsert returns a set able to hold member, converting the current
+// encoding if the new member would not fit it.
+func (s *MemoryStore) setForInsert(set setObject, member string) setObject {
+	if set.contains(member) {
+		return set
+	}
+
+	switch enc := set.(type) {
+	case *intset:
+		_, isInt := parseInt(member)
+		if isInt && enc.size() < s.config.SetMaxIntsetEntries {
+			return set
+		}
+		if enc.size() < s.config.SetMaxListpackEntries && len(member) <= s.config.SetMaxListpackValue {
+			return convertSet(set, &setListpack{})
+		}
+		return convertSet(set, newSetTable())
+
+	case *setListpack:
+		if enc.size() < s.config.SetMaxListpackEntries && len(member) <= s.config.SetMaxListpackValue {
+			return set
+		}
+		return convertSet(set, newSetTable())
+	}
+
+	return set
+}
+
+func convertSet(from, to setObject) setObject {
+	from.forEach(func(member string) {
+		to.insert(member)
+	})
+	return to
+}
+
+// encodingOf names the encoding of a stored value for OBJECT ENCODING.
+func encodingOf(val interface{}) string {
+	switch v := val.(type) {
+	case int64:
+		return encodingInt
+	case string:
+		if len(v) <= embstrSizeLimit {
+			return encodingEmbstr
+		}
+		return encodingRaw
+	case []string:
+		// Lists are always a plain slice.
+		return encodingQuicklist
+	case *hashListpack, *setListpack:
+		return encodingListpack
+	case *intset:
+		return encodingIntset
+	case *hashTable, *setTable:
+		return encodingHashtable
+	}
+	return "unknown"
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+// step is a command followed by the encoding its key must have after it.
+type step struct {
+	cmd      []string
+	encoding string
+}
+
+func runSteps(t *testing.T, s *MemoryStore, steps []step) {
+	t.Helper()
+	for _, st := range steps {
+		run(t, s, st.cmd[0], st.cmd[1:]...)
+		if got := encoding(t, s, st.cmd[1]); got != st.encoding {
+			t.Errorf("%s: encoding %s, want %s", strings.Join(st.cmd, " "), got, st.encoding)
+		}
+	}
+}
+
+func TestStringEncodings(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	runSteps(t, s, []step{
+		{[]string{"SET", "k", "-9223372036854775808"}, encodingInt},
+		{[]string{"SET", "k", "9223372036854775808"}, encodingEmbstr},
+		{[]string{"SET", "k", "007"}, encodingEmbstr},
+		{[]string{"SET", "k", strings.Repeat("x", embstrSizeLimit)}, encodingEmbstr},
+		{[]string{"SET", "k", strings.Repeat("x", embstrSizeLimit+1)}, encodingRaw},
+		{[]string{"SET", "k", "42"}, encodingInt},
+	})
+}
+
+func TestHashEncodingConversion(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "CONFIG", "SET", "hash-max-listpack-entries", "4")
+	run(t, s, "CONFIG", "SET", "hash-max-listpack-value", "8")
+
+	runSteps(t, s, []step{
+		// By count, and back down: the conversion is one way.
+		{[]string{"HSET", "count", "f1", "v", "f2", "v", "f3", "v", "f4", "v"}, encodingListpack},
+		{[]string{"HSET", "count", "f5", "v"}, encodingHashtable},
+		{[]string{"HDEL", "count", "f5", "f4", "f3", "f2"}, encodingHashtable},
+		{[]string{"HSET", "count", "f2", "v"}, encodingHashtable},
+
+		// By the size of a value or a field.
+		{[]string{"HSET", "value", "f", strings.Repeat("v", 8)}, encodingListpack},
+		{[]string{"HSET", "value", "f", strings.Repeat("v", 9)}, encodingHashtable},
+		{[]string{"HSET", "value", "f", "v"}, encodingHashtable},
+		{[]string{"HSET", "field", strings.Repeat("f", 9), "v"}, encodingHashtable},
+
+		// HINCRBY converts as well.
+		{[]string{"HSET", "incr", "f1", "1", "f2", "1", "f3", "1", "f4", "1"}, encodingListpack},
+		{[]string{"HINCRBY", "incr", "f5", "1"}, encodingHashtable},
+	})
+}
+
+func TestSetEncodingConversion(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "CONFIG", "SET", "set-max-intset-entries", "4")
+	run(t, s, "CONFIG", "SET", "set-max-listpack-entries", "6")
+	run(t, s, "CONFIG", "SET", "set-max-listpack-value", "8")
+
+	runSteps(t, s, []step{
+		// By count: intset, listpack, hashtable, and never back.
+		{[]string{"SADD", "count", "1", "2", "3", "4"}, encodingIntset},
+		{[]string{"SADD", "count", "5"}, encodingListpack},
+		{[]string{"SADD", "count", "6"}, encodingListpack},
+		{[]string{"SADD", "count", "7"}, encodingHashtable},
+		{[]string{"SREM", "count", "7", "6", "5", "4", "3"}, encodingHashtable},
+		{[]string{"SADD", "count", "3"}, encodingHashtable},
+
+		// A member that is not an integer leaves the intset.
+		{[]string{"SADD", "mixed", "1", "-2"}, encodingIntset},
+		{[]string{"SADD", "mixed", "a"}, encodingListpack},
+		{[]string{"SREM", "mixed", "a"}, encodingListpack},
+		{[]string{"SADD", "mixed", "3"}, encodingListpack},
+		{[]string{"SADD", "mixed", "01"}, encodingListpack},
+
+		// By the size of a member, from either encoding.
+		{[]string{"SADD", "size", "a", strings.Repeat("m", 8)}, encodingListpack},
+		{[]string{"SADD", "size", strings.Repeat("m", 9)}, encodingHashtable},
+		{[]string{"SADD", "big", "1"}, encodingIntset},
+		{[]string{"SADD", "big", strings.Repeat("m", 9)}, encodingHashtable},
+		// Large integers still fit an intset.
+		{[]string{"SADD", "ints", "1", "123456789012"}, encodingIntset},
+	})
+}
+
+func TestObjectEncodingReply(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "RPUSH", "list", "a")
+	run(t, s, "HSET", "hash", "f", "v")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ENCODING", "list"}, "$9\r\nquicklist\r\n"},
+		{[]string{"encoding", "hash"}, "$8\r\nlistpack\r\n"},
+		{[]string{"ENCODING", "missing"}, "$-1\r\n"},
+		{[]string{"ENCODING"}, "-ERR wrong number of arguments for 'object'\r\n"},
+		{[]string{"NOPE", "list"}, "-ERR unknown subcommand for 'object'\r\n"},
+	}
+	for _, tc := range tests {
+		if got := s.ExecuteRaw("OBJECT", tc.args); got != tc.want {
+			t.Errorf("OBJECT %s = %q, want %q", strings.Join(tc.args, " "), got, tc.want)
+		}
+	}
+}
+
+func TestObjectFreqReply(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	// Without a log factor every access counts.
+	run(t, s, "CONFIG", "SET", "lfu-log-factor", "0")
+
+	s.Set("k", "v")
+	if got := run(t, s, "OBJECT", "FREQ", "k"); got != ":6\r\n" {
+		t.Errorf("OBJECT FREQ after SET = %q, want :6", got)
+	}
+	for i := 0; i < 10; i++ {
+		run(t, s, "GET", "k")
+	}
+	if got := run(t, s, "OBJECT", "FREQ", "k"); got != ":16\r\n" {
+		t.Errorf("OBJECT FREQ after 10 GETs = %q, want :16", got)
+	}
+
+	// One point is lost per lfu-decay-time minutes without access.
+	s.mu.Lock()
+	s.access["k"].decayedAt -= 3
+	s.mu.Unlock()
+	if got := run(t, s, "OBJECT", "FREQ", "k"); got != ":13\r\n" {
+		t.Errorf("OBJECT FREQ after 3 idle minutes = %q, want :13", got)
+	}
+
+	for i := 0; i < 300; i++ {
+		run(t, s, "GET", "k")
+	}
+	if got := run(t, s, "OBJECT", "FREQ", "k"); got != ":255\r\n" {
+		t.Errorf("OBJECT FREQ after 300 more GETs = %q, want it saturated at :255", got)
+	}
+
+	if got := s.ExecuteRaw("OBJECT", []string{"FREQ", "missing"}); got != "$-1\r\n" {
+		t.Errorf("OBJECT FREQ of a missing key = %q, want nil", got)
+	}
+}
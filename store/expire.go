@@ -1,17 +1,66 @@
 package store
 
-import "time"
+import (
+	"log"
+	"strconv"
+	"time"
+)
 
+// Expire sets key to expire in the given number of seconds.
 func (s *MemoryStore) Expire(key string, seconds int64) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	return s.expireAtMillis(key, (time.Now().Unix()+seconds)*1000)
+}
+
+// ExpireAt sets the expiry of key to the unix time at, in seconds. A time
+// in the past deletes the key.
+func (s *MemoryStore) ExpireAt(key string, at int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.expireAtMillis(key, at*1000)
+}
+
+// PExpireAt is ExpireAt with the time in milliseconds.
+func (s *MemoryStore) PExpireAt(key string, at int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.expireAtMillis(key, at)
+}
+
+// expireAtMillis sets the expiry of key to the unix time at in
+// milliseconds, or deletes the key if that is in the past. The AOF gets
+// the absolute time as PEXPIREAT, so replaying it later doesn't extend
+// the lifetime of the key. Callers must hold s.mu.
+func (s *MemoryStore) expireAtMillis(key string, at int64) bool {
 	if _, exists := s.data[key]; !exists {
 		return false
 	}
+	if at <= time.Now().UnixMilli() {
+		s.deleteExpired(key)
+		return true
+	}
+
+	s.expiration[key] = (at + 999) / 1000
+	s.dirty++
+	s.signalModifiedKey(key)
+	if s.aof != nil {
+		s.aof.AppendCommand("PEXPIREAT", key, strconv.FormatInt(at, 10))
+	}
+	return true
+}
 
-	s.expiration[key] = time.Now().Unix() + seconds
-	return false
+// deleteExpired removes key and logs the removal as a DEL, so an AOF
+// replayed later or elsewhere doesn't depend on the clock to drop it.
+// Callers must hold s.mu.
+func (s *MemoryStore) deleteExpired(key string) {
+	s.removeKey(key)
+	if s.aof != nil {
+		s.aof.AppendCommand("DEL", key)
+	}
 }
 
 func (s *MemoryStore) TTL(key string) int64 {
@@ -30,15 +79,26 @@ func (s *MemoryStore) TTL(key string) int64 {
 	return ttl
 }
 
+// isExpired reports whether key has a TTL in the past but was not yet
+// removed by the expiry daemon. Callers must hold s.mu.
+func (s *MemoryStore) isExpired(key string) bool {
+	expireAt, ok := s.expiration[key]
+	return ok && time.Now().Unix() >= expireAt
+}
+
 func (s *MemoryStore) cleanupExpireKeys() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// A replica leaves expiring keys to its master, which sends a DEL.
+	if s.isReplica() {
+		return
+	}
+
 	now := time.Now().Unix()
 	for key, expireAt := range s.expiration {
 		if now >= expireAt {
-			delete(s.data, key)
-			delete(s.expiration, key)
+			s.deleteExpired(key)
 		}
 	}
 }
@@ -47,5 +107,9 @@ func (s *MemoryStore) expiryDeamon() {
 	ticker := time.NewTicker(1 * time.Second)
 	for range ticker.C {
 		s.cleanupExpireKeys()
+		// No client reply flushes the DELs logged for expired keys.
+		if err := s.FlushAOF(); err != nil {
+			log.Println("[AOF] Failed to write expired keys:", err)
+		}
 	}
 }
@@ -2,126 +2,140 @@ package store
 
 import "strconv"
 
-func (s *MemoryStore) getHash(key string) (map[string]string, bool) {
-	val, ok := s.data[key]
-	if !ok {
-		return nil, false
+func (s *MemoryStore) getHash(key string) (hashObject, bool, error) {
+	val, err := s.value(key)
+	if val == nil || err != nil {
+		return nil, false, err
 	}
-	hash, ok := val.(map[string]string)
-	return hash, ok
+	hash, ok := val.(hashObject)
+	return hash, ok, nil
 }
 
-func (s *MemoryStore) HSet(key, field, value string) int {
+func (s *MemoryStore) HSet(key, field, value string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, _ := s.getHash(key)
+	s.ownValue(key)
+	hash, _, err := s.getHash(key)
+	if err != nil {
+		return 0, err
+	}
 	if hash == nil {
-		hash = make(map[string]string)
+		hash = &hashListpack{}
 	}
-	_, exists := hash[field]
-	hash[field] = value
-	s.data[key] = hash
-	if exists {
-		return 0
+	added := hash.set(field, value)
+	s.setValue(key, s.convertHash(hash))
+	s.touch(key)
+	if !added {
+		return 0, nil
 	}
 
 	if s.aof != nil {
 		s.aof.AppendCommand("HSET", key, field, value)
 	}
 
-	return 1
+	return 1, nil
 }
 
-func (s *MemoryStore) HGet(key, field string) (string, bool) {
+func (s *MemoryStore) HGet(key, field string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, ok := s.getHash(key)
+	hash, ok, err := s.getHash(key)
 	if !ok {
-		return "", false
+		return "", false, err
 	}
-	val, exists := hash[field]
-	return val, exists
+	s.touch(key)
+	val, ok := hash.get(field)
+	return val, ok, nil
 }
 
-func (s *MemoryStore) HGetAll(key string) ([]string, bool) {
+func (s *MemoryStore) HGetAll(key string) ([]string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, ok := s.getHash(key)
+	hash, ok, err := s.getHash(key)
 	if !ok {
-		return nil, false
+		return nil, false, err
 	}
-	result := make([]string, 0, len(hash)*2)
-	for field, value := range hash {
+	s.touch(key)
+	result := make([]string, 0, hash.size()*2)
+	hash.forEach(func(field, value string) {
 		result = append(result, field, value)
-	}
-	return result, true
+	})
+	return result, true, nil
 }
 
-func (s *MemoryStore) HDel(key string, fields ...string) int {
+func (s *MemoryStore) HDel(key string, fields ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, ok := s.getHash(key)
+	s.ownValue(key)
+	hash, ok, err := s.getHash(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
 	count := 0
 	for _, field := range fields {
-		if _, exists := hash[field]; exists {
-			delete(hash, field)
+		if hash.del(field) {
 			count++
 		}
 	}
-	s.data[key] = hash
+	s.setValue(key, hash)
+	s.touch(key)
 
 	if s.aof != nil && count > 0 {
 		s.aof.AppendCommand("HDEL", append([]string{key}, fields...)...)
 	}
 
-	return count
+	return count, nil
 }
 
-func (s *MemoryStore) HLen(key string) int {
+func (s *MemoryStore) HLen(key string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, ok := s.getHash(key)
+	hash, ok, err := s.getHash(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
-	return len(hash)
+	s.touch(key)
+	return hash.size(), nil
 }
 
-func (s *MemoryStore) HExists(key, field string) bool {
+func (s *MemoryStore) HExists(key, field string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, ok := s.getHash(key)
+	hash, ok, err := s.getHash(key)
 	if !ok {
-		return false
+		return false, err
 	}
+	s.touch(key)
 
-	_, exists := hash[field]
-	return exists
+	_, exists := hash.get(field)
+	return exists, nil
 }
 
 func (s *MemoryStore) HIncrBy(key, field string, increment int64) (int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, ok := s.getHash(key)
+	s.ownValue(key)
+	hash, ok, err := s.getHash(key)
+	if err != nil {
+		return 0, err
+	}
 	if !ok {
-		hash = make(map[string]string)
+		hash = &hashListpack{}
 	}
-	oldStr := hash[field]
+	oldStr, _ := hash.get(field)
 	oldVal, _ := strconv.ParseInt(oldStr, 10, 64)
 	newVal := oldVal + increment
 
-	hash[field] = strconv.FormatInt(newVal, 10)
-	s.data[key] = hash
+	hash.set(field, strconv.FormatInt(newVal, 10))
+	s.setValue(key, s.convertHash(hash))
+	s.touch(key)
 
 	if s.aof != nil {
 		s.aof.AppendCommand("HINCRBY", key, field, strconv.FormatInt(increment, 10))
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// infoSection is one INFO section; render runs with s.mu held.
+type infoSection struct {
+	name   string
+	render func(s *MemoryStore, b *strings.Builder)
+}
+
+var infoSections = []infoSection{
+	{"memory", (*MemoryStore).infoMemory},
+	{"persistence", (*MemoryStore).infoPersistence},
+	{"replication", (*MemoryStore).infoReplication},
+	{"tiered", (*MemoryStore).infoTiered},
+	{"keyspace", (*MemoryStore).infoKeyspace},
+}
+
+// Info returns the INFO text for the given sections, all of them when
+// none or "all", "default" or "everything" is given.
+func (s *MemoryStore) Info(sections ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, name := range sections {
+		wanted[strings.ToLower(name)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(section.name[:1]), section.name[1:])
+		section.render(s, &b)
+	}
+	return b.String()
+}
+
+func (s *MemoryStore) infoMemory(b *strings.Builder) {
+	fmt.Fprintf(b, "lazyfree_pending_objects:%d\r\n", s.lazyFreeStats.pending)
+	fmt.Fprintf(b, "lazyfreed_objects:%d\r\n", s.lazyFreeStats.freed)
+}
+
+func (s *MemoryStore) infoPersistence(b *strings.Builder) {
+	inProgress, current := 0, int64(-1)
+	if s.bgsave != nil && !s.bgsave.aofRewrite {
+		inProgress = 1
+		current = int64(time.Since(s.bgsave.started).Seconds())
+	}
+	status := "ok"
+	if !s.saveStats.lastBgsaveOK {
+		status = "err"
+	}
+	last := int64(-1)
+	if s.saveStats.lastBgsaveTime >= 0 {
+		last = int64(s.saveStats.lastBgsaveTime.Seconds())
+	}
+
+	fmt.Fprintf(b, "loading:0\r\n")
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", s.dirty)
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", s.saveStats.lastSave.Unix())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(b, "rdb_last_bgsave_time_sec:%d\r\n", last)
+	fmt.Fprintf(b, "rdb_current_bgsave_time_sec:%d\r\n", current)
+	if s.aof == nil {
+		fmt.Fprintf(b, "aof_enabled:0\r\n")
+		return
+	}
+
+	aof := s.aof.Stats()
+	writeStatus, pendingFsync := "ok", 0
+	if !aof.LastWriteOK {
+		writeStatus = "err"
+	}
+	if aof.PendingFsyncs {
+		pendingFsync = 1
+	}
+	rewriting, rewriteCurrent := 0, int64(-1)
+	if s.bgsave != nil && s.bgsave.aofRewrite {
+		rewriting = 1
+		rewriteCurrent = int64(time.Since(s.bgsave.started).Seconds())
+	}
+	rewriteStatus, rewriteLast := "ok", int64(-1)
+	if !s.aofRewriteStats.lastOK {
+		rewriteStatus = "err"
+	}
+	if s.aofRewriteStats.lastTime >= 0 {
+		rewriteLast = int64(s.aofRewriteStats.lastTime.Seconds())
+	}
+	fmt.Fprintf(b, "aof_enabled:1\r\n")
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", rewriting)
+	fmt.Fprintf(b, "aof_last_rewrite_time_sec:%d\r\n", rewriteLast)
+	fmt.Fprintf(b, "aof_current_rewrite_time_sec:%d\r\n", rewriteCurrent)
+	fmt.Fprintf(b, "aof_last_bgrewrite_status:%s\r\n", rewriteStatus)
+	fmt.Fprintf(b, "aof_last_write_status:%s\r\n", writeStatus)
+	fmt.Fprintf(b, "aof_current_size:%d\r\n", aof.Size)
+	fmt.Fprintf(b, "aof_base_size:%d\r\n", aof.BaseSize)
+	fmt.Fprintf(b, "aof_buffer_length:%d\r\n", aof.BufferLength)
+	fmt.Fprintf(b, "aof_pending_bio_fsync:%d\r\n", pendingFsync)
+	fmt.Fprintf(b, "aof_delayed_fsync:%d\r\n", aof.DelayedFsync)
+	fmt.Fprintf(b, "aof_last_fsync_latency_usec:%d\r\n", aof.LastFsync.Microseconds())
+}
+
+func (s *MemoryStore) infoKeyspace(b *strings.Builder) {
+	if len(s.data) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", len(s.data), len(s.expiration))
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"redis-clone/persistance"
+)
+
+// Entries returns every key as a snapshot entry, sorted by key. The
+// entries don't share memory with the keyspace, so they stay valid while
+// it changes.
+func (s *MemoryStore) Entries() ([]persistance.Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	for i := range entries {
+		// Lists are the only values toObject doesn't copy.
+		if entries[i].Object.Type == persistance.TypeList {
+			entries[i].Object.Items = append([]string(nil), entries[i].Object.Items...)
+		}
+	}
+	return entries, err
+}
+
+// entries returns every key that hasn't expired as a snapshot entry,
+// sorted by key. List items are shared with the keyspace. Callers must
+// hold s.mu.
+func (s *MemoryStore) entries() ([]persistance.Entry, error) {
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		if !s.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	entries := make([]persistance.Entry, 0, len(keys))
+	for _, key := range keys {
+		obj, err := toObject(s.data[key])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		entry := persistance.Entry{Key: key, Object: obj, Idle: -1, Freq: -1}
+		if expireAt, ok := s.expiration[key]; ok {
+			entry.ExpireAt = expireAt * 1000
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
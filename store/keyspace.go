@@ -0,0 +1,255 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Values with more elements than this are freed by a background goroutine
+// on UNLINK, like Redis' LAZYFREE_THRESHOLD.
+const lazyFreeThreshold = 64
+
+// lazyFreeStats backs the lazyfree fields of INFO memory.
+type lazyFreeStats struct {
+	pending int64 // values handed to freeValues and not freed yet
+	freed   int64
+}
+
+// renameKey moves the value and TTL of oldKey to newKey, replacing
+// whatever newKey held. Callers must hold s.mu and ensure oldKey exists.
+func (s *MemoryStore) renameKey(oldKey, newKey string) error {
+	if oldKey == newKey {
+		return nil
+	}
+
+	// The value moves to a key the background save doesn't track, and
+	// removing oldKey would free a disk copy.
+	s.ownValue(oldKey)
+	val, err := s.value(oldKey)
+	if err != nil {
+		return err
+	}
+	expireAt, hasTTL := s.expiration[oldKey]
+
+	s.removeKey(newKey)
+	s.removeKey(oldKey)
+	s.setValue(newKey, val)
+	if hasTTL {
+		s.expiration[newKey] = expireAt
+	}
+	s.touch(newKey)
+	return nil
+}
+
+// RenameNX renames oldKey only if newKey does not exist yet.
+func (s *MemoryStore) RenameNX(oldKey, newKey string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[oldKey]; !ok {
+		return false, fmt.Errorf("no such key")
+	}
+	if _, exists := s.data[newKey]; exists {
+		return false, nil
+	}
+	if err := s.renameKey(oldKey, newKey); err != nil {
+		return false, err
+	}
+
+	if s.aof != nil {
+		s.aof.AppendCommand("RENAME", oldKey, newKey)
+	}
+
+	return true, nil
+}
+
+// Copy duplicates the value and TTL of src into dst. Without replace an
+// existing dst is left alone and false is returned.
+func (s *MemoryStore) Copy(src, dst string, db int, replace bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if db != 0 {
+		return false, fmt.Errorf("only one DB implemented")
+	}
+	if src == dst {
+		return false, fmt.Errorf("source and destination objects are the same")
+	}
+	val, err := s.value(src)
+	if val == nil || err != nil {
+		return false, err
+	}
+	if _, exists := s.data[dst]; exists && !replace {
+		return false, nil
+	}
+
+	s.removeKey(dst)
+	s.setValue(dst, cloneValue(val))
+	if expireAt, hasTTL := s.expiration[src]; hasTTL {
+		s.expiration[dst] = expireAt
+	}
+	s.touch(dst)
+
+	if s.aof != nil {
+		if replace {
+			s.aof.AppendCommand("COPY", src, dst, "REPLACE")
+		} else {
+			s.aof.AppendCommand("COPY", src, dst)
+		}
+	}
+
+	return true, nil
+}
+
+// Unlink removes keys like Del but hands large values to a background
+// goroutine, so tearing them down does not hold up other commands.
+func (s *MemoryStore) Unlink(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	var garbage []interface{}
+	for _, key := range keys {
+		val, ok := s.data[key]
+		if !ok {
+			continue
+		}
+		// A background save may still be reading the value.
+		lazy := valueLen(val) > lazyFreeThreshold && !s.sharedWithSave(key)
+		s.removeKey(key)
+		count++
+		if lazy {
+			garbage = append(garbage, val)
+		}
+
+		if s.aof != nil {
+			s.aof.AppendCommand("DEL", key)
+		}
+	}
+
+	if len(garbage) > 0 {
+		s.lazyFreeStats.pending += int64(len(garbage))
+		go s.freeValues(garbage)
+	}
+
+	return count
+}
+
+// freeValues drops the elements of unlinked values one by one, the slow
+// part of freeing a large collection, without holding s.mu; the garbage
+// collector then finds little left to walk.
+func (s *MemoryStore) freeValues(values []interface{}) {
+	for _, val := range values {
+		switch v := val.(type) {
+		case *hashTable:
+			clear(v.entries)
+			v.index = newKeyIndex()
+		case *setTable:
+			clear(v.members)
+			v.index = newKeyIndex()
+		case []string:
+			clear(v)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyFreeStats.pending -= int64(len(values))
+	s.lazyFreeStats.freed += int64(len(values))
+}
+
+// Touch updates the access time of keys and returns how many exist.
+func (s *MemoryStore) Touch(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok := s.data[key]; ok {
+			s.touch(key)
+			count++
+		}
+	}
+	return count
+}
+
+// RandomKey picks a random key by sampling buckets of the key index.
+// Expired keys are deleted as they are picked; a replica leaves them to
+// its master and, like Redis, returns one after 100 of them in a row.
+func (s *MemoryStore) RandomKey() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replica := s.isReplica()
+	expired := 0
+	for len(s.data) > 0 {
+		bucket := s.keys.buckets[rand.Intn(len(s.keys.buckets))]
+		if len(bucket) == 0 {
+			continue
+		}
+		key := bucket[rand.Intn(len(bucket))]
+		if !s.isExpired(key) {
+			return key, true
+		}
+		if !replica {
+			s.deleteExpired(key)
+			continue
+		}
+		if expired++; expired >= 100 {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (s *MemoryStore) DBSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.data)
+}
+
+// valueLen returns the number of elements of a collection, 1 for strings
+// and cold values.
+func valueLen(val interface{}) int {
+	switch v := val.(type) {
+	case []string:
+		return len(v)
+	case hashObject:
+		return v.size()
+	case setObject:
+		return v.size()
+	}
+	return 1
+}
+
+// cloneValue deep copies a stored value. Strings and integers are
+// immutable and returned as is.
+func cloneValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []string:
+		return append([]string(nil), v...)
+	case *hashListpack:
+		c := append(hashListpack(nil), *v...)
+		return &c
+	case *setListpack:
+		c := append(setListpack(nil), *v...)
+		return &c
+	case *intset:
+		c := append(intset(nil), *v...)
+		return &c
+	case *hashTable:
+		c := newHashTable()
+		v.forEach(func(field, value string) {
+			c.set(field, value)
+		})
+		return c
+	case *setTable:
+		c := newSetTable()
+		v.forEach(func(member string) {
+			c.insert(member)
+		})
+		return c
+	}
+	return val
+}
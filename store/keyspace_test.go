@@ -0,0 +1,111 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func lazyFreed(s *MemoryStore) lazyFreeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lazyFreeStats
+}
+
+func TestUnlinkFreesLargeValuesInBackground(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "HSET", append([]string{"hash"}, pairs(300)...)...)
+	run(t, s, "RPUSH", append([]string{"list"}, numbered("e", 300)...)...)
+	run(t, s, "SADD", "small", "a", "b")
+	run(t, s, "HSET", append([]string{"deleted"}, pairs(300)...)...)
+	hash := s.data["hash"].(*hashTable)
+	list := s.data["list"].([]string)
+
+	if reply := run(t, s, "UNLINK", "hash", "list", "small", "missing"); reply != ":3\r\n" {
+		t.Fatalf("UNLINK = %q, want :3", reply)
+	}
+	if reply := run(t, s, "EXISTS", "hash", "list", "small"); reply != ":0\r\n" {
+		t.Errorf("EXISTS after UNLINK = %q, want :0", reply)
+	}
+	for deadline := time.Now().Add(5 * time.Second); lazyFreed(s).pending > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("unlinked values were never freed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := lazyFreed(s); stats.freed != 2 {
+		t.Errorf("%d values freed in the background, want the 2 large ones", stats.freed)
+	}
+	s.mu.Lock()
+	if len(hash.entries) != 0 || list[0] != "" {
+		t.Error("unlinked values still hold their elements")
+	}
+	s.mu.Unlock()
+
+	// DEL frees on the spot.
+	run(t, s, "DEL", "deleted")
+	if stats := lazyFreed(s); stats.freed != 2 || stats.pending != 0 {
+		t.Errorf("lazy free stats after DEL = %+v, want DEL not to count", stats)
+	}
+	if info := s.Info("memory"); info != "# Memory\r\nlazyfree_pending_objects:0\r\nlazyfreed_objects:2\r\n" {
+		t.Errorf("INFO memory = %q", info)
+	}
+}
+
+// TestUnlinkDuringBackgroundSave unlinks a value a background save still
+// reads; it must be left intact.
+func TestUnlinkDuringBackgroundSave(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "HSET", append([]string{"hash"}, pairs(300)...)...)
+	s.mu.Lock()
+	save := s.startBackground(false)
+	s.mu.Unlock()
+
+	run(t, s, "UNLINK", "hash")
+	if stats := lazyFreed(s); stats.pending != 0 || stats.freed != 0 {
+		t.Errorf("lazy free stats = %+v, want the saved value left alone", stats)
+	}
+	if n := save.data["hash"].(hashObject).size(); n != 300 {
+		t.Errorf("saved hash has %d fields after UNLINK, want 300", n)
+	}
+
+	s.mu.Lock()
+	s.finishBackground()
+	s.mu.Unlock()
+}
+
+func TestRandomKeySkipsExpired(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.Set("live", "v")
+	for _, key := range setKeys(s, "dead", 50) {
+		s.expiration[key] = 1
+	}
+	for i := 0; i < 20; i++ {
+		if key, ok := s.RandomKey(); !ok || key != "live" {
+			t.Fatalf("RandomKey = %q, %v, want live", key, ok)
+		}
+	}
+
+	run(t, s, "DEL", "live")
+	if reply := run(t, s, "RANDOMKEY"); reply != "$-1\r\n" {
+		t.Errorf("RANDOMKEY with only expired keys = %q, want nil", reply)
+	}
+	if n := s.DBSize(); n != 0 {
+		t.Errorf("DBSIZE after RANDOMKEY = %d, want the expired keys deleted", n)
+	}
+}
+
+// TestRandomKeyOnReplica leaves expired keys to the master, and still
+// returns when there is nothing else.
+func TestRandomKeyOnReplica(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.SetMaster("127.0.0.1", 1)
+	for _, key := range setKeys(s, "dead", 10) {
+		s.expiration[key] = 1
+	}
+	if _, ok := s.RandomKey(); !ok {
+		t.Error("RandomKey on a replica with only expired keys found none")
+	}
+	if n := s.DBSize(); n != 10 {
+		t.Errorf("DBSIZE after RandomKey = %d, want the replica to keep expired keys", n)
+	}
+}
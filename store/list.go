@@ -2,97 +2,115 @@ package store
 
 import "errors"
 
-func (s *MemoryStore) getList(key string) ([]string, bool) {
-	val, ok := s.data[key]
-	if !ok {
-		return nil, false
+func (s *MemoryStore) getList(key string) ([]string, bool, error) {
+	val, err := s.value(key)
+	if val == nil || err != nil {
+		return nil, false, err
 	}
 
 	list, ok := val.([]string)
-	return list, ok
+	return list, ok, nil
 }
 
-func (s *MemoryStore) LPush(key string, values ...string) int {
+func (s *MemoryStore) LPush(key string, values ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, _ := s.getList(key)
+	list, _, err := s.getList(key)
+	if err != nil {
+		return 0, err
+	}
 	list = append(values, list...)
 
-	s.data[key] = list
+	s.setValue(key, list)
+	s.touch(key)
 
 	if s.aof != nil && len(values) > 0 {
 		_ = s.aof.AppendCommand("LPUSH", append([]string{key}, values...)...)
 	}
 
-	return len(list)
+	return len(list), nil
 }
 
-func (s *MemoryStore) RPush(key string, values ...string) int {
+func (s *MemoryStore) RPush(key string, values ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, _ := s.getList(key)
+	// append may write into a backing array a background save still reads.
+	s.ownValue(key)
+	list, _, err := s.getList(key)
+	if err != nil {
+		return 0, err
+	}
 	list = append(list, values...)
-	s.data[key] = list
+	s.setValue(key, list)
+	s.touch(key)
 
 	if s.aof != nil && len(values) > 0 {
 		_ = s.aof.AppendCommand("RPUSH", append([]string{key}, values...)...)
 	}
 
-	return len(list)
+	return len(list), nil
 }
 
-func (s *MemoryStore) LPop(key string) (string, error) {
+// LPop returns false if key holds no list or an empty one.
+func (s *MemoryStore) LPop(key string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, ok := s.getList(key)
-	if !ok {
-		return "", errors.New("empty or not a list")
+	list, ok, err := s.getList(key)
+	if !ok || len(list) == 0 {
+		return "", false, err
 	}
 
 	val := list[0]
 	list = list[1:]
-	s.data[key] = list
+	s.setValue(key, list)
+	s.touch(key)
 
 	// AOF logging
 	if s.aof != nil {
 		_ = s.aof.AppendCommand("LPOP", key)
 	}
 
-	return val, nil
+	return val, true, nil
 }
 
-func (s *MemoryStore) RPop(key string) (string, error) {
+// RPop returns false if key holds no list or an empty one.
+func (s *MemoryStore) RPop(key string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, ok := s.getList(key)
-	if !ok {
-		return "", errors.New("empty or not a list")
+	list, ok, err := s.getList(key)
+	if !ok || len(list) == 0 {
+		return "", false, err
 	}
 
 	val := list[len(list)-1]
 	list = list[:len(list)-1]
-	s.data[key] = list
+	s.setValue(key, list)
+	s.touch(key)
 
 	// AOF logging
 	if s.aof != nil {
 		_ = s.aof.AppendCommand("RPOP", key)
 	}
 
-	return val, nil
+	return val, true, nil
 }
 
 func (s *MemoryStore) LRange(key string, start, stop int) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, ok := s.getList(key)
+	list, ok, err := s.getList(key)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
 		return nil, errors.New("not a list")
 	}
+	s.touch(key)
 
 	if start < 0 {
 		start = len(list) + start
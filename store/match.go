@@ -0,0 +1,140 @@
+package store
+
+// Patterns nested deeper than this never match, which bounds the
+// recursion on pathological inputs such as "a*a*a*a*...b".
+const maxMatchNesting = 1000
+
+// MatchPattern reports whether str matches the Redis glob pattern, with
+// the same rules as Redis' stringmatchlen. '*' matches any run of bytes,
+// '?' a single byte, [abc], [^abc] and [a-z] a byte class, and a backslash
+// escapes the next byte both inside and outside classes.
+//
+// Matching works on bytes; unlike path.Match, '/' is not special and
+// malformed patterns never return an error. As in Redis, a non-empty
+// pattern never matches the empty string, so callers special-case "*".
+func MatchPattern(pattern, str string) bool {
+	skipLonger := false
+	return stringMatch(pattern, str, false, &skipLonger, 0)
+}
+
+// MatchPatternNoCase is MatchPattern ignoring ASCII case.
+func MatchPatternNoCase(pattern, str string) bool {
+	skipLonger := false
+	return stringMatch(pattern, str, true, &skipLonger, 0)
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
+
+// stringMatch is a port of stringmatchlen_impl. skipLonger is set once a
+// '*' failed to match any suffix, since then no longer match can succeed
+// either and the outer '*' loops can stop early.
+func stringMatch(p, s string, nocase bool, skipLonger *bool, nesting int) bool {
+	if nesting > maxMatchNesting {
+		return false
+	}
+
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if stringMatch(p[1:], s, nocase, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				s = s[1:]
+			}
+			*skipLonger = true
+			return false
+
+		case '?':
+			s = s[1:]
+
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for {
+				if len(p) == 0 {
+					// Unterminated class: treat the last byte as its end.
+					p = " "
+					break
+				}
+				if p[0] == '\\' && len(p) >= 2 {
+					p = p[1:]
+					if p[0] == s[0] {
+						match = true
+					}
+				} else if p[0] == ']' {
+					break
+				} else if len(p) >= 3 && p[1] == '-' {
+					start, end, c := p[0], p[2], s[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = lower(start), lower(end), lower(c)
+					}
+					p = p[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(p[0], s[0], nocase) {
+					match = true
+				}
+				p = p[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+
+		default:
+			if !equalByte(p[0], s[0], nocase) {
+				return false
+			}
+			s = s[1:]
+		}
+
+		p = p[1:]
+		if len(s) == 0 {
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			break
+		}
+	}
+
+	return len(p) == 0 && len(s) == 0
+}
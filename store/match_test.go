@@ -0,0 +1,133 @@
+package store
+
+import "testing"
+
+// Expected results follow Redis' stringmatchlen.
+var matchTests = []struct {
+	pattern, str string
+	want         bool
+}{
+	// Literals.
+	{"abc", "abc", true},
+	{"abc", "abd", false},
+	{"abc", "ab", false},
+	{"ab", "abc", false},
+	{"", "", true},
+	{"", "a", false},
+
+	// '*' matches any run of bytes, but a non-empty pattern never matches
+	// the empty string.
+	{"*", "anything", true},
+	{"*", "", false},
+	{"a*", "a", true},
+	{"a*", "abc", true},
+	{"*c", "abc", true},
+	{"*c", "abd", false},
+	{"a*c", "ac", true},
+	{"a*c", "abbbc", true},
+	{"a*c", "abbbd", false},
+	{"a**c", "abc", true},
+	{"*a*b*", "xxaxxbxx", true},
+	{"*a*b*", "xxbxxaxx", false},
+	{"a*a*a*a*a*a*a*a*b", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+	{"user:*", "user:1000", true},
+	{"user:*", "session:1", false},
+
+	// '?' matches exactly one byte.
+	{"?", "a", true},
+	{"?", "", false},
+	{"?", "ab", false},
+	{"h?llo", "hello", true},
+	{"h?llo", "hllo", false},
+	{"*?", "a", true},
+
+	// Classes.
+	{"h[ae]llo", "hello", true},
+	{"h[ae]llo", "hallo", true},
+	{"h[ae]llo", "hillo", false},
+	{"[abc]", "b", true},
+	{"[abc]", "d", false},
+	{"[abc]", "", false},
+	{"h[^e]llo", "hallo", true},
+	{"h[^e]llo", "hello", false},
+	{"[^a]", "a", false},
+	{"[^a]", "b", true},
+	{"[^abc]", "d", true},
+	{"h[a-b]llo", "hallo", true},
+	{"h[a-b]llo", "hbllo", true},
+	{"h[a-b]llo", "hcllo", false},
+	{"[a-z]", "m", true},
+	{"[a-z]", "M", false},
+	{"[0-9a-f]", "7", true},
+	{"[0-9a-f]", "c", true},
+	{"[0-9a-f]", "g", false},
+	{"[^0-9]", "5", false},
+	{"[^0-9]", "x", true},
+
+	// Reversed ranges are swapped.
+	{"[z-a]", "m", true},
+	{"[z-a]", "A", false},
+	{"[9-0]", "5", true},
+
+	// Backslash escapes, outside and inside classes.
+	{`\*`, "*", true},
+	{`\*`, "a", false},
+	{`\?`, "?", true},
+	{`\?`, "a", false},
+	{`\[`, "[", true},
+	{`a\*b`, "a*b", true},
+	{`a\*b`, "axb", false},
+	{`\a`, "a", true},
+	{`[\]]`, "]", true},
+	{`[\]]`, "a", false},
+	{`[\^a]`, "^", true},
+	{`[a\-z]`, "-", true},
+	{`[a\-z]`, "m", false},
+	{`*\*`, "abc*", true},
+
+	// An unterminated class is closed by the end of the pattern.
+	{"[abc", "a", true},
+	{"[abc", "c", true},
+	{"[abc", "d", false},
+	{"[a-c", "b", true},
+	{"[^a", "b", true},
+	{"[^a", "a", false},
+	{"ab[", "ab", false},
+
+	// A trailing backslash matches itself.
+	{`\`, `\`, true},
+	{`\`, "a", false},
+	{`a\`, `a\`, true},
+	{`a\`, "a", false},
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range matchTests {
+		if got := MatchPattern(tc.pattern, tc.str); got != tc.want {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", tc.pattern, tc.str, got, tc.want)
+		}
+	}
+}
+
+func TestMatchPatternNoCase(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		want         bool
+	}{
+		{"HELLO", "hello", true},
+		{"h*O", "HellO", true},
+		{"[A-C]", "b", true},
+		{"[a-c]", "B", true},
+		{"[^A]", "a", false},
+		{"h?llo", "HELLO", true},
+		{"hello", "world", false},
+	}
+	for _, tc := range tests {
+		if got := MatchPatternNoCase(tc.pattern, tc.str); got != tc.want {
+			t.Errorf("MatchPatternNoCase(%q, %q) = %v, want %v", tc.pattern, tc.str, got, tc.want)
+		}
+	}
+	if MatchPattern("HELLO", "hello") {
+		t.Error(`MatchPattern("HELLO", "hello") = true, want case to matter`)
+	}
+}
@@ -1,9 +1,9 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,46 +14,116 @@ import (
 
 type RedisValue interface{}
 
+var errWrongType = errors.New("wrong type")
+
+// ErrorReply formats err as an error reply. Errors that carry their own
+// code keep it, the rest get the generic ERR.
+func ErrorReply(err error) string {
+	var coldErr *ColdReadError
+	if errors.Is(err, ErrBusyKey) || errors.As(err, &coldErr) {
+		return "-" + err.Error() + "\r\n"
+	}
+	return "-ERR " + err.Error() + "\r\n"
+}
+
 type MemoryStore struct {
-	mu          sync.RWMutex
-	data        map[string]interface{}
-	expiration  map[string]int64
-	aof         *persistance.AOF
-	subscribers map[string][]chan string
+	mu              sync.RWMutex
+	data            map[string]interface{}
+	keys            *keyIndex
+	expiration      map[string]int64
+	access          map[string]*accessInfo
+	config          Config
+	aof             *persistance.AOF
+	subscribers     map[string][]chan string
+	bgsave          *bgSave
+	saveStats       saveStats
+	aofRewriteStats aofRewriteStats
+	dirty           int64                  // keys modified since the last successful save
+	keyring         *persistance.Keyring   // from encryption-key-file, nil if unset
+	cold            *persistance.ColdStore // values moved to disk, nil until the first one
+	tieringStats    tieringStats
+	lazyFreeStats   lazyFreeStats
+	repl            *replication
+	watches         map[string][]*keyWatch // by key, see signalModifiedKey
 }
 
 func NewMemoryStoreWithAOF(aof *persistance.AOF) *MemoryStore {
 	store := &MemoryStore{
-		data:        make(map[string]interface{}),
-		expiration:  make(map[string]int64),
-		aof:         aof,
-		subscribers: make(map[string][]chan string),
+		data:            make(map[string]interface{}),
+		keys:            newKeyIndex(),
+		expiration:      make(map[string]int64),
+		access:          make(map[string]*accessInfo),
+		config:          DefaultConfig(),
+		aof:             aof,
+		subscribers:     make(map[string][]chan string),
+		saveStats:       saveStats{lastSave: time.Now(), lastBgsaveOK: true, lastBgsaveTime: -1},
+		aofRewriteStats: aofRewriteStats{lastOK: true, lastTime: -1},
+		repl:            newReplication(),
 	}
 
 	go store.expiryDeamon()
+	go store.tieringDaemon()
+	go store.replicationDaemon()
 	return store
 }
 
+// setValue stores val under key, indexing the key if it is new.
+// Callers must hold s.mu.
+func (s *MemoryStore) setValue(key string, val interface{}) {
+	old, exists := s.data[key]
+	if !exists {
+		s.keys.add(key)
+	} else if cv, ok := old.(*coldValue); ok && val != interface{}(cv) {
+		s.releaseCold(key, cv)
+	}
+	s.data[key] = val
+	s.dirty++
+	s.signalModifiedKey(key)
+}
+
+// removeKey drops a key together with its TTL and access metadata.
+// Callers must hold s.mu.
+func (s *MemoryStore) removeKey(key string) {
+	if val, exists := s.data[key]; exists {
+		s.keys.remove(key)
+		s.dirty++
+		if cv, ok := val.(*coldValue); ok {
+			s.releaseCold(key, cv)
+		}
+	}
+	delete(s.data, key)
+	delete(s.expiration, key)
+	delete(s.access, key)
+	s.signalModifiedKey(key)
+	if s.bgsave != nil {
+		// Whatever key holds next is not the value being saved.
+		s.bgsave.owned[key] = struct{}{}
+	}
+}
+
 func (s *MemoryStore) Set(key string, val string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.data[key] = val
+	s.setValue(key, encodeString(val))
+	s.touch(key)
 
 	if s.aof != nil {
 		s.aof.AppendCommand("SET", key, val)
 	}
 }
 
-func (s *MemoryStore) Get(key string) (string, bool) {
+func (s *MemoryStore) Get(key string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	val, ok := s.data[key]
-	if !ok {
-		return "", false
+	val, err := s.value(key)
+	if val == nil || err != nil {
+		return "", false, err
 	}
-	return val.(string), true
+	s.touch(key)
+	str, ok := stringValue(val)
+	return str, ok, nil
 }
 
 func (s *MemoryStore) Del(keys ...string) int {
@@ -64,8 +134,7 @@ func (s *MemoryStore) Del(keys ...string) int {
 
 	for _, key := range keys {
 		if _, ok := s.data[key]; ok {
-			delete(s.data, key)
-			delete(s.expiration, key)
+			s.removeKey(key)
 			count++
 
 			if s.aof != nil && count > 0 {
@@ -96,9 +165,12 @@ func (s *MemoryStore) Incr(key string) (int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	val, exists := s.data[key]
-	if exists {
-		strVal, ok := val.(string)
+	val, err := s.value(key)
+	if err != nil {
+		return 0, err
+	}
+	if val != nil {
+		strVal, ok := stringValue(val)
 		if !ok {
 			return 0, fmt.Errorf("wrong type")
 		}
@@ -107,7 +179,8 @@ func (s *MemoryStore) Incr(key string) (int64, error) {
 			return 0, fmt.Errorf("value is not an integer")
 		}
 		n++
-		s.data[key] = strconv.FormatInt(n, 10)
+		s.setValue(key, n)
+		s.touch(key)
 		if s.aof != nil {
 			s.aof.AppendCommand("INCR", key)
 		}
@@ -116,7 +189,8 @@ func (s *MemoryStore) Incr(key string) (int64, error) {
 	}
 
 	// If not exists set to 1
-	s.data[key] = "1"
+	s.setValue(key, int64(1))
+	s.touch(key)
 	if s.aof != nil {
 		s.aof.AppendCommand("INCR", key)
 	}
@@ -133,15 +207,21 @@ func (s *MemoryStore) Type(key string) string {
 		return "none"
 	}
 
-	switch val.(type) {
-	case string:
+	return typeOf(val)
+}
+
+func typeOf(val interface{}) string {
+	switch v := val.(type) {
+	case string, int64:
 		return "string"
 	case []string:
 		return "list"
-	case map[string]string:
+	case hashObject:
 		return "hash"
-	case map[string]bool:
+	case setObject:
 		return "set"
+	case *coldValue:
+		return coldTypeNames[v.typ]
 	default:
 		return "unknown"
 	}
@@ -153,11 +233,7 @@ func (s *MemoryStore) Keys(pattern string) []string {
 
 	keys := make([]string, 0)
 	for k := range s.data {
-		match, err := path.Match(pattern, k)
-		if err != nil {
-			continue
-		}
-		if match {
+		if pattern == "*" || MatchPattern(pattern, k) {
 			keys = append(keys, k)
 		}
 	}
@@ -169,8 +245,13 @@ func (s *MemoryStore) FlushAll() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.dirty += int64(len(s.data))
+	s.signalFlush()
+	s.releaseAllCold()
 	s.data = make(map[string]interface{})
+	s.keys = newKeyIndex()
 	s.expiration = make(map[string]int64)
+	s.access = make(map[string]*accessInfo)
 
 	if s.aof != nil {
 		s.aof.AppendCommand("FLUSHALL")
@@ -181,12 +262,12 @@ func (s *MemoryStore) Rename(oldKey, newKey string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	val, ok := s.data[oldKey]
-	if !ok {
+	if _, ok := s.data[oldKey]; !ok {
 		return fmt.Errorf("no such key")
 	}
-	s.data[newKey] = val
-	delete(s.data, oldKey)
+	if err := s.renameKey(oldKey, newKey); err != nil {
+		return err
+	}
 
 	if s.aof != nil {
 		s.aof.AppendCommand("RENAME", oldKey, newKey)
@@ -254,27 +335,36 @@ func (s *MemoryStore) Unsubscribe(channel string, client chan string) {
 	}
 }
 
+// SaveSnapshot writes the dataset to path, blocking every client until
+// it is done.
 func (s *MemoryStore) SaveSnapshot(path string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return persistance.SaveRDB(path, persistance.Snapshot{
-		Data:       s.data,
-		Expiration: s.expiration,
-	})
+	if s.bgsave != nil && !s.bgsave.aofRewrite {
+		return ErrBgsaveInProgress
+	}
+	if err := writeSnapshot(path, s.config.RDBKeepSnapshots, s.rdbOptions(), s.data, s.expiration); err != nil {
+		return err
+	}
+	s.saveStats.lastSave = time.Now()
+	s.saveStats.lastBgsaveOK = true
+	s.dirty = 0
+	return nil
 }
 
+// LoadSnapshot replaces the dataset with the snapshot at path, falling
+// back to a retained older snapshot if that one is missing or corrupt.
+// The error wraps os.ErrNotExist when there is no snapshot at all.
 func (s *MemoryStore) LoadSnapshot(path string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	snap, err := persistance.LoadRDB(path)
+	snap, _, err := persistance.LoadLatestRDB(path, s.keyring)
 	if err != nil {
 		return err
 	}
-	s.data = snap.Data
-	s.expiration = snap.Expiration
-	return nil
+	return s.loadEntries(snap.Entries)
 }
 
 func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
@@ -290,7 +380,13 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		return "+OK\r\n"
 
 	case "GET":
-		val, ok := s.Get(args[0])
+		if len(args) != 1 {
+			return "-ERR wrong number of arguments for 'get'\r\n"
+		}
+		val, ok, err := s.Get(args[0])
+		if err != nil {
+			return ErrorReply(err)
+		}
 		if !ok {
 			return "$-1\r\n"
 		}
@@ -311,22 +407,31 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		if len(args) < 2 {
 			return "-ERR wrong number of arguments for 'lpush'\r\n"
 		}
-		count := s.LPush(args[0], args[1:]...)
+		count, err := s.LPush(args[0], args[1:]...)
+		if err != nil {
+			return ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "RPUSH":
 		if len(args) < 2 {
 			return "-ERR wrong number of arguments for 'rpush'\r\n"
 		}
-		count := s.RPush(args[0], args[1:]...)
+		count, err := s.RPush(args[0], args[1:]...)
+		if err != nil {
+			return ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "LPOP":
 		if len(args) < 1 {
 			return "-ERR wrong number of arguments for 'lpop'\r\n"
 		}
-		val, err := s.LPop(args[0])
+		val, ok, err := s.LPop(args[0])
 		if err != nil {
+			return ErrorReply(err)
+		}
+		if !ok {
 			return "$-1\r\n"
 		}
 		return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
@@ -335,8 +440,11 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		if len(args) < 1 {
 			return "-ERR wrong number of arguments for 'rpop'\r\n"
 		}
-		val, err := s.RPop(args[0])
+		val, ok, err := s.RPop(args[0])
 		if err != nil {
+			return ErrorReply(err)
+		}
+		if !ok {
 			return "$-1\r\n"
 		}
 		return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
@@ -353,7 +461,7 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 
 		items, err := s.LRange(args[0], start, stop)
 		if err != nil {
-			return "-ERR" + err.Error() + "\r\n"
+			return ErrorReply(err)
 		}
 
 		resp := fmt.Sprintf("*%d\r\n", len(items))
@@ -367,7 +475,10 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 			return "-ERR wrong number of arguments for 'sadd'\r\n"
 		}
 
-		count := s.SAdd(args[0], args[1:]...)
+		count, err := s.SAdd(args[0], args[1:]...)
+		if err != nil {
+			return ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "SREM":
@@ -375,14 +486,21 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 			return "-ERR wrong number of arguments for 'srem'\r\n"
 		}
 
-		count := s.SRem(args[0], args[1:]...)
+		count, err := s.SRem(args[0], args[1:]...)
+		if err != nil {
+			return ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "SISMEMBER":
 		if len(args) != 2 {
 			return "-ERR wrong number of arguments for 'sismember'\r\n"
 		}
-		if s.SIsMember(args[0], args[1]) {
+		isMember, err := s.SIsMember(args[0], args[1])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		if isMember {
 			return ":1\r\n"
 		}
 		return ":0\r\n"
@@ -391,7 +509,10 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'smembers'\r\n"
 		}
-		members, ok := s.SMembers(args[0])
+		members, ok, err := s.SMembers(args[0])
+		if err != nil {
+			return ErrorReply(err)
+		}
 		if !ok {
 			return "*0\r\n"
 		}
@@ -405,14 +526,20 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		if len(args) != 1 {
 			return "-ERR wrong number of arguemnts for 'scard'\r\n"
 		}
-		count := s.SCard(args[0])
+		count, err := s.SCard(args[0])
+		if err != nil {
+			return ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "SUNION":
 		if len(args) < 1 {
 			return "-ERR wrong number of arguments for 'sunion'\r\n"
 		}
-		union := s.SUnion(args...)
+		union, err := s.SUnion(args...)
+		if err != nil {
+			return ErrorReply(err)
+		}
 		resp := fmt.Sprintf("*%d\r\n", len(union))
 		for _, m := range union {
 			resp += fmt.Sprintf("$%d\r\n%s\r\n", len(m), m)
@@ -420,17 +547,27 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		return resp
 
 	case "HSET":
-		if len(args) != 3 {
+		if len(args) < 3 || len(args)%2 != 1 {
 			return "-ERR wrong number of arguments for 'hset'\r\n"
 		}
-		added := s.HSet(args[0], args[1], args[2])
+		added := 0
+		for i := 1; i < len(args); i += 2 {
+			n, err := s.HSet(args[0], args[i], args[i+1])
+			if err != nil {
+				return ErrorReply(err)
+			}
+			added += n
+		}
 		return fmt.Sprintf(":%d\r\n", added)
 
 	case "HGET":
 		if len(args) != 2 {
 			return "-ERR wrong number of arguments for 'hget'\r\n"
 		}
-		val, ok := s.HGet(args[0], args[1])
+		val, ok, err := s.HGet(args[0], args[1])
+		if err != nil {
+			return ErrorReply(err)
+		}
 		if !ok {
 			return "$-1\r\n"
 		}
@@ -440,7 +577,10 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'hgetall'\r\n"
 		}
-		pairs, ok := s.HGetAll(args[0])
+		pairs, ok, err := s.HGetAll(args[0])
+		if err != nil {
+			return ErrorReply(err)
+		}
 		if !ok {
 			return "*0\r\n"
 		}
@@ -454,14 +594,20 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		if len(args) < 2 {
 			return "-ERR wrong number of arguments for 'hdel'\r\n"
 		}
-		count := s.HDel(args[0], args[1:]...)
+		count, err := s.HDel(args[0], args[1:]...)
+		if err != nil {
+			return ErrorReply(err)
+		}
 		return fmt.Sprintf(":%d\r\n", count)
 
 	case "HEXISTS":
 		if len(args) != 2 {
 			return "-ERR wrong number of arguments for 'hexists'\r\n"
 		}
-		exists := s.HExists(args[0], args[1])
+		exists, err := s.HExists(args[0], args[1])
+		if err != nil {
+			return ErrorReply(err)
+		}
 		if exists {
 			return ":1\r\n"
 		}
@@ -481,6 +627,32 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		}
 		return ":0\r\n"
 
+	case "EXPIREAT":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'expireat'\r\n"
+		}
+		at, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if s.ExpireAt(args[0], at) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+
+	case "PEXPIREAT":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'pexpireat'\r\n"
+		}
+		at, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if s.PExpireAt(args[0], at) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+
 	case "TTL":
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'ttl'\r\n"
@@ -489,20 +661,50 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		return fmt.Sprintf(":%d\r\n", ttl)
 
 	case "SAVE":
-		err := s.LoadSnapshot("dump.rdb")
-		if err != nil {
-			log.Println(err)
+		if err := s.SaveSnapshot(s.DBFilename()); err != nil {
+			log.Println("[RDB] Save failed:", err)
+			if err == ErrBgsaveInProgress {
+				return ErrorReply(err)
+			}
 			return "-ERR failed to save snapshot\r\n"
 		}
 		return "+OK\r\n"
 
+	case "BGSAVE":
+		if len(args) > 1 || (len(args) == 1 && strings.ToUpper(args[0]) != "SCHEDULE") {
+			return "-ERR syntax error\r\n"
+		}
+		if err := s.BGSave(s.DBFilename()); err != nil {
+			return ErrorReply(err)
+		}
+		return "+Background saving started\r\n"
+
+	case "BGREWRITEAOF":
+		if err := s.BGRewriteAOF(); err != nil {
+			return ErrorReply(err)
+		}
+		return "+Background append only file rewriting started\r\n"
+
+	case "LASTSAVE":
+		return fmt.Sprintf(":%d\r\n", s.LastSave().Unix())
+
+	case "INFO":
+		info := s.Info(args...)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+
+	case "ROLE":
+		if len(args) != 0 {
+			return "-ERR wrong number of arguments for 'role'\r\n"
+		}
+		return s.roleReply()
+
 	case "INCR":
 		if len(args) != 1 {
 			return "-ERR wrong number of arguments for 'incr'\r\n"
 		}
 		n, err := s.Incr(args[0])
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return ErrorReply(err)
 		}
 		return fmt.Sprintf(":%d\r\n", n)
 
@@ -516,7 +718,7 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		}
 		n, err := s.HIncrBy(args[0], args[1], incr)
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return ErrorReply(err)
 		}
 		return fmt.Sprintf(":%d\r\n", n)
 
@@ -538,6 +740,45 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		}
 		return resp
 
+	case "SCAN":
+		if len(args) < 1 {
+			return "-ERR wrong number of arguments for 'scan'\r\n"
+		}
+		cursor, err := ParseCursor(args[0])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		opts, err := ParseScanArgs(args[1:])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		next, keys := s.Scan(cursor, opts)
+		return scanReply(next, keys)
+
+	case "SSCAN", "HSCAN":
+		if len(args) < 2 {
+			return fmt.Sprintf("-ERR wrong number of arguments for '%s'\r\n", strings.ToLower(cmd))
+		}
+		cursor, err := ParseCursor(args[1])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		opts, err := ParseScanArgs(args[2:])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		var next uint64
+		var items []string
+		if strings.ToUpper(cmd) == "SSCAN" {
+			next, items, err = s.SScan(args[0], cursor, opts)
+		} else {
+			next, items, err = s.HScan(args[0], cursor, opts)
+		}
+		if err != nil {
+			return ErrorReply(err)
+		}
+		return scanReply(next, items)
+
 	case "FLUSHALL":
 		s.FlushAll()
 		return "+OK\r\n"
@@ -548,7 +789,124 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		}
 		err := s.Rename(args[0], args[1])
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return ErrorReply(err)
+		}
+		return "+OK\r\n"
+
+	case "RENAMENX":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'renamenx'\r\n"
+		}
+		ok, err := s.RenameNX(args[0], args[1])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+
+	case "COPY":
+		if len(args) < 2 {
+			return "-ERR wrong number of arguments for 'copy'\r\n"
+		}
+		db, replace := 0, false
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "REPLACE":
+				replace = true
+			case "DB":
+				if i+1 >= len(args) {
+					return "-ERR syntax error\r\n"
+				}
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil {
+					return "-ERR invalid DB index\r\n"
+				}
+				db = n
+				i++
+			default:
+				return "-ERR syntax error\r\n"
+			}
+		}
+		ok, err := s.Copy(args[0], args[1], db, replace)
+		if err != nil {
+			return ErrorReply(err)
+		}
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+
+	case "UNLINK":
+		if len(args) < 1 {
+			return "-ERR wrong number of arguments for 'unlink'\r\n"
+		}
+		count := s.Unlink(args...)
+		return fmt.Sprintf(":%d\r\n", count)
+
+	case "TOUCH":
+		if len(args) < 1 {
+			return "-ERR wrong number of arguments for 'touch'\r\n"
+		}
+		count := s.Touch(args...)
+		return fmt.Sprintf(":%d\r\n", count)
+
+	case "RANDOMKEY":
+		key, ok := s.RandomKey()
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+
+	case "DBSIZE":
+		return fmt.Sprintf(":%d\r\n", s.DBSize())
+
+	case "SORT", "SORT_RO":
+		if len(args) < 1 {
+			return fmt.Sprintf("-ERR wrong number of arguments for '%s'\r\n", strings.ToLower(cmd))
+		}
+		opts, err := ParseSortArgs(args[1:], strings.ToUpper(cmd) == "SORT_RO")
+		if err != nil {
+			return ErrorReply(err)
+		}
+		result, err := s.Sort(args[0], opts)
+		if err != nil {
+			return ErrorReply(err)
+		}
+		if opts.Store != "" {
+			return fmt.Sprintf(":%d\r\n", len(result))
+		}
+		return sortReply(result)
+
+	case "DUMP":
+		if len(args) != 1 {
+			return "-ERR wrong number of arguments for 'dump'\r\n"
+		}
+		payload, ok, err := s.Dump(args[0])
+		if !ok {
+			return "$-1\r\n"
+		}
+		if err != nil {
+			return ErrorReply(err)
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(payload), payload)
+
+	case "RESTORE":
+		if len(args) < 3 {
+			return "-ERR wrong number of arguments for 'restore'\r\n"
+		}
+		ttl, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || ttl < 0 {
+			return "-ERR Invalid TTL value, must be >= 0\r\n"
+		}
+		opts, err := ParseRestoreArgs(args[3:])
+		if err != nil {
+			return ErrorReply(err)
+		}
+		err = s.Restore(args[0], ttl, []byte(args[2]), opts)
+		if err != nil {
+			return ErrorReply(err)
 		}
 		return "+OK\r\n"
 
@@ -562,29 +920,104 @@ func (s *MemoryStore) ExecuteRaw(cmd string, args []string) string {
 		}
 		err = s.Move(args[0], dbIndex)
 		if err != nil {
-			return "-ERR " + err.Error() + "\r\n"
+			return ErrorReply(err)
 		}
 		return ":1\r\n"
 
+	case "OBJECT":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'object'\r\n"
+		}
+		switch strings.ToUpper(args[0]) {
+		case "ENCODING":
+			enc, ok, err := s.ObjectEncoding(args[1])
+			if err != nil {
+				return ErrorReply(err)
+			}
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(enc), enc)
+		case "IDLETIME":
+			idle, ok := s.ObjectIdleTime(args[1])
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf(":%d\r\n", idle)
+		case "FREQ":
+			freq, ok := s.ObjectFreq(args[1])
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf(":%d\r\n", freq)
+		case "REFCOUNT":
+			refs, ok := s.ObjectRefCount(args[1])
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf(":%d\r\n", refs)
+		default:
+			return "-ERR unknown subcommand for 'object'\r\n"
+		}
+
+	case "CONFIG":
+		if len(args) < 2 {
+			return "-ERR wrong number of arguments for 'config'\r\n"
+		}
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			pairs := s.ConfigGet(args[1])
+			resp := fmt.Sprintf("*%d\r\n", len(pairs))
+			for _, v := range pairs {
+				resp += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+			return resp
+		case "SET":
+			if len(args) != 3 {
+				return "-ERR wrong number of arguments for 'config set'\r\n"
+			}
+			if err := s.ConfigSet(args[1], args[2]); err != nil {
+				return ErrorReply(err)
+			}
+			return "+OK\r\n"
+		default:
+			return "-ERR unknown subcommand for 'config'\r\n"
+		}
+
 	default:
 		return "-ERR unknown command\r\n"
 	}
 }
 
-func (s *MemoryStore) StartAutoSave(path string, interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		for range ticker.C {
-			if err := s.SaveSnapshot(path); err == nil {
-				log.Println("Snapshot saved.")
-			} else {
-				log.Println("Failed to save snapshot:", err)
-			}
-		}
-
-	}()
+// scanReply formats the two element cursor/items reply of the SCAN family.
+func scanReply(cursor uint64, items []string) string {
+	c := strconv.FormatUint(cursor, 10)
+	resp := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n", len(c), c, len(items))
+	for _, item := range items {
+		resp += fmt.Sprintf("$%d\r\n%s\r\n", len(item), item)
+	}
+	return resp
 }
 
-func (s *MemoryStore) SetAOF(aof *persistance.AOF) {
+func (s *MemoryStore) SetAOF(aof *persistance.AOF) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.aof = aof
+	aof.SetFeed(s.feedReplicas)
+	return s.applyAOFConfig()
+}
+
+// FlushAOF makes the commands logged so far reach the AOF according to
+// appendfsync. The server calls it before replying, outside s.mu, so
+// clients waiting for an fsync share it.
+func (s *MemoryStore) FlushAOF() error {
+	s.mu.Lock()
+	aof := s.aof
+	s.mu.Unlock()
+
+	if aof == nil {
+		return nil
+	}
+	return aof.Flush()
 }
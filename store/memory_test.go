@@ -0,0 +1,45 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestExecuteRawOddArguments runs every command with argument lists of
+// the wrong length or form, against each type of key. Nothing recovers
+// from a panic while serving a command, so each must reply.
+func TestExecuteRawOddArguments(t *testing.T) {
+	cmds := strings.Fields(`CONFIG COPY DBSIZE DEL DUMP EXISTS EXPIRE EXPIREAT
+		GET HDEL HEXISTS HGET HGETALL HINCRBY HSCAN HSET INCR INFO KEYS LASTSAVE
+		LPOP LPUSH LRANGE MOVE OBJECT PEXPIREAT PING RANDOMKEY RENAME RENAMENX
+		RESTORE ROLE RPOP RPUSH SADD SCAN SCARD SET SISMEMBER SMEMBERS SORT
+		SORT_RO SREM SSCAN SUNION TOUCH TTL TYPE UNLINK`)
+	argLists := [][]string{
+		{}, {"k"}, {"k", "x"}, {"k", "x", "y"}, {"k", "-1", "abc"}, {"k", "0", "-1"},
+		{"0"}, {"GET", "x"}, {"ENCODING", "k"}, {"FREQ", "k"}, {"k", "0", "\x00\x00"},
+		{"k", "9223372036854775807"}, {"k", "-9223372036854775808"},
+	}
+	setups := map[string][]string{
+		"none":   nil,
+		"string": {"SET", "k", "1"},
+		"list":   {"RPUSH", "k", "1"},
+		"set":    {"SADD", "k", "1"},
+		"hash":   {"HSET", "k", "x", "1"},
+	}
+	for typ, setup := range setups {
+		for _, cmd := range cmds {
+			for _, args := range argLists {
+				s := NewMemoryStoreWithAOF(nil)
+				if setup != nil {
+					run(t, s, setup[0], setup[1:]...)
+				}
+				// Twice, for commands that leave the key in a new state.
+				for i := 0; i < 2; i++ {
+					if reply := s.ExecuteRaw(cmd, args); reply == "" {
+						t.Errorf("%s %q on a %s key returned no reply", cmd, args, typ)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Initial LFU counter of new keys, so they are not evicted right away.
+const lfuInitVal = 5
+
+// accessInfo tracks how recently and how often a key was used.
+type accessInfo struct {
+	lastAccess int64 // unix milliseconds
+	freq       uint8 // logarithmic access counter
+	decayedAt  int64 // unix minutes of the last counter decay
+}
+
+// touch records an access to key. Callers must hold s.mu.
+func (s *MemoryStore) touch(key string) {
+	now := time.Now()
+	info, ok := s.access[key]
+	if !ok {
+		info = &accessInfo{freq: lfuInitVal, decayedAt: now.Unix() / 60}
+		s.access[key] = info
+	}
+	info.lastAccess = now.UnixMilli()
+	s.lfuDecay(info, now)
+	s.lfuIncr(info)
+}
+
+// lfuIncr increments the counter with a probability that shrinks as the
+// counter grows, so 255 is only reached after millions of accesses.
+func (s *MemoryStore) lfuIncr(info *accessInfo) {
+	if info.freq == 255 {
+		return
+	}
+	base := float64(info.freq) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	p := 1.0 / (base*float64(s.config.LFULogFactor) + 1)
+	if rand.Float64() < p {
+		info.freq++
+	}
+}
+
+// lfuDecay lowers the counter by one for every elapsed decay period.
+func (s *MemoryStore) lfuDecay(info *accessInfo, now time.Time) {
+	if s.config.LFUDecayTime <= 0 {
+		return
+	}
+	minutes := now.Unix()/60 - info.decayedAt
+	periods := minutes / int64(s.config.LFUDecayTime)
+	if periods <= 0 {
+		return
+	}
+	if periods >= int64(info.freq) {
+		info.freq = 0
+	} else {
+		info.freq -= uint8(periods)
+	}
+	info.decayedAt += periods * int64(s.config.LFUDecayTime)
+}
+
+func (s *MemoryStore) ObjectEncoding(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, err := s.value(key)
+	if val == nil || err != nil {
+		return "", false, err
+	}
+	return encodingOf(val), true, nil
+}
+
+// ObjectIdleTime returns the seconds since key was last accessed.
+func (s *MemoryStore) ObjectIdleTime(key string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[key]; !ok {
+		return 0, false
+	}
+	info, ok := s.access[key]
+	if !ok {
+		return 0, true
+	}
+	return (time.Now().UnixMilli() - info.lastAccess) / 1000, true
+}
+
+// ObjectFreq returns the logarithmic access frequency counter of key.
+func (s *MemoryStore) ObjectFreq(key string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[key]; !ok {
+		return 0, false
+	}
+	info, ok := s.access[key]
+	if !ok {
+		return lfuInitVal, true
+	}
+	s.lfuDecay(info, time.Now())
+	return int(info.freq), true
+}
+
+// ObjectRefCount always reports 1 since values are never shared.
+func (s *MemoryStore) ObjectRefCount(key string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[key]; !ok {
+		return 0, false
+	}
+	return 1, true
+}
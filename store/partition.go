@@ -37,7 +37,7 @@ func (pm *PartitionManager) Set(key, value string) {
 	pm.getParition(key).Set(key, value)
 }
 
-func (pm *PartitionManager) Get(key string) (string, bool) {
+func (pm *PartitionManager) Get(key string) (string, bool, error) {
 	return pm.getParition(key).Get(key)
 }
 
@@ -106,17 +106,22 @@ func (pm *PartitionManager) Rename(oldKey, newKey string) error {
 	// Cross partition re-name
 	oldParitition.mu.RLock()
 	val, ok := oldParitition.data[oldKey]
+	expireAt, hasTTL := oldParitition.expiration[oldKey]
 	oldParitition.mu.RUnlock()
 	if !ok {
 		return fmt.Errorf("no such key")
 	}
 
 	newPartition.mu.Lock()
-	newPartition.data[newKey] = val
+	newPartition.removeKey(newKey)
+	newPartition.setValue(newKey, val)
+	if hasTTL {
+		newPartition.expiration[newKey] = expireAt
+	}
 	newPartition.mu.Unlock()
 
 	oldParitition.mu.Lock()
-	delete(oldParitition.data, oldKey)
+	oldParitition.removeKey(oldKey)
 	oldParitition.mu.Unlock()
 
 	// AOF logging
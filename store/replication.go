@@ -0,0 +1,585 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+// Replication: a master passes every command it appends to the AOF on to
+// its replicas, as the same RESP stream. A replica first receives a
+// snapshot of the dataset taken when it connected (a full sync), then the
+// commands appended from that moment on, which it applies and passes on
+// to its own replicas in turn. The networking lives in the server
+// package; the store keeps the state INFO replication and ROLE report.
+//
+// A stream is named by a replication ID and its bytes are numbered by
+// offset, the same on the master and every replica of it. The last bytes
+// are kept in a backlog, so a replica that reconnects with the ID and the
+// offset it got to is sent what it missed (a partial resync) instead of a
+// new snapshot. A replica promoted to master starts a new ID but still
+// accepts the old one up to the offset it was promoted at, so the other
+// replicas of its old master can follow it without a full sync.
+const (
+	// The master pings its replicas this often, so they can tell an idle
+	// master from a broken link.
+	replPingPeriod = 10 * time.Second
+	// A replica whose unsent stream grows past this is disconnected; it
+	// will have to sync again.
+	replicaOutputLimit = 256 << 20
+)
+
+var (
+	ErrReadOnly      = errors.New("READONLY You can't write against a read only replica.")
+	errReplicaClosed = errors.New("replica disconnected")
+)
+
+// Replica is a replica connected to this server, as the master sees it.
+type Replica struct {
+	Addr string // IP address of the replica
+	Port int    // port it listens on, from REPLCONF listening-port
+
+	repl      *replication
+	state     string // "wait_bgsave", "send_bulk" or "online"
+	buf       []byte // stream not sent yet
+	ackOffset int64  // from REPLCONF ACK
+	lastAck   time.Time
+	closed    bool
+}
+
+// replication is the replication state of a store. It has its own lock
+// because the AOF feeds it with its lock held, which callers of the AOF
+// may also hold s.mu for.
+type replication struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// streamMu is held by the master link while it applies a command and
+	// passes it on, so a full sync of a replica of this replica starts
+	// between two commands rather than in the middle of one.
+	streamMu sync.Mutex
+
+	masterHost string // empty on a master
+	masterPort int
+	linkState  string // "connect", "connecting", "sync" or "connected"
+	lastIO     time.Time
+	replicas   map[*Replica]struct{}
+	syncs      int // full syncs served, which names their snapshot files
+	lastPing   time.Time
+
+	replID       string
+	replID2      string // the ID before the last promotion, accepted up to secondOffset
+	secondOffset int64  // -1 without replID2
+	offset       int64  // bytes of stream produced, or received from the master
+	backlog      *backlog
+	backlogSize  int64
+}
+
+func newReplication() *replication {
+	r := &replication{
+		replicas:     make(map[*Replica]struct{}),
+		replID:       newReplID(),
+		replID2:      noReplID,
+		secondOffset: -1,
+		backlogSize:  DefaultConfig().ReplBacklogSize,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// noReplID stands for no replication ID in INFO, as in Redis.
+const noReplID = "0000000000000000000000000000000000000000"
+
+// newReplID returns a random replication ID of 40 hex digits.
+func newReplID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalln("[REPL] Can't generate a replication ID:", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// feed appends line to the stream of every replica. Callers must hold
+// r.mu.
+func (r *replication) feed(line string) {
+	r.offset += int64(len(line))
+	if r.backlog != nil {
+		r.backlog.write(line)
+	}
+	for replica := range r.replicas {
+		if replica.closed {
+			continue
+		}
+		replica.buf = append(replica.buf, line...)
+		if len(replica.buf) > replicaOutputLimit {
+			log.Printf("[REPL] Disconnecting replica %s:%d, its output buffer is over %d bytes", replica.Addr, replica.Port, replicaOutputLimit)
+			replica.closed = true
+		}
+	}
+	r.cond.Broadcast()
+}
+
+// createBacklog starts keeping the stream from now on, if not done yet.
+// Callers must hold r.mu.
+func (r *replication) createBacklog() {
+	if r.backlog == nil {
+		r.backlog = newBacklog(r.backlogSize, r.offset)
+	}
+}
+
+// setBacklogSize applies repl-backlog-size. A backlog of another size
+// starts over empty. Callers must hold r.mu.
+func (r *replication) setBacklogSize(size int64) {
+	if size == r.backlogSize {
+		return
+	}
+	r.backlogSize = size
+	if r.backlog != nil {
+		r.backlog = newBacklog(size, r.offset)
+	}
+}
+
+// newStream is the replication ID and offset of a dataset loaded from a
+// master. The backlog of the previous stream is useless. Callers must hold
+// r.mu.
+func (r *replication) newStream(replID string, offset int64) {
+	r.replID, r.replID2, r.secondOffset = replID, noReplID, -1
+	r.offset = offset
+	r.backlog = newBacklog(r.backlogSize, offset)
+}
+
+// shiftReplID starts a new replication ID, keeping the current one as
+// the second ID for replicas that got the stream up to now. Callers must
+// hold r.mu.
+func (r *replication) shiftReplID() {
+	r.replID2, r.secondOffset = r.replID, r.offset+1
+	r.replID = newReplID()
+}
+
+// dropReplicas disconnects every replica. Callers must hold r.mu.
+func (r *replication) dropReplicas() {
+	for replica := range r.replicas {
+		replica.closed = true
+		delete(r.replicas, replica)
+	}
+	r.cond.Broadcast()
+}
+
+// feedReplicas is the feed of the AOF. Only a master produces a stream; a
+// replica passes on the one of its master instead.
+func (s *MemoryStore) feedReplicas(line string) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if s.repl.masterHost == "" {
+		s.repl.feed(line)
+	}
+}
+
+// replicationDaemon pings the replicas while there are any.
+func (s *MemoryStore) replicationDaemon() {
+	const ping = "*1\r\n$4\r\nPING\r\n"
+	ticker := time.NewTicker(time.Second)
+	for range ticker.C {
+		s.repl.mu.Lock()
+		if s.repl.masterHost == "" && len(s.repl.replicas) > 0 && time.Since(s.repl.lastPing) >= replPingPeriod {
+			s.repl.feed(ping)
+			s.repl.lastPing = time.Now()
+		}
+		s.repl.mu.Unlock()
+	}
+}
+
+// AddReplica registers a replica that asked for a full sync. It gets no
+// stream until ReplicaSnapshot takes its snapshot.
+func (s *MemoryStore) AddReplica(addr string, port int) *Replica {
+	return &Replica{Addr: addr, Port: port, repl: s.repl, state: "wait_bgsave", lastAck: time.Now()}
+}
+
+// ReplicaSnapshot writes the snapshot for the full sync of replica to a
+// file and returns its path, with the replication ID and offset the
+// snapshot is at; the caller sends and removes the file. The stream of
+// the replica starts with the first command after the snapshot. Like
+// BGSAVE the snapshot is written in the background of other commands, and
+// if a background save or AOF rewrite is running it waits for it.
+func (s *MemoryStore) ReplicaSnapshot(replica *Replica) (string, string, int64, error) {
+	for {
+		s.repl.streamMu.Lock()
+		s.mu.Lock()
+		if s.bgsave == nil {
+			break
+		}
+		s.mu.Unlock()
+		s.repl.streamMu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	save := s.startBackground(false)
+	// Replicas can't be expected to have the key file, and don't need
+	// older snapshots.
+	opts := persistance.RDBOptions{Compression: s.config.RDBCompression}
+	s.repl.mu.Lock()
+	s.repl.syncs++
+	path := fmt.Sprintf("temp-repl-%d-%d.rdb", os.Getpid(), s.repl.syncs)
+	replID, offset := s.repl.replID, s.repl.offset
+	replica.ackOffset = offset
+	s.repl.replicas[replica] = struct{}{}
+	s.repl.createBacklog()
+	s.repl.mu.Unlock()
+	s.mu.Unlock()
+	s.repl.streamMu.Unlock()
+
+	log.Printf("[REPL] Starting full sync of replica %s:%d", replica.Addr, replica.Port)
+	err := writeSnapshot(path, 1, opts, save.data, save.expiration)
+
+	s.mu.Lock()
+	s.finishBackground()
+	s.mu.Unlock()
+
+	if err != nil {
+		s.RemoveReplica(replica)
+		return "", "", 0, err
+	}
+	s.repl.mu.Lock()
+	replica.state = "send_bulk"
+	s.repl.mu.Unlock()
+	return path, replID, offset, nil
+}
+
+// PartialSync serves PSYNC replID offset for replica without a snapshot
+// if it can: when the stream the replica has is the one of this server,
+// or its history before the last promotion, and the backlog still holds
+// everything from offset on. The replica is then registered with the
+// missing bytes as its first stream, and the current replication ID is
+// returned. As in Redis, offset is the first byte the replica lacks,
+// counting from 1.
+func (s *MemoryStore) PartialSync(replica *Replica, replID string, offset int64) (string, bool) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if replID != s.repl.replID && (replID != s.repl.replID2 || offset > s.repl.secondOffset) {
+		return "", false
+	}
+	if s.repl.backlog == nil {
+		return "", false
+	}
+	missing, ok := s.repl.backlog.from(offset - 1)
+	if !ok {
+		return "", false
+	}
+	replica.buf = missing
+	replica.ackOffset = offset - 1
+	replica.state = "online"
+	s.repl.replicas[replica] = struct{}{}
+	return s.repl.replID, true
+}
+
+// Online marks the snapshot as sent.
+func (r *Replica) Online() {
+	r.repl.mu.Lock()
+	defer r.repl.mu.Unlock()
+
+	r.state = "online"
+	r.lastAck = time.Now()
+}
+
+// Next waits for stream to send to the replica and returns it. It fails
+// once the replica is disconnected.
+func (r *Replica) Next() ([]byte, error) {
+	r.repl.mu.Lock()
+	defer r.repl.mu.Unlock()
+
+	for len(r.buf) == 0 && !r.closed {
+		r.repl.cond.Wait()
+	}
+	if r.closed {
+		return nil, errReplicaClosed
+	}
+	buf := r.buf
+	r.buf = nil
+	return buf, nil
+}
+
+// Ack records the offset a replica reported with REPLCONF ACK.
+func (r *Replica) Ack(offset int64) {
+	r.repl.mu.Lock()
+	defer r.repl.mu.Unlock()
+
+	r.ackOffset = offset
+	r.lastAck = time.Now()
+}
+
+// RemoveReplica forgets a replica that disconnected.
+func (s *MemoryStore) RemoveReplica(replica *Replica) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	replica.closed = true
+	delete(s.repl.replicas, replica)
+	s.repl.cond.Broadcast()
+}
+
+// SetMaster makes the store a replica of host:port, or a master again if
+// host is empty. A master that becomes a replica disconnects its replicas,
+// which then follow the stream it gets from its master. A replica that
+// becomes a master keeps them and continues their stream under a new
+// replication ID.
+func (s *MemoryStore) SetMaster(host string, port int) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if host != "" && s.repl.masterHost == "" {
+		s.repl.dropReplicas()
+	}
+	if host == "" && s.repl.masterHost != "" {
+		s.repl.shiftReplID()
+		s.repl.createBacklog()
+	}
+	s.repl.masterHost, s.repl.masterPort = host, port
+	s.repl.linkState = "connect"
+	if host == "" {
+		s.repl.linkState = ""
+	}
+}
+
+// Master returns the master of a replica, or an empty host on a master.
+func (s *MemoryStore) Master() (string, int) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	return s.repl.masterHost, s.repl.masterPort
+}
+
+// SetMasterLinkState records the progress of the link to the master.
+func (s *MemoryStore) SetMasterLinkState(state string) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if s.repl.masterHost != "" {
+		s.repl.linkState = state
+	}
+}
+
+// PSyncArgs returns the arguments of PSYNC for a link to a master: the
+// replication ID and offset of the stream this server has, its own if it
+// was a master, and the first byte it lacks as the offset.
+func (s *MemoryStore) PSyncArgs() (string, int64) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	return s.repl.replID, s.repl.offset + 1
+}
+
+// ContinueReplication takes on the replication ID of a master that
+// accepted a partial resync. A master promoted since the last sync has a
+// new ID, which the replicas of this replica then need to know too; they
+// are disconnected and resync partially.
+func (s *MemoryStore) ContinueReplication(replID string) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	s.repl.lastIO = time.Now()
+	s.repl.createBacklog()
+	if replID == "" || replID == s.repl.replID {
+		return
+	}
+	s.repl.shiftReplID()
+	s.repl.replID = replID
+	s.repl.dropReplicas()
+}
+
+// LoadReplicaSnapshot replaces the dataset by the snapshot of a full sync,
+// which is at offset of the stream replID, and starts a new AOF holding
+// it. The replicas of this replica are disconnected; they have to sync
+// again.
+func (s *MemoryStore) LoadReplicaSnapshot(path, replID string, offset int64) error {
+	snap, err := persistance.LoadRDB(path, nil)
+	if err != nil {
+		return err
+	}
+
+	s.repl.streamMu.Lock()
+	s.mu.Lock()
+	err = s.loadEntries(snap.Entries)
+	s.repl.mu.Lock()
+	s.repl.dropReplicas()
+	s.repl.newStream(replID, offset)
+	s.repl.lastIO = time.Now()
+	s.repl.mu.Unlock()
+	s.mu.Unlock()
+	s.repl.streamMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.rewriteAOFAfterSync()
+}
+
+// rewriteAOFAfterSync rewrites the AOF from the dataset loaded by a full
+// sync, waiting for a running background save or rewrite first; the
+// commands logged before the sync don't lead to that dataset.
+func (s *MemoryStore) rewriteAOFAfterSync() error {
+	for {
+		s.mu.Lock()
+		aof, busy := s.aof, s.bgsave != nil
+		s.mu.Unlock()
+		if aof == nil {
+			return nil
+		}
+		if !busy {
+			if err := s.RewriteAOF(); err == nil || !s.backgroundRunning() {
+				return err
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *MemoryStore) backgroundRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bgsave != nil
+}
+
+// ApplyFromMaster executes a command of the master's stream, raw being the
+// command as received, and passes it on to the replicas of this replica.
+func (s *MemoryStore) ApplyFromMaster(cmd string, args []string, raw string) {
+	s.repl.streamMu.Lock()
+	defer s.repl.streamMu.Unlock()
+
+	s.ExecuteRaw(cmd, args)
+	s.repl.mu.Lock()
+	s.repl.feed(raw)
+	s.repl.lastIO = time.Now()
+	s.repl.mu.Unlock()
+}
+
+// ReplicationOffset returns the offset of the stream: produced so far on a
+// master, received so far on a replica.
+func (s *MemoryStore) ReplicationOffset() int64 {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	return s.repl.offset
+}
+
+// checkReadOnly returns ErrReadOnly for writes to a read-only replica.
+// Callers must hold s.mu.
+func (s *MemoryStore) checkReadOnly() error {
+	if !s.config.ReplicaReadOnly {
+		return nil
+	}
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if s.repl.masterHost != "" {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// isReplica reports whether the store replicates a master.
+func (s *MemoryStore) isReplica() bool {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	return s.repl.masterHost != ""
+}
+
+// roleReply is the reply to ROLE.
+func (s *MemoryStore) roleReply() string {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if s.repl.masterHost != "" {
+		state := s.repl.linkState
+		return fmt.Sprintf("*5\r\n$5\r\nslave\r\n$%d\r\n%s\r\n:%d\r\n$%d\r\n%s\r\n:%d\r\n",
+			len(s.repl.masterHost), s.repl.masterHost, s.repl.masterPort, len(state), state, s.repl.offset)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*3\r\n$6\r\nmaster\r\n:%d\r\n*%d\r\n", s.repl.offset, len(s.repl.replicas))
+	for _, replica := range s.sortedReplicas() {
+		port := strconv.Itoa(replica.Port)
+		offset := strconv.FormatInt(replica.ackOffset, 10)
+		fmt.Fprintf(&b, "*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+			len(replica.Addr), replica.Addr, len(port), port, len(offset), offset)
+	}
+	return b.String()
+}
+
+// sortedReplicas returns the replicas by address, so INFO and ROLE list
+// them in a stable order. Callers must hold s.repl.mu.
+func (s *MemoryStore) sortedReplicas() []*Replica {
+	replicas := make([]*Replica, 0, len(s.repl.replicas))
+	for replica := range s.repl.replicas {
+		replicas = append(replicas, replica)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		if replicas[i].Addr != replicas[j].Addr {
+			return replicas[i].Addr < replicas[j].Addr
+		}
+		return replicas[i].Port < replicas[j].Port
+	})
+	return replicas
+}
+
+func (s *MemoryStore) infoReplication(b *strings.Builder) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if s.repl.masterHost == "" {
+		fmt.Fprintf(b, "role:master\r\n")
+	} else {
+		linkStatus, syncing := "down", 0
+		if s.repl.linkState == "connected" {
+			linkStatus = "up"
+		}
+		if s.repl.linkState == "sync" {
+			syncing = 1
+		}
+		lastIO := int64(-1)
+		if !s.repl.lastIO.IsZero() {
+			lastIO = int64(time.Since(s.repl.lastIO).Seconds())
+		}
+		readOnly := 0
+		if s.config.ReplicaReadOnly {
+			readOnly = 1
+		}
+		fmt.Fprintf(b, "role:slave\r\n")
+		fmt.Fprintf(b, "master_host:%s\r\n", s.repl.masterHost)
+		fmt.Fprintf(b, "master_port:%d\r\n", s.repl.masterPort)
+		fmt.Fprintf(b, "master_link_status:%s\r\n", linkStatus)
+		fmt.Fprintf(b, "master_last_io_seconds_ago:%d\r\n", lastIO)
+		fmt.Fprintf(b, "master_sync_in_progress:%d\r\n", syncing)
+		fmt.Fprintf(b, "slave_repl_offset:%d\r\n", s.repl.offset)
+		fmt.Fprintf(b, "slave_read_only:%d\r\n", readOnly)
+	}
+	fmt.Fprintf(b, "connected_slaves:%d\r\n", len(s.repl.replicas))
+	for i, replica := range s.sortedReplicas() {
+		fmt.Fprintf(b, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n", i, replica.Addr, replica.Port,
+			replica.state, replica.ackOffset, int64(time.Since(replica.lastAck).Seconds()))
+	}
+	fmt.Fprintf(b, "master_replid:%s\r\n", s.repl.replID)
+	fmt.Fprintf(b, "master_replid2:%s\r\n", s.repl.replID2)
+	fmt.Fprintf(b, "master_repl_offset:%d\r\n", s.repl.offset)
+	fmt.Fprintf(b, "second_repl_offset:%d\r\n", s.repl.secondOffset)
+	if s.repl.backlog == nil {
+		fmt.Fprintf(b, "repl_backlog_active:0\r\n")
+		fmt.Fprintf(b, "repl_backlog_size:%d\r\n", s.repl.backlogSize)
+		fmt.Fprintf(b, "repl_backlog_first_byte_offset:0\r\n")
+		fmt.Fprintf(b, "repl_backlog_histlen:0\r\n")
+		return
+	}
+	fmt.Fprintf(b, "repl_backlog_active:1\r\n")
+	fmt.Fprintf(b, "repl_backlog_size:%d\r\n", len(s.repl.backlog.buf))
+	fmt.Fprintf(b, "repl_backlog_first_byte_offset:%d\r\n", s.repl.backlog.start+1)
+	fmt.Fprintf(b, "repl_backlog_histlen:%d\r\n", s.repl.backlog.end-s.repl.backlog.start)
+}
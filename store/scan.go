@@ -0,0 +1,258 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const (
+	minIndexBuckets  = 4
+	defaultScanCount = 10
+)
+
+// keyIndex mirrors a set of keys in power-of-two hash buckets so they can
+// be walked incrementally with a reverse binary cursor, like Redis' dictScan.
+// A key present for the whole iteration is returned at least once even if
+// the index grows or shrinks between calls.
+type keyIndex struct {
+	buckets [][]string
+	count   int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		buckets: make([][]string, minIndexBuckets),
+	}
+}
+
+func (ix *keyIndex) mask() uint64 {
+	return uint64(len(ix.buckets) - 1)
+}
+
+func (ix *keyIndex) add(key string) {
+	b := uint64(hashKey(key)) & ix.mask()
+	ix.buckets[b] = append(ix.buckets[b], key)
+	ix.count++
+	if ix.count > len(ix.buckets) {
+		ix.resize(len(ix.buckets) * 2)
+	}
+}
+
+func (ix *keyIndex) remove(key string) {
+	b := uint64(hashKey(key)) & ix.mask()
+	bucket := ix.buckets[b]
+	for i, k := range bucket {
+		if k == key {
+			bucket[i] = bucket[len(bucket)-1]
+			ix.buckets[b] = bucket[:len(bucket)-1]
+			ix.count--
+			break
+		}
+	}
+	if len(ix.buckets) > minIndexBuckets && ix.count < len(ix.buckets)/8 {
+		ix.resize(len(ix.buckets) / 2)
+	}
+}
+
+func (ix *keyIndex) resize(size int) {
+	old := ix.buckets
+	ix.buckets = make([][]string, size)
+	for _, bucket := range old {
+		for _, key := range bucket {
+			b := uint64(hashKey(key)) & ix.mask()
+			ix.buckets[b] = append(ix.buckets[b], key)
+		}
+	}
+}
+
+// scan visits the bucket addressed by cursor and returns the next cursor,
+// which is 0 once the whole index has been walked.
+func (ix *keyIndex) scan(cursor uint64, fn func(key string)) uint64 {
+	mask := ix.mask()
+	for _, key := range ix.buckets[cursor&mask] {
+		fn(key)
+	}
+
+	// Increment the reversed cursor so that growing or shrinking the
+	// table between calls never skips a bucket.
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// scanIndex walks ix from cursor until count keys were collected or the
+// iteration ends, bounding the number of buckets visited.
+func scanIndex(ix *keyIndex, cursor uint64, count int, fn func(key string)) uint64 {
+	seen := 0
+	maxBuckets := math.MaxInt
+	if count < math.MaxInt/10 {
+		maxBuckets = count * 10
+	}
+	for {
+		cursor = ix.scan(cursor, func(key string) {
+			seen++
+			fn(key)
+		})
+		maxBuckets--
+		if cursor == 0 || seen >= count || maxBuckets <= 0 {
+			return cursor
+		}
+	}
+}
+
+type ScanOptions struct {
+	Match    string
+	Count    int
+	Type     string
+	NoValues bool
+}
+
+// ParseScanArgs parses the MATCH, COUNT, TYPE and NOVALUES options shared
+// by the SCAN family.
+func ParseScanArgs(args []string) (ScanOptions, error) {
+	opts := ScanOptions{Count: defaultScanCount}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			opts.Match = args[i+1]
+			i++
+		case "COUNT":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return opts, errors.New("value is not an integer or out of range")
+			}
+			if n < 1 {
+				return opts, errors.New("syntax error")
+			}
+			opts.Count = n
+			i++
+		case "TYPE":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			opts.Type = strings.ToLower(args[i+1])
+			i++
+		case "NOVALUES":
+			opts.NoValues = true
+		default:
+			return opts, errors.New("syntax error")
+		}
+	}
+	return opts, nil
+}
+
+func ParseCursor(s string) (uint64, error) {
+	cursor, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+func scanMatch(pattern, s string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	return MatchPattern(pattern, s)
+}
+
+func (s *MemoryStore) Scan(cursor uint64, opts ScanOptions) (uint64, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// COUNT is only a hint, so it can't size the result on its own.
+	keys := make([]string, 0, min(opts.Count, s.keys.count))
+	next := scanIndex(s.keys, cursor, opts.Count, func(key string) {
+		if s.isExpired(key) || !scanMatch(opts.Match, key) {
+			return
+		}
+		if opts.Type != "" && typeOf(s.data[key]) != opts.Type {
+			return
+		}
+		keys = append(keys, key)
+	})
+	return next, keys
+}
+
+func (s *MemoryStore) SScan(key string, cursor uint64, opts ScanOptions) (uint64, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, err := s.value(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if val == nil {
+		return 0, []string{}, nil
+	}
+	set, ok := val.(setObject)
+	if !ok {
+		return 0, nil, errWrongType
+	}
+	s.touch(key)
+
+	members := make([]string, 0)
+	collect := func(member string) {
+		if scanMatch(opts.Match, member) {
+			members = append(members, member)
+		}
+	}
+
+	// Compact encodings are small enough to return in a single call.
+	table, ok := set.(*setTable)
+	if !ok {
+		set.forEach(collect)
+		return 0, members, nil
+	}
+	next := scanIndex(table.index, cursor, opts.Count, collect)
+	return next, members, nil
+}
+
+func (s *MemoryStore) HScan(key string, cursor uint64, opts ScanOptions) (uint64, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, err := s.value(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if val == nil {
+		return 0, []string{}, nil
+	}
+	hash, ok := val.(hashObject)
+	if !ok {
+		return 0, nil, errWrongType
+	}
+	s.touch(key)
+
+	result := make([]string, 0)
+	collect := func(field, value string) {
+		if !scanMatch(opts.Match, field) {
+			return
+		}
+		result = append(result, field)
+		if !opts.NoValues {
+			result = append(result, value)
+		}
+	}
+
+	table, ok := hash.(*hashTable)
+	if !ok {
+		hash.forEach(collect)
+		return 0, result, nil
+	}
+	next := scanIndex(table.index, cursor, opts.Count, func(field string) {
+		collect(field, table.entries[field])
+	})
+	return next, result, nil
+}
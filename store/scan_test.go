@@ -0,0 +1,204 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scanAll runs a full SCAN with opts, calling between after every call
+// but the last, and returns how often each key was returned.
+func scanAll(t *testing.T, s *MemoryStore, opts ScanOptions, between func(call int)) map[string]int {
+	t.Helper()
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for call := 0; ; call++ {
+		if call > 100000 {
+			t.Fatal("SCAN did not terminate")
+		}
+		var keys []string
+		cursor, keys = s.Scan(cursor, opts)
+		for _, key := range keys {
+			seen[key]++
+		}
+		if cursor == 0 {
+			return seen
+		}
+		if between != nil {
+			between(call)
+		}
+	}
+}
+
+func setKeys(s *MemoryStore, prefix string, n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = prefix + strconv.Itoa(i)
+		s.Set(keys[i], "v")
+	}
+	return keys
+}
+
+func checkScanned(t *testing.T, seen map[string]int, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		if seen[key] == 0 {
+			t.Errorf("key %s was present for the whole scan but never returned", key)
+		}
+	}
+}
+
+func TestScanReturnsEveryKey(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	keys := setKeys(s, "k", 1000)
+	seen := scanAll(t, s, ScanOptions{Count: 7}, nil)
+	checkScanned(t, seen, keys)
+	if len(seen) != len(keys) {
+		t.Errorf("SCAN returned %d distinct keys, want %d", len(seen), len(keys))
+	}
+}
+
+func TestScanWhileGrowing(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	keys := setKeys(s, "k", 100)
+	added := 0
+	seen := scanAll(t, s, ScanOptions{Count: 5}, func(call int) {
+		// Grow the table several times over early in the scan.
+		if call >= 10 {
+			return
+		}
+		for i := 0; i < 50; i++ {
+			s.Set("new"+strconv.Itoa(added), "v")
+			added++
+		}
+	})
+	if len(s.keys.buckets) < 16*minIndexBuckets {
+		t.Fatalf("index has %d buckets, want the scan to have grown it", len(s.keys.buckets))
+	}
+	checkScanned(t, seen, keys)
+}
+
+func TestScanWhileShrinking(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	keys := setKeys(s, "k", 50)
+	doomed := setKeys(s, "doomed", 2000)
+	before := len(s.keys.buckets)
+	seen := scanAll(t, s, ScanOptions{Count: 20}, func(call int) {
+		for i := 0; i < 200 && len(doomed) > 0; i++ {
+			run(t, s, "DEL", doomed[len(doomed)-1])
+			doomed = doomed[:len(doomed)-1]
+		}
+	})
+	if len(s.keys.buckets) >= before {
+		t.Fatalf("index has %d buckets, want the scan to have shrunk it from %d", len(s.keys.buckets), before)
+	}
+	checkScanned(t, seen, keys)
+}
+
+func TestScanFilters(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.Set("user:1", "a")
+	s.Set("user:2", "b")
+	s.Set("session:1", "c")
+	run(t, s, "RPUSH", "user:list", "x")
+	run(t, s, "SADD", "user:set", "x")
+	run(t, s, "HSET", "user:hash", "f", "v")
+
+	tests := []struct {
+		opts ScanOptions
+		want string
+	}{
+		{ScanOptions{Count: 10}, "session:1 user:1 user:2 user:hash user:list user:set"},
+		{ScanOptions{Count: 10, Match: "user:*"}, "user:1 user:2 user:hash user:list user:set"},
+		{ScanOptions{Count: 10, Match: "user:?"}, "user:1 user:2"},
+		{ScanOptions{Count: 10, Match: "nothing*"}, ""},
+		{ScanOptions{Count: 10, Type: "string"}, "session:1 user:1 user:2"},
+		{ScanOptions{Count: 10, Type: "list"}, "user:list"},
+		{ScanOptions{Count: 10, Type: "set"}, "user:set"},
+		{ScanOptions{Count: 10, Type: "hash"}, "user:hash"},
+		{ScanOptions{Count: 10, Type: "zset"}, ""},
+		{ScanOptions{Count: 10, Match: "user:*", Type: "string"}, "user:1 user:2"},
+	}
+	for _, tc := range tests {
+		seen := scanAll(t, s, tc.opts, nil)
+		keys := make([]string, 0, len(seen))
+		for key := range seen {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if got := strings.Join(keys, " "); got != tc.want {
+			t.Errorf("SCAN MATCH %q TYPE %q = %q, want %q", tc.opts.Match, tc.opts.Type, got, tc.want)
+		}
+	}
+}
+
+func TestScanSkipsExpiredKeys(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.Set("live", "v")
+	s.Set("dead", "v")
+	s.expiration["dead"] = 1
+	seen := scanAll(t, s, ScanOptions{Count: 10}, nil)
+	if seen["dead"] != 0 || seen["live"] != 1 {
+		t.Errorf("SCAN returned %v, want only live", seen)
+	}
+}
+
+func TestScanHugeCount(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	keys := setKeys(s, "k", 100)
+	cursor, got := s.Scan(0, ScanOptions{Count: math.MaxInt})
+	if cursor != 0 || len(got) != len(keys) {
+		t.Errorf("SCAN COUNT MaxInt = cursor %d with %d keys, want 0 with %d", cursor, len(got), len(keys))
+	}
+	if reply := s.ExecuteRaw("SCAN", []string{"0", "COUNT", strconv.Itoa(math.MaxInt)}); !strings.HasPrefix(reply, "*2\r\n$1\r\n0\r\n") {
+		t.Errorf("SCAN 0 COUNT MaxInt = %.40q..., want a complete iteration", reply)
+	}
+}
+
+func TestSScanAndHScan(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	for i := 0; i < 300; i++ {
+		n := strconv.Itoa(i)
+		run(t, s, "SADD", "set", "m"+n)
+		run(t, s, "HSET", "hash", "f"+n, "v"+n)
+	}
+
+	members := make(map[string]bool)
+	for cursor, first := uint64(0), true; first || cursor != 0; first = false {
+		var got []string
+		var err error
+		cursor, got, err = s.SScan("set", cursor, ScanOptions{Count: 10, Match: "m1*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range got {
+			members[m] = true
+		}
+	}
+	// m1, m10-m19 and m100-m199.
+	if len(members) != 111 {
+		t.Errorf("SSCAN MATCH m1* returned %d members, want 111", len(members))
+	}
+
+	fields := make(map[string]string)
+	for cursor, first := uint64(0), true; first || cursor != 0; first = false {
+		var got []string
+		var err error
+		cursor, got, err = s.HScan("hash", cursor, ScanOptions{Count: 10, Match: "f2?"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(got); i += 2 {
+			fields[got[i]] = got[i+1]
+		}
+	}
+	if len(fields) != 10 || fields["f25"] != "v25" {
+		t.Errorf("HSCAN MATCH f2? = %v, want the 10 fields f20-f29 with values", fields)
+	}
+
+	if _, _, err := s.SScan("hash", 0, ScanOptions{Count: 10}); err == nil {
+		t.Error("SSCAN of a hash succeeded, want a WRONGTYPE error")
+	}
+}
@@ -1,111 +1,130 @@
 package store
 
-func (s *MemoryStore) getSet(key string) (map[string]struct{}, bool) {
-	val, ok := s.data[key]
-	if !ok {
-		return nil, false
+func (s *MemoryStore) getSet(key string) (setObject, bool, error) {
+	val, err := s.value(key)
+	if val == nil || err != nil {
+		return nil, false, err
 	}
-	set, ok := val.(map[string]struct{})
-	return set, ok
+	set, ok := val.(setObject)
+	return set, ok, nil
 }
 
-func (s *MemoryStore) SAdd(key string, members ...string) int {
+func (s *MemoryStore) SAdd(key string, members ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, _ := s.getSet(key)
+	s.ownValue(key)
+	set, _, err := s.getSet(key)
+	if err != nil {
+		return 0, err
+	}
 	if set == nil {
-		set = make(map[string]struct{})
+		set = &intset{}
 	}
 	added := 0
 	for _, m := range members {
-		if _, exists := set[m]; !exists {
-			set[m] = struct{}{}
+		set = s.setForInsert(set, m)
+		if set.insert(m) {
 			added++
 		}
 	}
-	s.data[key] = set
+	s.setValue(key, set)
+	s.touch(key)
 
-	return added
+	if s.aof != nil && added > 0 {
+		_ = s.aof.AppendCommand("SADD", append([]string{key}, members...)...)
+	}
+	return added, nil
 }
 
-func (s *MemoryStore) SRem(key string, members ...string) int {
+func (s *MemoryStore) SRem(key string, members ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, ok := s.getSet(key)
+	s.ownValue(key)
+	set, ok, err := s.getSet(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	removed := 0
 	for _, m := range members {
-		if _, exists := set[m]; exists {
-			delete(set, m)
-			removed--
+		if set.remove(m) {
+			removed++
 		}
 	}
 
-	s.data[key] = set
-	return removed
+	s.setValue(key, set)
+	s.touch(key)
+
+	if s.aof != nil && removed > 0 {
+		_ = s.aof.AppendCommand("SREM", append([]string{key}, members...)...)
+	}
+	return removed, nil
 }
 
-func (s *MemoryStore) SIsMember(key, member string) bool {
+func (s *MemoryStore) SIsMember(key, member string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, ok := s.getSet(key)
+	set, ok, err := s.getSet(key)
 	if !ok {
-		return false
+		return false, err
 	}
+	s.touch(key)
 
-	_, exists := set[member]
-	return exists
+	return set.contains(member), nil
 }
 
-func (s *MemoryStore) SMembers(key string) ([]string, bool) {
+func (s *MemoryStore) SMembers(key string) ([]string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, ok := s.getSet(key)
+	set, ok, err := s.getSet(key)
 	if !ok {
-		return nil, false
+		return nil, false, err
 	}
+	s.touch(key)
 
-	members := make([]string, 0, len(set))
-	for m := range set {
+	members := make([]string, 0, set.size())
+	set.forEach(func(m string) {
 		members = append(members, m)
-	}
+	})
 
-	return members, true
+	return members, true, nil
 }
 
-func (s *MemoryStore) SCard(key string) int {
+func (s *MemoryStore) SCard(key string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, ok := s.getSet(key)
+	set, ok, err := s.getSet(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
+	s.touch(key)
 
-	return len(set)
+	return set.size(), nil
 }
 
-func (s *MemoryStore) SUnion(keys ...string) []string {
+func (s *MemoryStore) SUnion(keys ...string) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	union := make(map[string]struct{}, 0)
 
 	for _, key := range keys {
-		set, ok := s.getSet(key)
+		set, ok, err := s.getSet(key)
+		if err != nil {
+			return nil, err
+		}
 		if !ok {
 			continue
 		}
-		for member := range set {
+		s.touch(key)
+		set.forEach(func(member string) {
 			union[member] = struct{}{}
-		}
+		})
 	}
 
 	result := make([]string, 0, len(union))
@@ -113,5 +132,5 @@ func (s *MemoryStore) SUnion(keys ...string) []string {
 		result = append(result, member)
 	}
 
-	return result
+	return result, nil
 }
@@ -0,0 +1,290 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SortOptions struct {
+	By     string
+	NoSort bool
+	Offset int
+	Count  int
+	Get    []string
+	Desc   bool
+	Alpha  bool
+	Store  string
+}
+
+// ParseSortArgs parses the options following SORT key. readOnly rejects
+// STORE, for SORT_RO.
+func ParseSortArgs(args []string, readOnly bool) (SortOptions, error) {
+	opts := SortOptions{Count: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ASC":
+			opts.Desc = false
+		case "DESC":
+			opts.Desc = true
+		case "ALPHA":
+			opts.Alpha = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			count, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return opts, errors.New("value is not an integer or out of range")
+			}
+			opts.Offset, opts.Count = offset, count
+			i += 2
+		case "BY":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			opts.By = args[i+1]
+			// A pattern without '*' can't reference the elements, so
+			// there is nothing to sort by.
+			if !strings.Contains(opts.By, "*") {
+				opts.NoSort = true
+			}
+			i++
+		case "GET":
+			if i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			opts.Get = append(opts.Get, args[i+1])
+			i++
+		case "STORE":
+			if readOnly || i+1 >= len(args) {
+				return opts, errors.New("syntax error")
+			}
+			opts.Store = args[i+1]
+			i++
+		default:
+			return opts, errors.New("syntax error")
+		}
+	}
+	return opts, nil
+}
+
+// lookupPattern resolves a BY or GET pattern for elem: "#" is elem itself,
+// the first '*' is replaced by elem and "->field" reads a hash field.
+// Callers must hold s.mu.
+func (s *MemoryStore) lookupPattern(pattern, elem string) (string, bool, error) {
+	if pattern == "#" {
+		return elem, true, nil
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return "", false, nil
+	}
+
+	keyPattern, field := pattern, ""
+	if arrow := strings.LastIndex(pattern, "->"); arrow > star && arrow+2 < len(pattern) {
+		keyPattern, field = pattern[:arrow], pattern[arrow+2:]
+	}
+	key := keyPattern[:star] + elem + keyPattern[star+1:]
+
+	if field != "" {
+		hash, ok, err := s.getHash(key)
+		if !ok {
+			return "", false, err
+		}
+		val, ok := hash.get(field)
+		return val, ok, nil
+	}
+	val, err := s.value(key)
+	if val == nil || err != nil {
+		return "", false, err
+	}
+	str, ok := stringValue(val)
+	return str, ok, nil
+}
+
+type sortElem struct {
+	value string
+	score float64
+	by    string
+	hasBy bool
+}
+
+// Sort implements SORT and SORT_RO for lists and sets. Missing GET lookups
+// are returned as nil. With opts.Store the result replaces the destination
+// list and only its length is meaningful.
+func (s *MemoryStore) Sort(key string, opts SortOptions) ([]*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var elems []string
+	val, err := s.value(key)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case nil:
+	case []string:
+		elems = append([]string(nil), v...)
+	case setObject:
+		v.forEach(func(member string) {
+			elems = append(elems, member)
+		})
+		// Sets have no order of their own; keep NOSORT output stable.
+		if opts.NoSort {
+			sort.Strings(elems)
+		}
+	default:
+		return nil, errWrongType
+	}
+
+	items := make([]sortElem, len(elems))
+	for i, e := range elems {
+		items[i].value = e
+		if opts.NoSort {
+			continue
+		}
+		cmpVal, found := e, true
+		if opts.By != "" {
+			if cmpVal, found, err = s.lookupPattern(opts.By, e); err != nil {
+				return nil, err
+			}
+		}
+		items[i].by = cmpVal
+		if opts.Alpha {
+			// Missing BY values sort before everything else.
+			items[i].hasBy = found
+			continue
+		}
+		// Like Redis, a missing BY value sorts as 0 numerically.
+		items[i].hasBy = true
+		if found {
+			score, err := strconv.ParseFloat(strings.TrimSpace(cmpVal), 64)
+			if err != nil {
+				return nil, errors.New("One or more scores can't be converted into double")
+			}
+			items[i].score = score
+		}
+	}
+
+	if !opts.NoSort {
+		sort.SliceStable(items, func(i, j int) bool {
+			cmp := compareSortElems(items[i], items[j], opts.Alpha)
+			if opts.Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+
+	start, end := sortLimit(len(items), opts.Offset, opts.Count)
+	items = items[start:end]
+
+	result := make([]*string, 0, len(items))
+	for _, item := range items {
+		if len(opts.Get) == 0 {
+			v := item.value
+			result = append(result, &v)
+			continue
+		}
+		for _, pattern := range opts.Get {
+			v, ok, err := s.lookupPattern(pattern, item.value)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				result = append(result, &v)
+			} else {
+				result = append(result, nil)
+			}
+		}
+	}
+
+	if opts.Store != "" {
+		s.storeSortResult(opts.Store, result)
+	} else {
+		s.touch(key)
+	}
+	return result, nil
+}
+
+// compareSortElems orders by score (or string with alpha); ties and
+// missing BY values fall back to comparing the elements themselves.
+func compareSortElems(a, b sortElem, alpha bool) int {
+	cmp := 0
+	switch {
+	case a.hasBy && !b.hasBy:
+		cmp = 1
+	case !a.hasBy && b.hasBy:
+		cmp = -1
+	case !a.hasBy && !b.hasBy:
+	case alpha:
+		cmp = strings.Compare(a.by, b.by)
+	case a.score < b.score:
+		cmp = -1
+	case a.score > b.score:
+		cmp = 1
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.value, b.value)
+	}
+	return cmp
+}
+
+// sortLimit clamps LIMIT offset count to the bounds of n elements.
+func sortLimit(n, offset, count int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > n {
+		offset = n
+	}
+	end := n
+	if count >= 0 && count < n-offset {
+		end = offset + count
+	}
+	return offset, end
+}
+
+// storeSortResult replaces dst with the sorted elements, logging the
+// concrete result rather than the SORT so replay doesn't depend on the
+// keys BY and GET read. Callers must hold s.mu.
+func (s *MemoryStore) storeSortResult(dst string, result []*string) {
+	list := make([]string, 0, len(result))
+	for _, v := range result {
+		if v == nil {
+			list = append(list, "")
+		} else {
+			list = append(list, *v)
+		}
+	}
+
+	s.removeKey(dst)
+	if len(list) > 0 {
+		s.setValue(dst, list)
+		s.touch(dst)
+	}
+
+	if s.aof != nil {
+		s.aof.AppendCommand("DEL", dst)
+		if len(list) > 0 {
+			s.aof.AppendCommand("RPUSH", append([]string{dst}, list...)...)
+		}
+	}
+}
+
+// sortReply formats the SORT result as a RESP array.
+func sortReply(result []*string) string {
+	resp := fmt.Sprintf("*%d\r\n", len(result))
+	for _, v := range result {
+		if v == nil {
+			resp += "$-1\r\n"
+		} else {
+			resp += fmt.Sprintf("$%d\r\n%s\r\n", len(*v), *v)
+		}
+	}
+	return resp
+}
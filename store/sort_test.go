@@ -0,0 +1,171 @@
+package store
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// run executes a command through ExecuteRaw and fails the test on an
+// error reply.
+func run(t *testing.T, s *MemoryStore, cmd string, args ...string) string {
+	t.Helper()
+	reply := s.ExecuteRaw(cmd, args)
+	if strings.HasPrefix(reply, "-") {
+		t.Fatalf("%s %v = %q", cmd, args, reply)
+	}
+	return reply
+}
+
+// sortResult runs SORT with args and joins the result with spaces,
+// showing missing GET lookups as "nil".
+func sortResult(t *testing.T, s *MemoryStore, key string, args ...string) string {
+	t.Helper()
+	opts, err := ParseSortArgs(args, false)
+	if err != nil {
+		t.Fatalf("ParseSortArgs(%v): %v", args, err)
+	}
+	result, err := s.Sort(key, opts)
+	if err != nil {
+		t.Fatalf("SORT %s %v: %v", key, args, err)
+	}
+	items := make([]string, len(result))
+	for i, v := range result {
+		if v == nil {
+			items[i] = "nil"
+		} else {
+			items[i] = *v
+		}
+	}
+	return strings.Join(items, " ")
+}
+
+func TestSort(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "RPUSH", "nums", "3", "10", "1", "2")
+	run(t, s, "RPUSH", "words", "pear", "apple", "fig")
+	run(t, s, "SADD", "set", "b", "c", "a")
+	for _, elem := range []string{"1", "2", "3", "10"} {
+		run(t, s, "SET", "weight_"+elem, map[string]string{"1": "40", "2": "30", "3": "20", "10": "10"}[elem])
+		run(t, s, "HSET", "obj_"+elem, "name", "n"+elem)
+	}
+
+	tests := []struct {
+		key  string
+		args string
+		want string
+	}{
+		{"nums", "", "1 2 3 10"},
+		{"nums", "DESC", "10 3 2 1"},
+		{"words", "ALPHA", "apple fig pear"},
+		{"words", "ALPHA DESC", "pear fig apple"},
+		{"set", "ALPHA", "a b c"},
+		{"missing", "", ""},
+
+		// BY reads the weights; a pattern without '*' skips sorting.
+		{"nums", "BY weight_*", "10 3 2 1"},
+		{"nums", "BY weight_* DESC", "1 2 3 10"},
+		{"nums", "BY nosort", "3 10 1 2"},
+		{"set", "BY nosort", "a b c"},
+		// Missing BY values sort as 0.
+		{"nums", "BY nokey_*", "1 10 2 3"},
+		{"nums", "BY obj_*->name ALPHA", "1 10 2 3"},
+
+		// GET, with '#' for the element itself and hash fields.
+		{"nums", "GET #", "1 2 3 10"},
+		{"nums", "GET weight_*", "40 30 20 10"},
+		{"nums", "GET # GET obj_*->name", "1 n1 2 n2 3 n3 10 n10"},
+		{"nums", "GET nokey_*", "nil nil nil nil"},
+		{"nums", "BY nosort GET obj_*->missing", "nil nil nil nil"},
+
+		// LIMIT.
+		{"nums", "LIMIT 0 2", "1 2"},
+		{"nums", "LIMIT 1 2", "2 3"},
+		{"nums", "LIMIT 3 10", "10"},
+		{"nums", "LIMIT 4 1", ""},
+		{"nums", "LIMIT 100 1", ""},
+		{"nums", "LIMIT 0 0", ""},
+		{"nums", "LIMIT -5 2", "1 2"},
+		{"nums", "LIMIT 1 -1", "2 3 10"},
+	}
+	for _, tc := range tests {
+		if got := sortResult(t, s, tc.key, strings.Fields(tc.args)...); got != tc.want {
+			t.Errorf("SORT %s %s = %q, want %q", tc.key, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestSortLimitBounds(t *testing.T) {
+	tests := []struct {
+		n, offset, count int
+		start, end       int
+	}{
+		{4, 0, -1, 0, 4},
+		{4, 1, 2, 1, 3},
+		{4, 2, 10, 2, 4},
+		{4, 10, 1, 4, 4},
+		{4, -1, 1, 0, 1},
+		{4, 1, math.MaxInt, 1, 4},
+		{4, math.MaxInt, math.MaxInt, 4, 4},
+	}
+	for _, tc := range tests {
+		start, end := sortLimit(tc.n, tc.offset, tc.count)
+		if start != tc.start || end != tc.end {
+			t.Errorf("sortLimit(%d, %d, %d) = %d, %d, want %d, %d",
+				tc.n, tc.offset, tc.count, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestSortErrors(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "RPUSH", "words", "pear", "apple")
+	run(t, s, "SET", "str", "x")
+
+	if reply := s.ExecuteRaw("SORT", []string{"words"}); !strings.Contains(reply, "can't be converted") {
+		t.Errorf("numeric SORT of words = %q, want a conversion error", reply)
+	}
+	if reply := s.ExecuteRaw("SORT", []string{"str"}); !strings.HasPrefix(reply, "-") {
+		t.Errorf("SORT of a string = %q, want an error", reply)
+	}
+	if reply := s.ExecuteRaw("SORT_RO", []string{"words", "STORE", "dst"}); !strings.HasPrefix(reply, "-ERR syntax") {
+		t.Errorf("SORT_RO with STORE = %q, want a syntax error", reply)
+	}
+	if reply := s.ExecuteRaw("SORT", []string{"words", "LIMIT", "0"}); !strings.HasPrefix(reply, "-ERR syntax") {
+		t.Errorf("SORT with a short LIMIT = %q, want a syntax error", reply)
+	}
+}
+
+func TestSortStore(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	run(t, s, "RPUSH", "nums", "3", "1", "2")
+	run(t, s, "SET", "weight_2", "w2")
+
+	if reply := run(t, s, "SORT", "nums", "DESC", "STORE", "dst"); reply != ":3\r\n" {
+		t.Errorf("SORT STORE = %q, want :3", reply)
+	}
+	if reply := run(t, s, "LRANGE", "dst", "0", "-1"); reply != "*3\r\n$1\r\n3\r\n$1\r\n2\r\n$1\r\n1\r\n" {
+		t.Errorf("LRANGE dst = %q, want 3 2 1", reply)
+	}
+
+	// Missing GET lookups are stored as empty strings.
+	run(t, s, "SORT", "nums", "GET", "weight_*", "STORE", "dst")
+	if reply := run(t, s, "LRANGE", "dst", "0", "-1"); reply != "*3\r\n$0\r\n\r\n$2\r\nw2\r\n$0\r\n\r\n" {
+		t.Errorf("LRANGE dst = %q, want \"\" w2 \"\"", reply)
+	}
+
+	// An empty result deletes the destination, whatever its type.
+	run(t, s, "SET", "str", "x")
+	for _, dst := range []string{"dst", "str"} {
+		if reply := run(t, s, "SORT", "missing", "STORE", dst); reply != ":0\r\n" {
+			t.Errorf("SORT STORE %s of a missing key = %q, want :0", dst, reply)
+		}
+		if reply := run(t, s, "EXISTS", dst); reply != ":0\r\n" {
+			t.Errorf("EXISTS %s after an empty SORT STORE = %q, want :0", dst, reply)
+		}
+	}
+	run(t, s, "SORT", "nums", "LIMIT", "5", "1", "STORE", "nums")
+	if reply := run(t, s, "EXISTS", "nums"); reply != ":0\r\n" {
+		t.Errorf("EXISTS nums after storing an empty LIMIT onto itself = %q, want :0", reply)
+	}
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"time"
+
+	"redis-clone/persistance"
+)
+
+// Tiered storage: once the heap grows past tiered-storage-max-memory, the
+// values of the least recently (lru) or least frequently (lfu) used keys
+// are moved to a ColdStore on disk. The key stays in the keyspace with a
+// coldValue in place of its value, and the first command that needs the
+// value loads it back into memory. Snapshots and AOF rewrites read cold
+// values from disk without loading them.
+const (
+	tieringInterval = 100 * time.Millisecond
+	tieringSamples  = 5   // keys sampled per eviction, like maxmemory-samples
+	tieringBatch    = 100 // keys moved per acquisition of s.mu
+	minColdString   = 64  // shorter strings aren't worth a disk read
+	// Most ticks skipped after a pass that forced a collection in vain.
+	tieringMaxBackoff = 64
+)
+
+// coldValue stands in for a value moved to disk. Its type is kept so TYPE
+// and SCAN TYPE don't need to load it.
+type coldValue struct {
+	ref *persistance.ColdRef
+	typ byte
+}
+
+// tieringStats backs the tiered section of INFO.
+type tieringStats struct {
+	spilled int64 // values moved to disk
+	loaded  int64 // values loaded back
+}
+
+var coldTypeNames = map[byte]string{
+	persistance.TypeString: "string",
+	persistance.TypeList:   "list",
+	persistance.TypeSet:    "set",
+	persistance.TypeHash:   "hash",
+}
+
+// object reads the value back from disk.
+func (cv *coldValue) object() (persistance.Object, error) {
+	payload, err := cv.ref.Load()
+	if err != nil {
+		return persistance.Object{}, fmt.Errorf("reading the tiered store: %w", err)
+	}
+	obj, err := persistance.ParseDumpPayload(payload)
+	if err != nil {
+		return persistance.Object{}, fmt.Errorf("reading the tiered store: %w", err)
+	}
+	return obj, nil
+}
+
+// ColdReadError is returned when a value moved to disk can't be read
+// back. The key stays on disk, so the next command may succeed.
+type ColdReadError struct {
+	Key string
+	Err error
+}
+
+func (e *ColdReadError) Error() string {
+	return fmt.Sprintf("ERR can't load key '%s': %v", e.Key, e.Err)
+}
+
+func (e *ColdReadError) Unwrap() error {
+	return e.Err
+}
+
+// value returns the value of key, or nil if there is none, loading it
+// back into memory if it was moved to disk. Callers must hold s.mu.
+func (s *MemoryStore) value(key string) (interface{}, error) {
+	val := s.data[key]
+	cv, cold := val.(*coldValue)
+	if !cold {
+		return val, nil
+	}
+	obj, err := cv.object()
+	if err == nil {
+		val, err = s.fromObject(obj)
+	}
+	if err != nil {
+		log.Printf("[TIER] Can't load key %q: %v", key, err)
+		return nil, &ColdReadError{Key: key, Err: err}
+	}
+	s.data[key] = val
+	s.releaseCold(key, cv)
+	s.tieringStats.loaded++
+	return val, nil
+}
+
+// releaseCold frees the disk copy of a value that left the keyspace. A
+// background save may still have to read it; it is freed when the save
+// is done then. Callers must hold s.mu.
+func (s *MemoryStore) releaseCold(key string, cv *coldValue) {
+	if s.bgsave != nil {
+		if val, ok := s.bgsave.data[key]; ok && val == interface{}(cv) {
+			s.bgsave.coldRefs = append(s.bgsave.coldRefs, cv.ref)
+			return
+		}
+	}
+	cv.ref.Free()
+}
+
+// releaseAllCold frees the disk copies of every value before the keyspace
+// is replaced as a whole. Callers must hold s.mu.
+func (s *MemoryStore) releaseAllCold() {
+	if s.cold == nil {
+		return
+	}
+	for key, val := range s.data {
+		if cv, ok := val.(*coldValue); ok {
+			s.releaseCold(key, cv)
+		}
+	}
+}
+
+// finishBackground ends the running background save or AOF rewrite.
+// Callers must hold s.mu.
+func (s *MemoryStore) finishBackground() {
+	for _, ref := range s.bgsave.coldRefs {
+		ref.Free()
+	}
+	s.bgsave = nil
+}
+
+func (s *MemoryStore) tieringDaemon() {
+	ticker := time.NewTicker(tieringInterval)
+	// A pass that forces a collection but finds nothing to move would
+	// be repeated every tick, so such passes back off exponentially.
+	backoff, wait := 1, 0
+	for range ticker.C {
+		if wait > 0 {
+			wait--
+		} else if s.spillColdValues() {
+			backoff = 1
+		} else {
+			wait = backoff
+			backoff = min(backoff*2, tieringMaxBackoff)
+		}
+
+		s.mu.Lock()
+		cold := s.cold
+		s.mu.Unlock()
+		if cold != nil {
+			if _, err := cold.Compact(); err != nil {
+				log.Println("[TIER] Compaction failed:", err)
+			}
+		}
+	}
+}
+
+// heapMetric reads one of the runtime's heap metrics, in bytes.
+func heapMetric(name string) int64 {
+	sample := []metrics.Sample{{Name: name}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
+
+// spillColdValues moves values to disk until the heap is back under
+// tiered-storage-max-memory. It returns false if it forced a collection
+// and then freed nothing.
+func (s *MemoryStore) spillColdValues() bool {
+	s.mu.Lock()
+	limit := s.config.TieredStorageMaxMemory
+	s.mu.Unlock()
+	// The heap objects include garbage not collected yet, so only the
+	// live heap as marked by a collection counts.
+	if limit == 0 || heapMetric("/memory/classes/heap/objects:bytes") <= limit {
+		return true
+	}
+	runtime.GC()
+	need := heapMetric("/gc/heap/live:bytes") - limit
+	var total int64
+	for need > 0 {
+		freed, err := s.spillBatch(need)
+		if err != nil {
+			log.Println("[TIER] Can't move values to disk:", err)
+			break
+		}
+		if freed == 0 {
+			break
+		}
+		need -= freed
+		total += freed
+	}
+	return total > 0
+}
+
+// spillBatch moves up to tieringBatch values to disk, stopping once about
+// need bytes were freed, and returns the bytes freed.
+func (s *MemoryStore) spillBatch(need int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.TieredStorageMaxMemory == 0 {
+		return 0, nil
+	}
+	if s.cold == nil {
+		cold, err := persistance.OpenColdStore(s.config.TieredStorageDir)
+		if err != nil {
+			return 0, err
+		}
+		cold.SetKeyring(s.keyring)
+		s.cold = cold
+		log.Println("[TIER] Moving cold values to", s.config.TieredStorageDir)
+	}
+
+	var freed int64
+	for i := 0; i < tieringBatch && freed < need; i++ {
+		key, ok := s.pickColdKey()
+		if !ok {
+			break
+		}
+		n, err := s.spill(key)
+		if err != nil {
+			return freed, err
+		}
+		freed += n
+	}
+	return freed, nil
+}
+
+// pickColdKey samples keys with values in memory and returns the least
+// recently or least frequently used one, by tiered-storage-policy. Map
+// iteration starts at a random key, which makes the sample. Callers must
+// hold s.mu.
+func (s *MemoryStore) pickColdKey() (string, bool) {
+	now := time.Now()
+	best, found := "", false
+	var bestScore int64
+	sampled := 0
+	for key, val := range s.data {
+		if !spillable(val) {
+			continue
+		}
+		var score int64
+		if info, ok := s.access[key]; ok {
+			if s.config.TieredStoragePolicy == "lfu" {
+				s.lfuDecay(info, now)
+				score = int64(info.freq)
+			} else {
+				score = info.lastAccess
+			}
+		}
+		if !found || score < bestScore {
+			best, bestScore, found = key, score, true
+		}
+		if sampled++; sampled == tieringSamples {
+			break
+		}
+	}
+	return best, found
+}
+
+func spillable(val interface{}) bool {
+	switch v := val.(type) {
+	case *coldValue, int64:
+		return false
+	case string:
+		return len(v) >= minColdString
+	}
+	return true
+}
+
+// spill moves the value of key to disk and returns roughly how much
+// memory that frees. Callers must hold s.mu.
+func (s *MemoryStore) spill(key string) (int64, error) {
+	val := s.data[key]
+	obj, err := toObject(val)
+	if err != nil {
+		return 0, fmt.Errorf("key %q: %w", key, err)
+	}
+	payload, err := persistance.DumpPayload(obj)
+	if err != nil {
+		return 0, err
+	}
+	ref, err := s.cold.Put(payload)
+	if err != nil {
+		return 0, err
+	}
+	s.data[key] = &coldValue{ref: ref, typ: obj.Type}
+	s.tieringStats.spilled++
+	// Every element costs a string header and a slot besides its bytes.
+	return int64(len(payload) + 32*len(obj.Items)), nil
+}
+
+// applyTieringConfig reacts to changes of the tiered storage parameters.
+// The directory is immutable, so only the keyring can change under an
+// open cold store. Callers must hold s.mu.
+func (s *MemoryStore) applyTieringConfig() {
+	if s.cold != nil {
+		s.cold.SetKeyring(s.keyring)
+	}
+}
+
+func (s *MemoryStore) infoTiered(b *strings.Builder) {
+	enabled := 0
+	if s.config.TieredStorageMaxMemory > 0 {
+		enabled = 1
+	}
+	var stats persistance.ColdStats
+	if s.cold != nil {
+		stats = s.cold.Stats()
+	}
+	fmt.Fprintf(b, "tiered_storage_enabled:%d\r\n", enabled)
+	fmt.Fprintf(b, "tiered_heap_live_bytes:%d\r\n", heapMetric("/gc/heap/live:bytes"))
+	fmt.Fprintf(b, "tiered_cold_keys:%d\r\n", stats.Values)
+	fmt.Fprintf(b, "tiered_disk_bytes:%d\r\n", stats.Size)
+	fmt.Fprintf(b, "tiered_disk_dead_bytes:%d\r\n", stats.DeadSize)
+	fmt.Fprintf(b, "tiered_segments:%d\r\n", stats.Segments)
+	fmt.Fprintf(b, "tiered_compactions:%d\r\n", stats.Compactions)
+	fmt.Fprintf(b, "tiered_spilled_keys:%d\r\n", s.tieringStats.spilled)
+	fmt.Fprintf(b, "tiered_loaded_keys:%d\r\n", s.tieringStats.loaded)
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"redis-clone/persistance"
+)
+
+// spillKeys moves the values of keys to a cold store in a temporary
+// directory and returns the directory.
+func spillKeys(t *testing.T, s *MemoryStore, keys ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	cold, err := persistance.OpenColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cold.Close() })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cold = cold
+	for _, key := range keys {
+		if _, err := s.spill(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestColdValuesLoadBack(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	value := strings.Repeat("v", 2*minColdString)
+	s.Set("str", value)
+	run(t, s, "RPUSH", "list", "a", "b")
+	run(t, s, "HSET", "hash", "f", "v")
+	spillKeys(t, s, "str", "list", "hash")
+
+	if reply := run(t, s, "TYPE", "list"); reply != "+list\r\n" {
+		t.Errorf("TYPE of a cold list = %q, want +list", reply)
+	}
+	if got, ok, err := s.Get("str"); err != nil || !ok || got != value {
+		t.Errorf("Get(str) = %.10q, %v, %v, want the value back", got, ok, err)
+	}
+	if reply := run(t, s, "LRANGE", "list", "0", "-1"); reply != "*2\r\n$1\r\na\r\n$1\r\nb\r\n" {
+		t.Errorf("LRANGE of a cold list = %q", reply)
+	}
+	if reply := run(t, s, "HGET", "hash", "f"); reply != "$1\r\nv\r\n" {
+		t.Errorf("HGET of a cold hash = %q", reply)
+	}
+	if _, cold := s.data["str"].(*coldValue); cold {
+		t.Error("str is still cold after being read")
+	}
+}
+
+// TestColdReadErrorFailsCommand reads values whose segment was lost. The
+// commands fail with an error, and the keys stay for a later attempt.
+func TestColdReadErrorFailsCommand(t *testing.T) {
+	s := NewMemoryStoreWithAOF(nil)
+	s.Set("str", strings.Repeat("v", 2*minColdString))
+	run(t, s, "SADD", "set", "a", "b")
+	run(t, s, "RPUSH", "src", "x")
+	dir := spillKeys(t, s, "str", "set", "src")
+
+	segments, err := filepath.Glob(filepath.Join(dir, "cold-*.seg"))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("no cold segments in %s: %v", dir, err)
+	}
+	for _, path := range segments {
+		if err := os.Truncate(path, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, cmd := range [][]string{
+		{"GET", "str"},
+		{"SMEMBERS", "set"},
+		{"SADD", "set", "c"},
+		{"SORT", "set", "ALPHA"},
+		{"SSCAN", "set", "0"},
+		{"OBJECT", "ENCODING", "set"},
+		{"DUMP", "set"},
+		{"RENAME", "src", "dst"},
+		{"COPY", "src", "dst"},
+		{"LPOP", "src"},
+	} {
+		reply := s.ExecuteRaw(cmd[0], cmd[1:])
+		if !strings.HasPrefix(reply, "-ERR can't load key") {
+			t.Errorf("%s = %q, want a load error", strings.Join(cmd, " "), reply)
+		}
+	}
+	if reply := run(t, s, "EXISTS", "str", "set", "src"); reply != ":3\r\n" {
+		t.Errorf("EXISTS after failed loads = %q, want :3", reply)
+	}
+	if reply := run(t, s, "EXISTS", "dst"); reply != ":0\r\n" {
+		t.Errorf("EXISTS dst after a failed RENAME = %q, want :0", reply)
+	}
+}